@@ -3,13 +3,27 @@ package apipaths
 const (
 	AuthGroup = "/auth"
 
+	// JWKSPath is served at the root, outside of API_PATH_PREFIX
+	JWKSPath = "/.well-known/jwks.json"
+
 	GitHubLoginRel    = "/login-github"
 	GitHubCallbackRel = "/login-github-callback"
 	GoogleLoginRel    = "/login-google"
 	GoogleCallbackRel = "/login-google-callback"
+	LineLoginRel      = "/login-line"
+	LineCallbackRel   = "/login-line-callback"
+	OIDCRel           = "/oidc" // OIDC_PROVIDERS log in at /oidc/<name> and come back to /oidc/<name>/callback
+	VerifyEmailRel    = "/verify-email"
+	ResetPasswordRel  = "/reset-password"
+	MagicLinkRel      = "/magic-link"
 
 	GitHubLoginPath    = AuthGroup + GitHubLoginRel
 	GitHubCallbackPath = AuthGroup + GitHubCallbackRel
 	GoogleLoginPath    = AuthGroup + GoogleLoginRel
 	GoogleCallbackPath = AuthGroup + GoogleCallbackRel
+	LineLoginPath      = AuthGroup + LineLoginRel
+	LineCallbackPath   = AuthGroup + LineCallbackRel
+	VerifyEmailPath    = AuthGroup + VerifyEmailRel
+	ResetPasswordPath  = AuthGroup + ResetPasswordRel
+	MagicLinkPath      = AuthGroup + MagicLinkRel
 )
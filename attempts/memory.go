@@ -0,0 +1,71 @@
+package attempts
+
+import (
+	"sync"
+	"time"
+)
+
+// maxMemoryRecords bounds the memory store, stale records are swept when it is reached
+const maxMemoryRecords = 100000
+
+// memoryRecordTTL is how long an untouched record is kept before a sweep may drop it
+const memoryRecordTTL = 24 * time.Hour
+
+// MemoryStore keeps records in process memory
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Get(key string) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryStore) AddFailure(key string, now time.Time, window time.Duration) (Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.records[key]
+	if now.Sub(r.LastFailure) > window {
+		r.Failures = 0
+	}
+	r.Failures++
+	r.LastFailure = now
+
+	if _, exists := s.records[key]; !exists && len(s.records) >= maxMemoryRecords {
+		s.sweep(now)
+	}
+	s.records[key] = r
+	return r, nil
+}
+
+func (s *MemoryStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.records[key]
+	r.LockedUntil = until
+	s.records[key] = r
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// sweep drops records that are neither locked nor recently failed, callers hold mu
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, r := range s.records {
+		if !r.Locked(now) && now.Sub(r.LastFailure) > memoryRecordTTL {
+			delete(s.records, key)
+		}
+	}
+}
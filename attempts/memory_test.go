@@ -0,0 +1,36 @@
+package attempts
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Now()
+
+	r, err := s.Get("ip:1.2.3.4")
+	require.NoError(t, err)
+	assert.Zero(t, r.Failures)
+
+	for i := 1; i <= 3; i++ {
+		r, err = s.AddFailure("ip:1.2.3.4", now.Add(time.Duration(i)*time.Minute), 10*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, i, r.Failures)
+	}
+
+	r, _ = s.AddFailure("ip:1.2.3.4", now.Add(30*time.Minute), 10*time.Minute)
+	assert.Equal(t, 1, r.Failures, "Failures older than the window are forgotten")
+
+	require.NoError(t, s.Lock("ip:1.2.3.4", now.Add(time.Hour)))
+	r, _ = s.Get("ip:1.2.3.4")
+	assert.True(t, r.Locked(now))
+	assert.False(t, r.Locked(now.Add(2*time.Hour)))
+
+	require.NoError(t, s.Reset("ip:1.2.3.4"))
+	r, _ = s.Get("ip:1.2.3.4")
+	assert.Equal(t, Record{}, r)
+}
@@ -0,0 +1,54 @@
+package attempts
+
+import (
+	"sync"
+	"time"
+)
+
+// Record is the recent failure history of one key, e.g. an IP address or an account
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time // zero when not locked
+}
+
+// Locked reports whether the key is locked at now
+func (r Record) Locked(now time.Time) bool {
+	return now.Before(r.LockedUntil)
+}
+
+// Store keeps attempt records. MemoryStore is enough for a single instance, deployments
+// with several instances need a shared implementation (e.g. Redis) set with SetDefault.
+type Store interface {
+	// Get returns the record of key, a zero Record when there is none
+	Get(key string) (Record, error)
+	// AddFailure counts a failure at now and returns the updated record. Failures are
+	// forgotten when the previous one is older than window.
+	AddFailure(key string, now time.Time, window time.Duration) (Record, error)
+	// Lock locks key until the given time
+	Lock(key string, until time.Time) error
+	// Reset forgets key, including its lock
+	Reset(key string) error
+}
+
+var (
+	defaultStore Store
+	defaultMu    sync.Mutex
+)
+
+// Default returns the store used by the login throttling, a MemoryStore unless replaced
+func Default() Store {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultStore == nil {
+		defaultStore = NewMemoryStore()
+	}
+	return defaultStore
+}
+
+// SetDefault replaces the store returned by Default
+func SetDefault(s Store) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultStore = s
+}
@@ -0,0 +1,116 @@
+// Package audit appends authentication and admin actions to the audit trail
+// (models.AuditEvent).
+package audit
+
+import (
+	"encoding/json"
+	"log"
+
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Outcomes of an audited action
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure" // wrong credentials, invalid or expired token or code
+	OutcomeDenied  = "denied"  // valid credentials, but the account may not do it (disabled, locked out)
+)
+
+// Actions of the audit trail, "auth.*" are done by users on their own account and
+// "admin.*" by admins on other accounts
+const (
+	ActionRegister             = "auth.register"
+	ActionLogin                = "auth.login"
+	ActionLogout               = "auth.logout"
+	ActionRefresh              = "auth.refresh" // only failures are recorded
+	ActionLockout              = "auth.lockout"
+	ActionMFAVerify            = "auth.mfa.verify"
+	ActionMFAEnable            = "auth.mfa.enable"
+	ActionMFADisable           = "auth.mfa.disable"
+	ActionRecoveryCodes        = "auth.mfa.recovery_codes"
+	ActionPasswordChange       = "auth.password.change"
+	ActionPasswordResetRequest = "auth.password.reset_request"
+	ActionPasswordReset        = "auth.password.reset"
+	ActionEmailVerify          = "auth.email.verify"
+	ActionIdentityLink         = "auth.identity.link"
+	ActionIdentityUnlink       = "auth.identity.unlink"
+	ActionAPIKeyCreate         = "auth.api_key.create"
+	ActionAPIKeyRevoke         = "auth.api_key.revoke"
+	ActionProfileUpdate        = "auth.profile.update"
+	ActionAccountDelete        = "auth.account.delete"
+	ActionPasskeyAdd           = "auth.passkey.add"
+	ActionPasskeyRemove        = "auth.passkey.remove"
+	ActionSessionRevoke        = "auth.session.revoke"
+	ActionMagicLinkRequest     = "auth.magic_link.request"
+	ActionGuestCreate          = "auth.guest.create"
+	ActionGuestUpgrade         = "auth.guest.upgrade"
+
+	ActionAdminRoleChange  = "admin.user.role_change"
+	ActionAdminDisable     = "admin.user.disable"
+	ActionAdminEnable      = "admin.user.enable"
+	ActionAdminDelete      = "admin.user.delete"
+	ActionAdminUnlockLogin = "admin.lockout.unlock"
+	ActionAdminRevokeToken = "admin.token.revoke"
+)
+
+// Entry is one action to record
+type Entry struct {
+	Action       string
+	Outcome      string // OutcomeSuccess when empty
+	ActorID      uint   // 0 means the authenticated user of the request, if any
+	TargetUserID uint   // the account the action was about, 0 when unknown
+	Details      map[string]any
+}
+
+// Write appends e to the audit trail using tx, so it can be part of the transaction of the action
+func Write(tx *gorm.DB, c *gin.Context, e Entry) error {
+	event := models.AuditEvent{
+		Action:    e.Action,
+		Outcome:   e.Outcome,
+		IP:        c.ClientIP(),
+		UserAgent: truncate(c.Request.UserAgent(), 256),
+	}
+	if event.Outcome == "" {
+		event.Outcome = OutcomeSuccess
+	}
+
+	actorID := e.ActorID
+	if actorID == 0 {
+		actorID = utils.GetUserID(c)
+	}
+	if actorID != 0 {
+		event.ActorID = &actorID
+	}
+	if e.TargetUserID != 0 {
+		targetID := e.TargetUserID
+		event.TargetUserID = &targetID
+	}
+
+	if len(e.Details) > 0 {
+		b, err := json.Marshal(e.Details)
+		if err != nil {
+			return err
+		}
+		event.Details = truncate(string(b), 1024)
+	}
+	return tx.Create(&event).Error
+}
+
+// Record is Write for actions that already happened, a failure is only logged so a broken
+// audit trail never fails a login
+func Record(db *gorm.DB, c *gin.Context, e Entry) {
+	if err := Write(db, c, e); err != nil {
+		log.Println("[Audit] record error:", err, "action:", e.Action)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
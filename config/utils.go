@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -51,3 +52,15 @@ func GetVariableAsTimeDuration(varName string) (time.Duration, error) {
 	}
 	return duration, nil
 }
+
+func GetVariableAsInt(varName string) (int, error) {
+	value, err := GetVariableAsString(varName)
+	if err != nil {
+		return 0, err
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing %s as int: %v", varName, err)
+	}
+	return number, nil
+}
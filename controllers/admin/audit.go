@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ListAuditEvents returns the audit trail, newest first.
+// Query: action (exact, or a prefix such as "auth.*"), outcome, actor_id, target_user_id,
+// user_id (actor or target), ip, since and until (RFC 3339), page, page_size.
+func ListAuditEvents(c *gin.Context, db *gorm.DB) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultUserPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxUserPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page_size"})
+		return
+	}
+
+	query := db.Model(&models.AuditEvent{})
+	if action := c.Query("action"); action != "" {
+		if prefix, ok := strings.CutSuffix(action, "*"); ok {
+			query = query.Where("action LIKE ? ESCAPE '!'", escapeLike(prefix)+"%")
+		} else {
+			query = query.Where("action = ?", action)
+		}
+	}
+	if outcome := c.Query("outcome"); outcome != "" {
+		query = query.Where("outcome = ?", outcome)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	for _, filter := range []struct{ param, where string }{
+		{"actor_id", "actor_id = ?"},
+		{"target_user_id", "target_user_id = ?"},
+		{"user_id", "actor_id = ? OR target_user_id = ?"},
+	} {
+		value := c.Query(filter.param)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + filter.param})
+			return
+		}
+		args := make([]any, strings.Count(filter.where, "?"))
+		for i := range args {
+			args[i] = id
+		}
+		query = query.Where(filter.where, args...)
+	}
+	for _, filter := range []struct{ param, where string }{
+		{"since", "created_at >= ?"},
+		{"until", "created_at < ?"},
+	} {
+		value := c.Query(filter.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + filter.param})
+			return
+		}
+		query = query.Where(filter.where, t)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+
+	var events []models.AuditEvent
+	if err := query.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events, "page": page, "page_size": pageSize, "total": total})
+}
+
+// escapeLike escapes the LIKE wildcards of s with "!", a backslash would need different
+// quoting in MySQL and SQLite
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
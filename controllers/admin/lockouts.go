@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"personal_site/audit"
+	authController "personal_site/controllers/auth"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type unlockRequest struct {
+	Email string `json:"email"`
+	IP    string `json:"ip"`
+}
+
+// ListLockouts returns recorded login lockouts, newest first.
+// Query: kind (account or ip), subject, active=true for lockouts still in effect, limit (default 100).
+func ListLockouts(c *gin.Context, db *gorm.DB) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+		return
+	}
+
+	query := db.Order("id DESC").Limit(limit)
+	if kind := c.Query("kind"); kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if subject := c.Query("subject"); subject != "" {
+		query = query.Where("subject = ?", subject)
+	}
+	if c.Query("active") == "true" {
+		query = query.Where("unlocked_at IS NULL AND locked_until > ?", time.Now())
+	}
+
+	var lockouts []models.LoginLockout
+	if err := query.Find(&lockouts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"lockouts": lockouts})
+}
+
+// UnlockLogin lifts the login throttling of an account (by email) or an IP address
+func UnlockLogin(c *gin.Context, db *gorm.DB) {
+	var req unlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
+		return
+	}
+	if (req.Email == "") == (req.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "exactly one of email or ip is required"})
+		return
+	}
+
+	kind, subject := authController.ThrottleKindAccount, req.Email
+	if req.IP != "" {
+		kind, subject = authController.ThrottleKindIP, req.IP
+	}
+
+	unlocked, err := authController.UnlockLogin(db, kind, subject, utils.GetUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to unlock", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAdminUnlockLogin, Details: map[string]any{"kind": kind, "subject": subject}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Unlocked", "kind": kind, "subject": subject, "lockouts_unlocked": unlocked})
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/config"
+	authController "personal_site/controllers/auth"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type revokeTokenRequest struct {
+	TokenID string `json:"token_id" binding:"required"`
+	UserID  uint   `json:"user_id"`
+}
+
+// RevokeToken puts a single access token (by jti) on the revocation list.
+// The session the token belongs to is revoked as well so it cannot be refreshed.
+func RevokeToken(c *gin.Context, db *gorm.DB) {
+	var req revokeTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
+		return
+	}
+
+	// The exact expiry is unknown here, keep the row as long as a token can live
+	exp, err := config.GetVariableAsTimeDuration("DEFAULT_TOKEN_EXPIRATION")
+	if err != nil {
+		exp = 12 * time.Hour
+	}
+
+	userID := req.UserID
+	var session models.Session
+	if err := db.Where("token_id = ?", req.TokenID).First(&session).Error; err == nil {
+		userID = session.UserID
+		if err := authController.RevokeSession(db, &session, "admin"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session", "details": err.Error()})
+			return
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+
+	if err := authController.RevokeToken(db, req.TokenID, userID, time.Now().Add(exp), "admin"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke token", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAdminRevokeToken, TargetUserID: userID, Details: map[string]any{"token_id": req.TokenID}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked", "token_id": req.TokenID})
+}
+
+// RevokeUserTokens revokes every token and session of a user
+func RevokeUserTokens(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+
+	if err := authController.RevokeAllUserTokens(db, user.ID, "admin"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAdminRevokeToken, TargetUserID: user.ID, Details: map[string]any{"all": true}})
+
+	c.JSON(http.StatusOK, gin.H{"message": "All tokens of the user revoked", "user_id": user.ID})
+}
@@ -0,0 +1,311 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"personal_site/audit"
+	authController "personal_site/controllers/auth"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultUserPageSize = 20
+	maxUserPageSize     = 100
+)
+
+var errActOnSelf = errors.New("admins cannot change their own account here")
+
+type adminUserResponse struct {
+	ID              uint                `json:"id"`
+	Email           string              `json:"email"`
+	Nickname        string              `json:"nickname"`
+	Role            models.Role         `json:"role"`
+	Provider        models.AuthProvider `json:"provider"`
+	EmailVerifiedAt *time.Time          `json:"email_verified_at"`
+	DisabledAt      *time.Time          `json:"disabled_at"`
+	DeletedAt       *time.Time          `json:"deleted_at"`
+	CreatedAt       time.Time           `json:"created_at"`
+}
+
+func newAdminUserResponse(user models.User) adminUserResponse {
+	resp := adminUserResponse{
+		ID:              user.ID,
+		Email:           user.Email,
+		Nickname:        user.Nickname,
+		Role:            user.Role,
+		Provider:        user.Provider,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		DisabledAt:      user.DisabledAt,
+		CreatedAt:       user.CreatedAt,
+	}
+	if user.DeletedAt.Valid {
+		resp.DeletedAt = &user.DeletedAt.Time
+	}
+	return resp
+}
+
+type changeRoleRequest struct {
+	Role models.Role `json:"role" binding:"required"`
+}
+
+type disableUserRequest struct {
+	Reason string `json:"reason" binding:"max=256"`
+}
+
+// ListUsers searches users page by page.
+// Query: q (part of email or nickname), role, provider, status (active, disabled, deleted or all;
+// default active and disabled), page (from 1), page_size (default 20, at most 100).
+func ListUsers(c *gin.Context, db *gorm.DB) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultUserPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxUserPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page_size"})
+		return
+	}
+
+	query := db.Model(&models.User{})
+	switch c.Query("status") {
+	case "":
+	case "active":
+		query = query.Where("disabled_at IS NULL")
+	case "disabled":
+		query = query.Where("disabled_at IS NOT NULL")
+	case "deleted":
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	case "all":
+		query = query.Unscoped()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status"})
+		return
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := "%" + strings.ToLower(q) + "%"
+		query = query.Where("LOWER(email) LIKE ? OR LOWER(nickname) LIKE ?", pattern, pattern)
+	}
+	if role := c.Query("role"); role != "" {
+		query = query.Where("role = ?", role)
+	}
+	if provider := c.Query("provider"); provider != "" {
+		query = query.Where("provider = ?", provider)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+
+	var users []models.User
+	if err := query.Order("id").Offset((page - 1) * pageSize).Limit(pageSize).Find(&users).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return
+	}
+
+	resp := make([]adminUserResponse, 0, len(users))
+	for _, user := range users {
+		resp = append(resp, newAdminUserResponse(user))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": resp, "page": page, "page_size": pageSize, "total": total})
+}
+
+// GetUser returns one user, deleted users included
+func GetUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findUser(c, db.Unscoped())
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": newAdminUserResponse(user)})
+}
+
+// ChangeUserRole promotes or demotes a user. Access tokens that carry the old role are
+// rejected from now on, the user's sessions stay and get the new role on their next refresh.
+func ChangeUserRole(c *gin.Context, db *gorm.DB) {
+	var req changeRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
+		return
+	}
+	if !req.Role.IsValid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role"})
+		return
+	}
+	// The guest role belongs to guest accounts, which expire and are deleted with their data
+	if req.Role == models.RoleGuest {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "the guest role cannot be assigned"})
+		return
+	}
+
+	user, ok := findOtherUser(c, db)
+	if !ok {
+		return
+	}
+	if user.IsGuest() {
+		c.JSON(http.StatusConflict, gin.H{"error": "guest accounts cannot change role, they upgrade to a full account instead"})
+		return
+	}
+	if user.Role == req.Role {
+		c.JSON(http.StatusOK, gin.H{"message": "Role unchanged", "user": newAdminUserResponse(user)})
+		return
+	}
+
+	oldRole := user.Role
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("role", req.Role).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, audit.ActionAdminRoleChange, user.ID, map[string]any{"from": oldRole, "to": req.Role})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to change role", "details": err.Error()})
+		return
+	}
+	// Tokens with the old role stop working now, the sessions refresh into the new role
+	if err := authController.BumpTokenVersion(db, user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role changed", "user": newAdminUserResponse(user)})
+}
+
+// DisableUser stops a user from logging in and ends all of the user's sessions
+func DisableUser(c *gin.Context, db *gorm.DB) {
+	var req disableUserRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request", "details": err.Error()})
+			return
+		}
+	}
+
+	user, ok := findOtherUser(c, db)
+	if !ok {
+		return
+	}
+	if user.IsDisabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "user is already disabled"})
+		return
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("disabled_at", &now).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, audit.ActionAdminDisable, user.ID, map[string]any{"reason": req.Reason})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable user", "details": err.Error()})
+		return
+	}
+	authController.ForgetUserStatus(db, user.ID)
+	if err := authController.RevokeAllUserTokens(db, user.ID, "disabled"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User disabled", "user": newAdminUserResponse(user)})
+}
+
+// EnableUser lets a disabled user log in again
+func EnableUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findOtherUser(c, db)
+	if !ok {
+		return
+	}
+	if !user.IsDisabled() {
+		c.JSON(http.StatusConflict, gin.H{"error": "user is not disabled"})
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Update("disabled_at", nil).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, audit.ActionAdminEnable, user.ID, nil)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable user", "details": err.Error()})
+		return
+	}
+	authController.ForgetUserStatus(db, user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User enabled", "user": newAdminUserResponse(user)})
+}
+
+// DeleteUser soft deletes a user. The row and the user's data are kept, but the user can
+// no longer log in and is hidden from the default user list.
+func DeleteUser(c *gin.Context, db *gorm.DB) {
+	user, ok := findOtherUser(c, db)
+	if !ok {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+		return recordAdminAction(tx, c, audit.ActionAdminDelete, user.ID, map[string]any{"email": user.Email})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete user", "details": err.Error()})
+		return
+	}
+	authController.ForgetUserStatus(db, user.ID)
+	if err := authController.RevokeAllUserTokens(db, user.ID, "deleted"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke tokens", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User deleted", "user_id": user.ID})
+}
+
+// findUser loads the user of the :id parameter, it answers the request when that fails
+func findUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := db.First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return models.User{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// findOtherUser is findUser for mutations, admins cannot lock themselves out
+func findOtherUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	user, ok := findUser(c, db)
+	if !ok {
+		return models.User{}, false
+	}
+	if user.ID == utils.GetUserID(c) {
+		c.JSON(http.StatusConflict, gin.H{"error": errActOnSelf.Error()})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// recordAdminAction appends an admin mutation of targetID to the audit trail
+func recordAdminAction(tx *gorm.DB, c *gin.Context, action string, targetID uint, details map[string]any) error {
+	return audit.Write(tx, c, audit.Entry{Action: action, TargetUserID: targetID, Details: details})
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	apiKeyPrefix = "ps_"
+	// Only refresh LastUsedAt this often, so busy scripts do not write on every request
+	apiKeyLastUsedPrecision = time.Minute
+)
+
+// APIKeyScopes are the scopes a personal API key can be granted, "<resource>:read" allows
+// safe methods and "<resource>:write" the others
+var APIKeyScopes = []string{
+	"storage:read",
+	"storage:write",
+	"reurl:read",
+	"reurl:write",
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+type createAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required,max=64"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type apiKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newAPIKeyResponse(key models.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.ScopeList(),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// CreateAPIKey creates a personal API key, the key itself is only returned this one time
+func CreateAPIKey(c *gin.Context, db *gorm.DB) {
+	if rejectGuest(c, db) {
+		return
+	}
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	scopes := make([]string, 0, len(req.Scopes))
+	for _, scope := range req.Scopes {
+		if !slices.Contains(APIKeyScopes, scope) {
+			c.JSON(400, gin.H{"error": "Unknown scope", "details": scope})
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	slices.Sort(scopes)
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(400, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	prefix, rawKey, err := generateAPIKey()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate API key", "details": err.Error()})
+		return
+	}
+
+	key := models.APIKey{
+		UserID:     utils.GetUserID(c),
+		Name:       strings.TrimSpace(req.Name),
+		Prefix:     prefix,
+		SecretHash: hashToken(rawKey),
+		Scopes:     strings.Join(scopes, " "),
+		ExpiresAt:  req.ExpiresAt,
+	}
+	if err := db.Create(&key).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create API key", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAPIKeyCreate, TargetUserID: key.UserID, Details: map[string]any{"prefix": key.Prefix, "scopes": key.Scopes}})
+
+	c.JSON(201, gin.H{
+		"message": "API key created, copy it now since it will not be shown again",
+		"key":     rawKey,
+		"api_key": newAPIKeyResponse(key),
+	})
+}
+
+// ListAPIKeys lists the active API keys of the current user
+func ListAPIKeys(c *gin.Context, db *gorm.DB) {
+	var keys []models.APIKey
+	if err := db.Where("user_id = ? AND revoked_at IS NULL", utils.GetUserID(c)).Order("id").Find(&keys).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	resp := make([]apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, newAPIKeyResponse(key))
+	}
+	c.JSON(200, gin.H{"api_keys": resp})
+}
+
+// RevokeAPIKey revokes one API key of the current user
+func RevokeAPIKey(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	var key models.APIKey
+	if err := db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, utils.GetUserID(c)).First(&key).Error; err != nil {
+		c.JSON(404, gin.H{"error": "API key not found"})
+		return
+	}
+
+	now := time.Now()
+	if err := db.Model(&key).Update("revoked_at", &now).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke API key", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAPIKeyRevoke, TargetUserID: key.UserID, Details: map[string]any{"prefix": key.Prefix}})
+
+	c.JSON(200, gin.H{"message": "API key revoked"})
+}
+
+// IsAPIKey reports whether a Bearer token is a personal API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// ResolveAPIKey looks up an active API key and returns it with the user it acts as.
+// LastUsedAt is refreshed on the way.
+func ResolveAPIKey(db *gorm.DB, rawKey string) (models.APIKey, schemas.TokenUser, error) {
+	prefix, ok := parseAPIKeyPrefix(rawKey)
+	if !ok {
+		return models.APIKey{}, schemas.TokenUser{}, errInvalidAPIKey
+	}
+
+	var key models.APIKey
+	if err := db.Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.APIKey{}, schemas.TokenUser{}, errInvalidAPIKey
+		}
+		return models.APIKey{}, schemas.TokenUser{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashToken(rawKey))) != 1 || !key.IsActive() {
+		return models.APIKey{}, schemas.TokenUser{}, errInvalidAPIKey
+	}
+
+	var user models.User
+	if err := db.First(&user, key.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return models.APIKey{}, schemas.TokenUser{}, errInvalidAPIKey
+		}
+		return models.APIKey{}, schemas.TokenUser{}, err
+	}
+	// Same checks as the tokens, e.g. the key of an expired guest stops working with it
+	if err := userStatusError(user); err != nil {
+		return models.APIKey{}, schemas.TokenUser{}, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyLastUsedPrecision {
+		if err := db.Model(&key).Update("last_used_at", &now).Error; err != nil {
+			return models.APIKey{}, schemas.TokenUser{}, err
+		}
+	}
+
+	return key, schemas.TokenUser{
+		ID:       user.ID,
+		Role:     string(user.Role),
+		Nickname: user.Nickname,
+	}, nil
+}
+
+// APIKeyScopeFor returns the scope needed to call method on resource
+func APIKeyScopeFor(resource, method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+// generateAPIKey returns a new key "ps_<prefix>_<secret>" and its prefix
+func generateAPIKey() (string, string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	prefix := hex.EncodeToString(b)
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	return prefix, apiKeyPrefix + prefix + "_" + secret, nil
+}
+
+func parseAPIKeyPrefix(rawKey string) (string, bool) {
+	rest, ok := strings.CutPrefix(rawKey, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
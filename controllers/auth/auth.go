@@ -3,26 +3,29 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"strings"
+	"errors"
+	"log"
+	"net/http"
 
+	"personal_site/audit"
 	"personal_site/config"
 	"personal_site/models"
+	"personal_site/password"
 	"personal_site/schemas"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type registerRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Nickname string `json:"nickname" binding:"required"`
-	Password string `json:"password" binding:"required,min=8"`
+	Password string `json:"password" binding:"required"` // checked against the password policy
 }
 
 type loginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=8"`
+	Password string `json:"password" binding:"required"`
 }
 
 type loginResponse struct {
@@ -35,8 +38,8 @@ type loginResponse struct {
 }
 
 type changePasswordRequest struct {
-	OldPassword string `json:"old_password" binding:"required,min=8"`
-	NewPassword string `json:"new_password" binding:"required,min=8"`
+	OldPassword string `json:"old_password" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
 }
 
 func Register(c *gin.Context, db *gorm.DB) {
@@ -45,6 +48,14 @@ func Register(c *gin.Context, db *gorm.DB) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	nickname, err := normalizeNickname(req.Nickname)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid nickname", "details": err.Error()})
+		return
+	}
+	if !checkPasswordPolicy(c, req.Password, req.Email, nickname) {
+		return
+	}
 
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
@@ -53,7 +64,7 @@ func Register(c *gin.Context, db *gorm.DB) {
 	}
 
 	user := models.User{
-		Nickname:   req.Nickname,
+		Nickname:   nickname,
 		Role:       models.RoleUser,
 		Provider:   models.AuthProviderPassword,
 		Email:      req.Email,
@@ -61,69 +72,145 @@ func Register(c *gin.Context, db *gorm.DB) {
 	}
 
 	if err := db.Create(&user).Error; err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, Outcome: audit.OutcomeFailure, Details: map[string]any{"email": req.Email}})
 		c.JSON(500, gin.H{"error": "Failed to create user"})
 		return
 	}
-	c.JSON(200, gin.H{"message": "User registered successfully", "user_id": user.ID})
+	audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, ActorID: user.ID, TargetUserID: user.ID, Details: map[string]any{"provider": user.Provider}})
+
+	// The account works right away, a failed email only means the user has to ask for a new link
+	verificationSent := true
+	if err := sendVerificationEmail(user); err != nil {
+		log.Println("[Register] send verification email error:", err, "user:", user.ID)
+		verificationSent = false
+	}
+
+	c.JSON(200, gin.H{"message": "User registered successfully", "user_id": user.ID, "verification_email_sent": verificationSent})
 }
 
 func Login(c *gin.Context, db *gorm.DB) {
+	passwordLogin(c, db, false)
+}
+
+// LoginForToken is Login for clients that authenticate with a Bearer token: the access and
+// refresh token are returned in the response body and no cookies are set
+func LoginForToken(c *gin.Context, db *gorm.DB) {
+	passwordLogin(c, db, true)
+}
+
+func passwordLogin(c *gin.Context, db *gorm.DB, inBody bool) {
 	var req loginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
+	if !allowPasswordAttempt(c, req.Email) {
+		return
+	}
+
 	// Attempt to login
 	var user models.User
-	err1 := db.Select("ID", "Role", "Nickname", "Identifier").Where("email = ?", req.Email).First(&user).Error // Cannot find user
-	err2 := bcrypt.CompareHashAndPassword([]byte(user.Identifier), []byte(req.Password))                       // Password mismatch
+	err1 := db.Select("ID", "Role", "Nickname", "Identifier", "DisabledAt", "TokenVersion").
+		Where("provider = ? AND email = ?", models.AuthProviderPassword, req.Email).First(&user).Error // Cannot find user
+	match, needsRehash := password.Verify(req.Password, user.Identifier) // Password mismatch
 
 	// Login failed
-	if err1 != nil || err2 != nil {
+	if err1 != nil || !match {
+		audit.Record(db, c, audit.Entry{
+			Action:       audit.ActionLogin,
+			Outcome:      audit.OutcomeFailure,
+			TargetUserID: user.ID,
+			Details:      map[string]any{"method": amrPassword, "email": req.Email},
+		})
+		passwordAttemptFailed(c, db, req.Email, user.ID)
 		c.JSON(401, gin.H{"error": "Invalid email or password"})
 		return
 	}
+	if needsRehash {
+		upgradePasswordHash(db, user, req.Password)
+	}
 
-	// login successful
-	token, err := GenerateToken(schemas.TokenPayload{
-		UserID:   user.ID,
-		Role:     string(user.Role),
-		Nickname: user.Nickname,
-	}, user.ID)
+	// Accounts with TOTP enabled need a second step before a session is started
+	mfaEnabled, err := hasConfirmedTOTP(db, user.ID)
 	if err != nil {
-		c.JSON(500, gin.H{"error": "Failed to generate token", "details": err.Error()})
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if mfaEnabled {
+		respondMFARequired(c, user, inBody, amrPassword)
 		return
 	}
 
-	setAuthCookie(c, token)
-
-	c.JSON(200, loginResponse{
-		UserID:   user.ID,
-		Message:  "Login successful",
-		Role:     string(user.Role),
-		Nickname: user.Nickname,
-	})
+	// login successful, with MFA the counter is only cleared once the code is verified
+	passwordAttemptSucceeded(req.Email)
+	finishLogin(c, db, user, inBody, amrPassword)
 }
 
-func Logout(c *gin.Context) {
-	// 清除 auth_token cookie
-	removeAuthCookie(c)
+func Logout(c *gin.Context, db *gorm.DB) {
+	var userID uint
+	// 撤銷目前的 session，之後 refresh token 無法再使用
+	if session, err := currentSessionFromRequest(c, db); err == nil {
+		userID = session.UserID
+		if err := revokeSession(db, &session, revokeReasonLogout); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to logout", "details": err.Error()})
+			return
+		}
+	}
+
+	// 將目前的 access token 加入撤銷清單，讓它立即失效
+	if claims, err := accessClaimsFromRequest(c); err == nil && claims.ExpiresAt != nil {
+		userID = claims.Payload.UserID
+		if err := RevokeToken(db, claims.ID, claims.Payload.UserID, claims.ExpiresAt.Time, revokeReasonLogout); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to logout", "details": err.Error()})
+			return
+		}
+	}
+
+	// 清除 auth_token 與 refresh_token cookie
+	clearSessionCookies(c)
+	if userID != 0 {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionLogout, ActorID: userID, TargetUserID: userID})
+	}
 
 	c.JSON(200, gin.H{"message": "Logged out successfully"})
 }
 
-func hashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func hashPassword(plain string) (string, error) {
+	return password.Hash(plain)
+}
+
+func checkPasswordHash(plain, hash string) bool {
+	match, _ := password.Verify(plain, hash)
+	return match
+}
+
+// upgradePasswordHash replaces the stored hash of user with one of the current hasher.
+// It is only written when the hash did not change meanwhile, a failure keeps the old hash.
+func upgradePasswordHash(db *gorm.DB, user models.User, plain string) {
+	hash, err := hashPassword(plain)
+	if err == nil {
+		err = db.Model(&models.User{}).Where("id = ? AND identifier = ?", user.ID, user.Identifier).UpdateColumn("identifier", hash).Error
+	}
 	if err != nil {
-		return "", err
+		log.Println("[upgradePasswordHash] error:", err, "user:", user.ID)
+	}
+}
+
+// checkPasswordPolicy answers 400 with every broken rule when newPassword does not meet
+// the password policy for the account of email and nickname
+func checkPasswordPolicy(c *gin.Context, newPassword, email, nickname string) bool {
+	err := password.FromConfig().Check(newPassword, password.User{Email: email, Nickname: nickname})
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		respondPasswordPolicyError(c, policyErr)
+		return false
 	}
-	return string(hashedPassword), nil
+	return true
 }
 
-func checkPasswordHash(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+func respondPasswordPolicyError(c *gin.Context, err *password.PolicyError) {
+	c.JSON(400, gin.H{"error": "Password does not meet the requirements", "violations": err.Violations})
 }
 
 func ChangePassword(c *gin.Context, db *gorm.DB) {
@@ -157,10 +244,19 @@ func ChangePassword(c *gin.Context, db *gorm.DB) {
 		return
 	}
 
+	if !allowPasswordAttempt(c, dbUser.Email) {
+		return
+	}
 	if !checkPasswordHash(req.OldPassword, dbUser.Identifier) {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionPasswordChange, Outcome: audit.OutcomeFailure, TargetUserID: dbUser.ID})
+		passwordAttemptFailed(c, db, dbUser.Email, dbUser.ID)
 		c.JSON(403, gin.H{"error": "Old password is incorrect"})
 		return
 	}
+	passwordAttemptSucceeded(dbUser.Email)
+	if !checkPasswordPolicy(c, req.NewPassword, dbUser.Email, dbUser.Nickname) {
+		return
+	}
 
 	newHashedPassword, err := hashPassword(req.NewPassword)
 	if err != nil {
@@ -173,16 +269,34 @@ func ChangePassword(c *gin.Context, db *gorm.DB) {
 		c.JSON(500, gin.H{"error": "Failed to update password"})
 		return
 	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionPasswordChange, TargetUserID: dbUser.ID})
+
+	// Whoever knew the old password is logged out, only this session continues
+	if _, err := revokeOtherSessions(c, db, dbUser.ID, revokeReasonPasswordChange); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke sessions", "details": err.Error()})
+		return
+	}
+	if err := BumpTokenVersion(db, dbUser.ID); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke tokens", "details": err.Error()})
+		return
+	}
+	dbUser.TokenVersion++
+	accessToken, claims, err := reissueAccessToken(c, db, dbUser)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token", "details": err.Error()})
+		return
+	}
 
-	c.JSON(200, gin.H{"message": "Password changed successfully"})
+	respondWithReissuedToken(c, gin.H{"message": "Password changed successfully"}, accessToken, claims)
 }
 
 // ================= Helpers used by multiple providers =================
 
+// fallbackNickname returns the first part that is a valid nickname, see normalizeNickname
 func fallbackNickname(parts ...string) string {
 	for _, p := range parts {
-		if strings.TrimSpace(p) != "" {
-			return p
+		if nickname, err := normalizeNickname(p); err == nil {
+			return nickname
 		}
 	}
 	return "github_user"
@@ -204,8 +318,10 @@ func setAuthCookie(c *gin.Context, token string) {
 		return
 	}
 
+	// Lax: not sent on cross-site POSTs, but still sent on top-level OAuth redirects
+	c.SetSameSite(http.SameSiteLaxMode)
 	c.SetCookie(
-		"auth_token",       // cookie name
+		authCookieName,     // cookie name
 		token,              // cookie value
 		int(exp.Seconds()), // max age in seconds
 		"/",                // path
@@ -216,13 +332,14 @@ func setAuthCookie(c *gin.Context, token string) {
 }
 
 func removeAuthCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
 	c.SetCookie(
-		"auth_token", // cookie name
-		"",           // empty value
-		-1,           // max age -1 (delete immediately)
-		"/",          // path
-		"",           // domain (empty means current domain)
-		true,         // secure (set to true in production with HTTPS)
-		true,         // httpOnly
+		authCookieName, // cookie name
+		"",             // empty value
+		-1,             // max age -1 (delete immediately)
+		"/",            // path
+		"",             // domain (empty means current domain)
+		true,           // secure (set to true in production with HTTPS)
+		true,           // httpOnly
 	)
 }
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"strings"
+	"time"
+
+	"personal_site/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Emails that can be asked for again and again (password reset, login and verification links)
+// are counted per recipient and per IP address in the attempts store, so the endpoints cannot
+// flood a mailbox or be used to send mail in bulk. Unknown addresses are counted like
+// registered ones.
+const (
+	throttleKindEmail   = "email"
+	throttleKindEmailIP = "email_ip"
+)
+
+// emailRequestTargets returns the counters an email to address requested by the client counts against
+func emailRequestTargets(c *gin.Context, address string) []throttleTarget {
+	return []throttleTarget{
+		{kind: throttleKindEmailIP, subject: c.ClientIP(), maxFailures: getLoginMaxFailures("EMAIL_MAX_REQUESTS_PER_IP", 20)},
+		{kind: throttleKindEmail, subject: strings.ToLower(strings.TrimSpace(address)), maxFailures: getLoginMaxFailures("EMAIL_MAX_REQUESTS_PER_ADDRESS", 5)},
+	}
+}
+
+// allowEmailRequest counts a requested email to address and aborts with 429 when the
+// address or the IP asked for too many within EMAIL_REQUEST_WINDOW
+func allowEmailRequest(c *gin.Context, address string) bool {
+	return allowCountedRequest(c, emailRequestTargets(c, address), getEmailRequestWindow(), "Too many emails requested, try again later")
+}
+
+func getEmailRequestWindow() time.Duration {
+	window, err := config.GetVariableAsTimeDuration("EMAIL_REQUEST_WINDOW")
+	if err != nil {
+		return time.Hour // Default to 1 hour if not set
+	}
+	return window
+}
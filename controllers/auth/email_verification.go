@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"personal_site/apipaths"
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/controllers/utils"
+	"personal_site/mailer"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// VerifyEmail marks the email of the user as verified with the token from the verification link.
+// The token is bound to the email, so it stops working if the email changes.
+func VerifyEmail(c *gin.Context, db *gorm.DB) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(400, gin.H{"error": "token is required"})
+		return
+	}
+
+	claims, err := validatePurposeToken(token, purposeVerifyEmail)
+	if err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionEmailVerify, Outcome: audit.OutcomeFailure})
+		c.JSON(400, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, claims.UserID()).Error; err != nil || user.Email != claims.Data["email"] {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionEmailVerify, Outcome: audit.OutcomeFailure, TargetUserID: claims.UserID()})
+		c.JSON(400, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	if !user.IsEmailVerified() {
+		if err := db.Model(&user).Update("email_verified_at", time.Now()).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Failed to verify email", "details": err.Error()})
+			return
+		}
+	}
+
+	audit.Record(db, c, audit.Entry{Action: audit.ActionEmailVerify, TargetUserID: user.ID, Details: map[string]any{"email": user.Email}})
+	c.JSON(200, gin.H{"message": "Email verified", "email": user.Email})
+}
+
+// ResendVerificationEmail sends a new verification link to the logged in user
+func ResendVerificationEmail(c *gin.Context, db *gorm.DB) {
+	tokenUser, err := utils.GetTokenUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, tokenUser.ID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to find user"})
+		return
+	}
+	if user.IsEmailVerified() {
+		c.JSON(409, gin.H{"error": "Email is already verified"})
+		return
+	}
+	if !allowEmailRequest(c, user.Email) {
+		return
+	}
+
+	if err := sendVerificationEmail(user); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to send verification email", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Verification email sent"})
+}
+
+// IsEmailVerified reports whether the user verified the email, used by VerifiedEmailRequired
+func IsEmailVerified(db *gorm.DB, userID uint) (bool, error) {
+	var user models.User
+	if err := db.Select("ID", "EmailVerifiedAt").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+		return false, err
+	}
+	return user.IsEmailVerified(), nil
+}
+
+// sendVerificationEmail mails a signed verification link to the user
+func sendVerificationEmail(user models.User) error {
+	token, err := generatePurposeToken(purposeVerifyEmail, user.ID, getEmailVerificationExpiration(),
+		map[string]string{"email": user.Email})
+	if err != nil {
+		return err
+	}
+
+	link := computeRedirectURL(apipaths.VerifyEmailPath) + "?token=" + url.QueryEscape(token)
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %s. If you did not create an account, you can ignore this email.\n",
+			user.Nickname, link, getEmailVerificationExpiration()),
+	})
+}
+
+func getEmailVerificationExpiration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("EMAIL_VERIFICATION_EXPIRATION")
+	if err != nil {
+		exp = 24 * time.Hour // Default to 24 hours if not set
+	}
+	return exp
+}
@@ -0,0 +1,334 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/controllers/storage"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// amrGuest is the amr of a guest session, nothing was proven
+const amrGuest = "guest"
+
+// guestEmailDomain is the domain of the placeholder emails of guests, .invalid never resolves
+const guestEmailDomain = "guest.invalid"
+
+// guestMergeTokenExpiration is how long the guest has to log in to the account that takes its data
+const guestMergeTokenExpiration = 30 * time.Minute
+
+type mergeGuestRequest struct {
+	MergeToken string `json:"merge_token" binding:"required"`
+}
+
+type upgradeGuestRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"` // checked against the password policy
+	Nickname string `json:"nickname"`                    // keeps the guest nickname when empty
+}
+
+// CreateGuest creates a guest account and logs it in. A guest has its own storage and
+// reurls until GUEST_ACCOUNT_TTL is over, unless it is upgraded before.
+func CreateGuest(c *gin.Context, db *gorm.DB) {
+	if _, err := accessClaimsFromRequest(c); err == nil {
+		c.JSON(409, gin.H{"error": "Already logged in"})
+		return
+	}
+	if !allowGuestCreation(c) {
+		return
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create guest", "details": err.Error()})
+		return
+	}
+	handle := hex.EncodeToString(b)
+	expiresAt := time.Now().Add(getGuestAccountTTL())
+	user := models.User{
+		Nickname:  "guest-" + handle[:6],
+		Role:      models.RoleGuest,
+		Provider:  models.AuthProviderGuest,
+		Email:     "guest-" + handle + "@" + guestEmailDomain,
+		ExpiresAt: &expiresAt,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to create guest", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionGuestCreate, ActorID: user.ID, TargetUserID: user.ID})
+
+	err := startSession(c, db, user, amrGuest)
+	if err != nil {
+		abortSessionStart(c, err)
+		return
+	}
+	c.JSON(200, gin.H{
+		"message":    "Guest account created",
+		"user_id":    user.ID,
+		"role":       user.Role,
+		"nickname":   user.Nickname,
+		"expires_at": user.ExpiresAt,
+	})
+}
+
+// UpgradeGuest turns the logged in guest into a password account, keeping its id and data.
+// The current session continues with a reissued token of the new role.
+func UpgradeGuest(c *gin.Context, db *gorm.DB) {
+	var req upgradeGuestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if !user.IsGuest() {
+		c.JSON(403, gin.H{"error": "Only guest accounts can be upgraded"})
+		return
+	}
+
+	nickname := user.Nickname
+	if req.Nickname != "" {
+		var err error
+		if nickname, err = normalizeNickname(req.Nickname); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid nickname", "details": err.Error()})
+			return
+		}
+	}
+	email := strings.TrimSpace(req.Email)
+	if !checkPasswordPolicy(c, req.Password, email, nickname) {
+		return
+	}
+
+	var existing int64
+	if err := db.Unscoped().Model(&models.User{}).Where("provider = ? AND email = ?", models.AuthProviderPassword, email).Count(&existing).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if existing > 0 {
+		c.JSON(409, gin.H{"error": "Email already registered, merge the guest data into that account instead"})
+		return
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	oldNickname := user.Nickname
+	if nickname != oldNickname {
+		// Storage paths contain the nickname, keep the files with the user
+		if err := storage.RenameUserFolder(user.ID, oldNickname, nickname); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to move the storage folder", "details": err.Error()})
+			return
+		}
+	}
+	user.Nickname = nickname
+	user.Role = models.RoleUser
+	user.Provider = models.AuthProviderPassword
+	user.Email = email
+	user.Identifier = hashedPassword
+	user.ExpiresAt = nil
+	if err := db.Save(&user).Error; err != nil {
+		if nickname != oldNickname {
+			if err := storage.RenameUserFolder(user.ID, nickname, oldNickname); err != nil {
+				log.Println("[UpgradeGuest] restore storage folder error:", err, "user:", user.ID)
+			}
+		}
+		audit.Record(db, c, audit.Entry{Action: audit.ActionGuestUpgrade, Outcome: audit.OutcomeFailure, TargetUserID: user.ID, Details: map[string]any{"email": email}})
+		c.JSON(500, gin.H{"error": "Failed to upgrade account", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionGuestUpgrade, TargetUserID: user.ID, Details: map[string]any{"provider": user.Provider}})
+
+	// Tokens of other guest sessions still carry the guest role
+	if err := BumpTokenVersion(db, user.ID); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to upgrade account", "details": err.Error()})
+		return
+	}
+	user.TokenVersion++
+	accessToken, claims, err := reissueAccessToken(c, db, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token", "details": err.Error()})
+		return
+	}
+
+	verificationSent := true
+	if err := sendVerificationEmail(user); err != nil {
+		log.Println("[UpgradeGuest] send verification email error:", err, "user:", user.ID)
+		verificationSent = false
+	}
+
+	resp, err := newMeResponse(db, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	respondWithReissuedToken(c, gin.H{"message": "Guest account upgraded", "user": resp, "verification_email_sent": verificationSent}, accessToken, claims)
+}
+
+// IsGuest reports whether the user is a guest account, used by VerifiedEmailRequired
+func IsGuest(db *gorm.DB, userID uint) (bool, error) {
+	var user models.User
+	if err := db.Select("ID", "Provider", "ExpiresAt").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+		return false, err
+	}
+	return user.IsGuest(), nil
+}
+
+// rejectGuest answers 403 and returns true when the logged in user is a guest, for features
+// that would tie a login method or an API key to an account that expires
+func rejectGuest(c *gin.Context, db *gorm.DB) bool {
+	guest, err := IsGuest(db, utils.GetUserID(c))
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return true
+	}
+	if !guest {
+		return false
+	}
+	c.JSON(403, gin.H{"error": "Not available for guest accounts, upgrade the account or merge it into another one instead"})
+	return true
+}
+
+// StartGuestMerge returns a token that lets the account the guest logs in to next take the
+// guest's reurls and files with MergeGuest. Logging in alone never moves the data.
+func StartGuestMerge(c *gin.Context, db *gorm.DB) {
+	guest, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if !guest.IsGuest() {
+		c.JSON(403, gin.H{"error": "Only guest accounts can be merged"})
+		return
+	}
+
+	token, err := generatePurposeToken(purposeGuestMerge, guest.ID, guestMergeTokenExpiration, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate merge token", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"merge_token": token, "expires_in": int(guestMergeTokenExpiration.Seconds())})
+}
+
+// MergeGuest moves the reurls and files of the guest of merge_token to the logged in user
+// and deletes the guest. When the merge fails the guest keeps its data and the same token
+// can be sent again.
+func MergeGuest(c *gin.Context, db *gorm.DB) {
+	var req mergeGuestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+	if user.IsGuest() {
+		c.JSON(403, gin.H{"error": "Log in to the account that should keep the guest data first"})
+		return
+	}
+
+	claims, err := validatePurposeToken(req.MergeToken, purposeGuestMerge)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid or expired merge token"})
+		return
+	}
+	var guest models.User
+	if err := db.Where("id = ?", claims.UserID()).Limit(1).Find(&guest).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if !guest.IsGuest() || guest.IsExpired() {
+		c.JSON(400, gin.H{"error": "Invalid or expired merge token"})
+		return
+	}
+
+	reurls, err := mergeGuest(db, guest, user)
+	if err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionGuestUpgrade, Outcome: audit.OutcomeFailure, ActorID: user.ID, TargetUserID: guest.ID, Details: map[string]any{"merged_into": user.ID, "reason": err.Error()}})
+		c.JSON(500, gin.H{"error": "Failed to merge the guest data, the guest keeps it", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionGuestUpgrade, ActorID: user.ID, TargetUserID: guest.ID, Details: map[string]any{"merged_into": user.ID}})
+
+	c.JSON(200, gin.H{"message": "Guest data merged", "guest_id": guest.ID, "reurls_moved": reurls})
+}
+
+// mergeGuest gives the reurls and files of guest to user, deletes the guest and returns how
+// many reurls moved. The files move first, when they cannot nothing is changed and the guest
+// keeps all of its data.
+func mergeGuest(db *gorm.DB, guest, user models.User) (int64, error) {
+	if err := storage.MoveUserStorage(guest.ID, guest.Nickname, user.ID, user.Nickname); err != nil {
+		return 0, fmt.Errorf("move storage: %w", err)
+	}
+	var reurls int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Reurl{}).Where("owner_id = ?", guest.ID).Update("owner_id", user.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		reurls = result.RowsAffected
+		return deleteAccount(tx, guest)
+	})
+	if err != nil {
+		// The files are with user already, the guest keeps its reurls and can merge again
+		return 0, err
+	}
+
+	ForgetUserStatus(db, guest.ID)
+	if err := RevokeAllUserTokens(db, guest.ID, revokeReasonDeleted); err != nil {
+		log.Println("[mergeGuest] revoke tokens error:", err, "guest:", guest.ID)
+	}
+	// Everything of value moved, only leftovers such as unfinished uploads are removed
+	if err := storage.RemoveUserStorage(guest.ID); err != nil {
+		log.Println("[mergeGuest] remove storage error:", err, "guest:", guest.ID)
+	}
+	return reurls, nil
+}
+
+// DeleteExpiredGuests deletes the guests whose ExpiresAt is before now, with their reurls
+// and files, and returns how many were deleted
+func DeleteExpiredGuests(db *gorm.DB, now time.Time) (int, error) {
+	var guests []models.User
+	if err := db.Where("provider = ? AND expires_at < ?", models.AuthProviderGuest, now).Find(&guests).Error; err != nil {
+		return 0, err
+	}
+
+	for i, guest := range guests {
+		if err := deleteAccount(db, guest); err != nil {
+			return i, err
+		}
+		ForgetUserStatus(db, guest.ID)
+		if err := RevokeAllUserTokens(db, guest.ID, revokeReasonExpired); err != nil {
+			log.Println("[DeleteExpiredGuests] revoke tokens error:", err, "guest:", guest.ID)
+		}
+		if err := storage.RemoveUserStorage(guest.ID); err != nil {
+			log.Println("[DeleteExpiredGuests] remove storage error:", err, "guest:", guest.ID)
+		}
+	}
+	return len(guests), nil
+}
+
+func getGuestAccountTTL() time.Duration {
+	ttl, err := config.GetVariableAsTimeDuration("GUEST_ACCOUNT_TTL")
+	if err != nil {
+		return 7 * 24 * time.Hour // Default to 7 days if not set
+	}
+	return ttl
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"time"
+
+	"personal_site/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Guest accounts need no proof of anything, so their creation is counted per IP address in
+// the attempts store to keep a client from filling the database with guests.
+const throttleKindGuestIP = "guest_ip"
+
+// allowGuestCreation counts a guest created by the client and aborts with 429 when the IP
+// created GUEST_MAX_PER_IP guests within GUEST_CREATION_WINDOW
+func allowGuestCreation(c *gin.Context) bool {
+	targets := []throttleTarget{
+		{kind: throttleKindGuestIP, subject: c.ClientIP(), maxFailures: getLoginMaxFailures("GUEST_MAX_PER_IP", 10)},
+	}
+	return allowCountedRequest(c, targets, getGuestCreationWindow(), "Too many guest accounts created, try again later")
+}
+
+func getGuestCreationWindow() time.Duration {
+	window, err := config.GetVariableAsTimeDuration("GUEST_CREATION_WINDOW")
+	if err != nil {
+		return time.Hour // Default to 1 hour if not set
+	}
+	return window
+}
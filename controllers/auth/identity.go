@@ -0,0 +1,459 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	linkIntentCookieName = "oauth_link"
+	linkTokenExpiration  = 10 * time.Minute
+)
+
+var (
+	errIdentityLinkedElsewhere = errors.New("this account is already linked to another user")
+	errProviderAlreadyLinked   = errors.New("an account of this provider is already linked")
+)
+
+// oauthIdentity is what a provider callback learned about the user
+type oauthIdentity struct {
+	Provider      models.AuthProvider
+	Subject       string // provider user id
+	Email         string
+	EmailVerified bool // whether the provider confirmed the user owns Email
+	Nicknames     []string
+}
+
+type identityResponse struct {
+	ID        uint                `json:"id"`
+	Provider  models.AuthProvider `json:"provider"`
+	Email     string              `json:"email"`
+	CreatedAt time.Time           `json:"created_at"`
+}
+
+type confirmLinkRequest struct {
+	LinkToken string `json:"link_token" binding:"required"`
+}
+
+// completeOAuthLogin is the shared end of every OAuth callback. It links the identity when
+// the user started a link flow, offers to link when a verified email matches an existing
+// user, and otherwise logs in the owner of the identity, creating the user on first login.
+func completeOAuthLogin(c *gin.Context, db *gorm.DB, ident oauthIdentity, redirectBack, message string) {
+	if userID, ok := consumeLinkIntent(c); ok {
+		if err := linkIdentity(db, userID, ident); err != nil {
+			auditLink(c, db, userID, ident.Provider, err)
+			finalizeLinkError(c, redirectBack, err)
+			return
+		}
+		auditLink(c, db, userID, ident.Provider, nil)
+		finalizeLinkResponse(c, redirectBack, ident.Provider)
+		return
+	}
+
+	user, err := findUserByIdentity(db, ident.Provider, ident.Subject)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Do not silently create a second account for a person we already know
+		if existing, found := findVerifiedUserByEmail(db, ident); found {
+			offerLink(c, redirectBack, existing, ident)
+			return
+		}
+
+		user, err = createOAuthUser(db, ident)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+			return
+		}
+		audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, ActorID: user.ID, TargetUserID: user.ID, Details: map[string]any{"provider": ident.Provider}})
+	} else {
+		markProviderVerifiedEmail(db, &user, ident)
+	}
+
+	// The provider is only the first factor, like the password of the account
+	mfaEnabled, err := hasConfirmedTOTP(db, user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if mfaEnabled && userStatusError(user) == nil {
+		respondOAuthMFARequired(c, redirectBack, user)
+		return
+	}
+
+	// Start a session and set the token cookies
+	err = startSession(c, db, user, amrOAuth)
+	auditLogin(c, db, user, err, map[string]any{"amr": []string{amrOAuth}, "provider": ident.Provider})
+	if err != nil {
+		abortSessionStart(c, err)
+		return
+	}
+
+	finalizeLoginResponse(c, redirectBack, user, message)
+}
+
+// respondOAuthMFARequired answers an OAuth login of a user with TOTP enabled like
+// respondMFARequired, or redirects back with login=mfa_required and the mfa_token
+func respondOAuthMFARequired(c *gin.Context, redirectBack string, user models.User) {
+	if redirectBack == "" {
+		respondMFARequired(c, user, false, amrOAuth)
+		return
+	}
+	mfaToken, err := generateMFAPendingToken(user, false, amrOAuth)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate MFA token", "details": err.Error()})
+		return
+	}
+	u, _ := url.Parse(redirectBack)
+	q := u.Query()
+	q.Set("login", "mfa_required")
+	q.Set("mfa_token", mfaToken)
+	u.RawQuery = q.Encode()
+	c.Redirect(302, u.String())
+}
+
+// auditLink records linking an identity of provider to userID
+func auditLink(c *gin.Context, db *gorm.DB, userID uint, provider models.AuthProvider, err error) {
+	entry := audit.Entry{Action: audit.ActionIdentityLink, ActorID: userID, TargetUserID: userID, Details: map[string]any{"provider": provider}}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Details["reason"] = err.Error()
+	}
+	audit.Record(db, c, entry)
+}
+
+// StartLink starts the OAuth flow of :provider to link it to the logged in user
+func StartLink(c *gin.Context, db *gorm.DB) {
+	if rejectGuest(c, db) {
+		return
+	}
+	provider := models.AuthProvider(c.Param("provider"))
+	if _, ok := lookupOAuthProvider(provider); !ok {
+		c.JSON(400, gin.H{"error": "Unsupported provider"})
+		return
+	}
+
+	userID := utils.GetUserID(c)
+	token, err := generatePurposeToken(purposeLinkIntent, userID, linkTokenExpiration, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start linking", "details": err.Error()})
+		return
+	}
+	setLinkIntentCookie(c, token, linkTokenExpiration)
+
+	OAuthLoginStart(c, provider)
+}
+
+// ConfirmLink links the identity of a link offer to the logged in user. Only the user the
+// offer was made for can accept it, so the caller proved they own both accounts.
+func ConfirmLink(c *gin.Context, db *gorm.DB) {
+	var req confirmLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := validatePurposeToken(req.LinkToken, purposeLinkPending)
+	if err != nil || claims.UserID() != utils.GetUserID(c) {
+		c.JSON(400, gin.H{"error": "Invalid or expired link token"})
+		return
+	}
+
+	ident := oauthIdentity{
+		Provider: models.AuthProvider(claims.Data["provider"]),
+		Subject:  claims.Data["subject"],
+		Email:    claims.Data["email"],
+	}
+	if err := linkIdentity(db, claims.UserID(), ident); err != nil {
+		auditLink(c, db, claims.UserID(), ident.Provider, err)
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	auditLink(c, db, claims.UserID(), ident.Provider, nil)
+
+	c.JSON(200, gin.H{"message": "Account linked", "provider": ident.Provider})
+}
+
+// ListIdentities lists the external accounts linked to the logged in user
+func ListIdentities(c *gin.Context, db *gorm.DB) {
+	var identities []models.Identity
+	if err := db.Where("user_id = ?", utils.GetUserID(c)).Order("id").Find(&identities).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	resp := make([]identityResponse, 0, len(identities))
+	for _, identity := range identities {
+		resp = append(resp, identityResponse{
+			ID:        identity.ID,
+			Provider:  identity.Provider,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+	c.JSON(200, gin.H{"identities": resp})
+}
+
+// UnlinkIdentity removes a linked external account, the last way to log in cannot be removed
+func UnlinkIdentity(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	userID := utils.GetUserID(c)
+	var identity models.Identity
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&identity).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Identity not found"})
+		return
+	}
+
+	methods, err := countLoginMethods(db, userID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if methods <= 1 {
+		c.JSON(409, gin.H{"error": "Cannot remove the last login method"})
+		return
+	}
+
+	// Hard delete, so the provider account can be linked again later
+	if err := db.Unscoped().Delete(&identity).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to unlink", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionIdentityUnlink, TargetUserID: userID, Details: map[string]any{"provider": identity.Provider}})
+
+	c.JSON(200, gin.H{"message": "Account unlinked", "provider": identity.Provider})
+}
+
+// countLoginMethods counts the password or magic link (if any), the linked identities and
+// the passkeys of a user
+func countLoginMethods(db *gorm.DB, userID uint) (int64, error) {
+	var user models.User
+	if err := db.Select("ID", "Provider").First(&user, userID).Error; err != nil {
+		return 0, err
+	}
+
+	var count int64
+	if err := db.Model(&models.Identity{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	var passkeys int64
+	if err := db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userID).Count(&passkeys).Error; err != nil {
+		return 0, err
+	}
+	count += passkeys
+	if user.Provider == models.AuthProviderPassword || user.Provider == models.AuthProviderEmail {
+		count++
+	}
+	return count, nil
+}
+
+func findUserByIdentity(db *gorm.DB, provider models.AuthProvider, subject string) (models.User, error) {
+	var identity models.Identity
+	if err := db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error; err != nil {
+		return models.User{}, err
+	}
+
+	// Unscoped, so a deleted user is refused instead of being created again
+	var user models.User
+	err := db.Unscoped().First(&user, identity.UserID).Error
+	return user, err
+}
+
+// findVerifiedUserByEmail finds a user whose verified email is the provider verified email
+func findVerifiedUserByEmail(db *gorm.DB, ident oauthIdentity) (models.User, bool) {
+	if !ident.EmailVerified || ident.Email == "" {
+		return models.User{}, false
+	}
+
+	var user models.User
+	err := db.Where("email = ? AND email_verified_at IS NOT NULL", ident.Email).Order("id").Limit(1).Find(&user).Error
+	return user, err == nil && user.ID != 0
+}
+
+// markProviderVerifiedEmail verifies the email of user when the provider of its identity
+// confirms the same address, e.g. for users that existed before email verification
+func markProviderVerifiedEmail(db *gorm.DB, user *models.User, ident oauthIdentity) {
+	if user.IsEmailVerified() || !ident.EmailVerified || ident.Email != user.Email {
+		return
+	}
+	now := time.Now()
+	if err := db.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("email_verified_at", now).Error; err != nil {
+		log.Println("[markProviderVerifiedEmail] error:", err, "user:", user.ID)
+		return
+	}
+	user.EmailVerifiedAt = &now
+}
+
+// createOAuthUser creates a user and its first identity
+func createOAuthUser(db *gorm.DB, ident oauthIdentity) (models.User, error) {
+	user := models.User{
+		Nickname:   fallbackNickname(ident.Nicknames...),
+		Role:       models.RoleUser,
+		Provider:   ident.Provider,
+		Email:      ident.Email,
+		Identifier: ident.Subject,
+	}
+	if ident.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.Identity{
+			UserID:   user.ID,
+			Provider: ident.Provider,
+			Subject:  ident.Subject,
+			Email:    ident.Email,
+		}).Error
+	})
+	return user, err
+}
+
+// linkIdentity attaches the identity to userID, linking it again to the same user is a no-op
+func linkIdentity(db *gorm.DB, userID uint, ident oauthIdentity) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existing models.Identity
+		if err := tx.Where("provider = ? AND subject = ?", ident.Provider, ident.Subject).Limit(1).Find(&existing).Error; err != nil {
+			return err
+		}
+		if existing.ID != 0 {
+			if existing.UserID != userID {
+				return errIdentityLinkedElsewhere
+			}
+			return nil
+		}
+
+		var count int64
+		if err := tx.Model(&models.Identity{}).Where("user_id = ? AND provider = ?", userID, ident.Provider).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errProviderAlreadyLinked
+		}
+
+		return tx.Create(&models.Identity{
+			UserID:   userID,
+			Provider: ident.Provider,
+			Subject:  ident.Subject,
+			Email:    ident.Email,
+		}).Error
+	})
+}
+
+// offerLink answers a login whose verified email belongs to an existing user. The link_token
+// can be confirmed with /auth/link/confirm after logging in to the existing account.
+func offerLink(c *gin.Context, redirectBack string, existing models.User, ident oauthIdentity) {
+	token, err := generatePurposeToken(purposeLinkPending, existing.ID, linkTokenExpiration, map[string]string{
+		"provider": string(ident.Provider),
+		"subject":  ident.Subject,
+		"email":    ident.Email,
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate link token", "details": err.Error()})
+		return
+	}
+
+	if redirectBack != "" {
+		u, _ := url.Parse(redirectBack)
+		q := u.Query()
+		q.Set("login", "link_required")
+		q.Set("provider", string(ident.Provider))
+		q.Set("email", ident.Email)
+		q.Set("link_token", token)
+		u.RawQuery = q.Encode()
+		c.Redirect(302, u.String())
+		return
+	}
+	c.JSON(409, gin.H{
+		"error":         "An account with this email already exists",
+		"link_required": true,
+		"provider":      ident.Provider,
+		"email":         ident.Email,
+		"link_token":    token,
+	})
+}
+
+// finalizeLinkResponse redirects back with link=success, or returns JSON when no redirect
+func finalizeLinkResponse(c *gin.Context, redirectBack string, provider models.AuthProvider) {
+	if redirectBack != "" {
+		u, _ := url.Parse(redirectBack)
+		q := u.Query()
+		q.Set("link", "success")
+		q.Set("provider", string(provider))
+		u.RawQuery = q.Encode()
+		c.Redirect(302, u.String())
+		return
+	}
+	c.JSON(200, gin.H{"message": "Account linked", "provider": provider})
+}
+
+func finalizeLinkError(c *gin.Context, redirectBack string, err error) {
+	status := 500
+	if errors.Is(err, errIdentityLinkedElsewhere) || errors.Is(err, errProviderAlreadyLinked) {
+		status = 409
+	}
+	if redirectBack != "" {
+		u, _ := url.Parse(redirectBack)
+		q := u.Query()
+		q.Set("link", "error")
+		q.Set("error", err.Error())
+		u.RawQuery = q.Encode()
+		c.Redirect(302, u.String())
+		return
+	}
+	c.JSON(status, gin.H{"error": "Failed to link account", "details": err.Error()})
+}
+
+// consumeLinkIntent returns the user that started a link flow and removes the intent cookie
+func consumeLinkIntent(c *gin.Context) (uint, bool) {
+	token, err := c.Cookie(linkIntentCookieName)
+	if err != nil || token == "" {
+		return 0, false
+	}
+	setLinkIntentCookie(c, "", -1)
+
+	claims, err := validatePurposeToken(token, purposeLinkIntent)
+	if err != nil || claims.UserID() == 0 {
+		return 0, false
+	}
+	return claims.UserID(), true
+}
+
+func setLinkIntentCookie(c *gin.Context, token string, exp time.Duration) {
+	maxAge := int(exp.Seconds())
+	if exp < 0 {
+		maxAge = -1
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		linkIntentCookieName, // cookie name
+		token,                // cookie value
+		maxAge,               // max age in seconds
+		refreshCookiePath(),  // path, the callbacks are under /auth
+		"",                   // domain (empty means current domain)
+		true,                 // secure (set to true in production with HTTPS)
+		true,                 // httpOnly
+	)
+}
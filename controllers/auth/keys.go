@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"personal_site/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is one asymmetric key pair identified by kid
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// keySet holds the configured signing method. For HS256 it has no keys and the
+// shared JWT_SECRET_KEY is used instead. For RS256/EdDSA, Active signs new tokens
+// and every key in Keys can still verify tokens, so keys can be rotated without
+// invalidating tokens that are already issued.
+type keySet struct {
+	Method jwt.SigningMethod
+	Active *signingKey
+	Keys   map[string]*signingKey
+}
+
+func (ks *keySet) isSymmetric() bool {
+	return ks.Method == jwt.SigningMethodHS256
+}
+
+var (
+	loadedKeySet *keySet
+	keySetMu     sync.Mutex
+)
+
+var getKeySet = func() (*keySet, error) {
+	keySetMu.Lock()
+	defer keySetMu.Unlock()
+	if loadedKeySet != nil {
+		return loadedKeySet, nil
+	}
+
+	ks, err := loadKeySet()
+	if err != nil {
+		return nil, err
+	}
+	loadedKeySet = ks
+	return ks, nil
+}
+
+// loadKeySet reads JWT_SIGNING_METHOD and, for asymmetric methods, every *.pem
+// private key in JWT_KEYS_DIR. The file name without extension is the kid.
+// JWT_ACTIVE_KEY_ID selects the signing key, it defaults to the last kid in name order.
+func loadKeySet() (*keySet, error) {
+	methodName, err := config.GetVariableAsString("JWT_SIGNING_METHOD")
+	if err != nil {
+		methodName = "HS256" // Default to the shared secret if not set
+	}
+
+	var method jwt.SigningMethod
+	switch strings.ToUpper(methodName) {
+	case "HS256":
+		return &keySet{Method: jwt.SigningMethodHS256}, nil
+	case "RS256":
+		method = jwt.SigningMethodRS256
+	case "EDDSA":
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported JWT_SIGNING_METHOD: %s", methodName)
+	}
+
+	dir, err := config.GetVariableAsString("JWT_KEYS_DIR")
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no *.pem keys found in %s", dir)
+	}
+	sort.Strings(files)
+
+	ks := &keySet{Method: method, Keys: make(map[string]*signingKey)}
+	var lastID string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		kid := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		key, err := parseSigningKey(kid, method, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %v", file, err)
+		}
+		ks.Keys[kid] = key
+		lastID = kid
+	}
+
+	activeID, err := config.GetVariableAsString("JWT_ACTIVE_KEY_ID")
+	if err != nil {
+		activeID = lastID
+	}
+	active, ok := ks.Keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active key %s not found in %s", activeID, dir)
+	}
+	ks.Active = active
+
+	return ks, nil
+}
+
+// parseSigningKey parses a PKCS#8 or PKCS#1 PEM private key and checks it matches method
+func parseSigningKey(kid string, method jwt.SigningMethod, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("RSA key cannot be used with %s", method.Alg())
+		}
+		return &signingKey{ID: kid, Method: method, Private: k, Public: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		if method != jwt.SigningMethodEdDSA {
+			return nil, fmt.Errorf("Ed25519 key cannot be used with %s", method.Alg())
+		}
+		return &signingKey{ID: kid, Method: method, Private: k, Public: k.Public()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+// jsonWebKey is the public part of a signing key as published in the JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// publicKey decodes a key of another issuer's JWKS
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func toJSONWebKey(key *signingKey) (jsonWebKey, error) {
+	jwk := jsonWebKey{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return jsonWebKey{}, fmt.Errorf("unsupported key type %T", key.Public)
+	}
+	return jwk, nil
+}
+
+// JWKS publishes the public verification keys. With HS256 the list is empty
+// because the shared secret must never be published.
+func JWKS(c *gin.Context) {
+	ks, err := getKeySet()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to load signing keys", "details": err.Error()})
+		return
+	}
+
+	ids := make([]string, 0, len(ks.Keys))
+	for kid := range ks.Keys {
+		ids = append(ids, kid)
+	}
+	sort.Strings(ids)
+
+	keys := make([]jsonWebKey, 0, len(ids))
+	for _, kid := range ids {
+		jwk, err := toJSONWebKey(ks.Keys[kid])
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to encode signing key", "details": err.Error()})
+			return
+		}
+		keys = append(keys, jwk)
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(200, gin.H{"keys": keys})
+}
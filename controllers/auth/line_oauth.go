@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"personal_site/apipaths"
+	"personal_site/config"
+	"personal_site/models"
+
+	"golang.org/x/oauth2"
+)
+
+// Default LINE Login v2.1 endpoints. Each one can be overridden from .env,
+// which lets tests point the flow at a local fake LINE server.
+const (
+	defaultLineAuthURL    = "https://access.line.me/oauth2/v2.1/authorize"
+	defaultLineTokenURL   = "https://api.line.me/oauth2/v2.1/token"
+	defaultLineVerifyURL  = "https://api.line.me/oauth2/v2.1/verify"
+	defaultLineProfileURL = "https://api.line.me/v2/profile"
+)
+
+var lineOAuthConfig *oauth2.Config
+
+func getLineOAuthConfig() (*oauth2.Config, error) {
+	if lineOAuthConfig != nil {
+		return lineOAuthConfig, nil
+	}
+
+	clientID, err := config.GetVariableAsString("LINE_CLIENT_ID")
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := config.GetVariableAsString("LINE_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	// Build redirect URL from shared path constant
+	redirectURL := computeRedirectURL(apipaths.LineCallbackPath)
+	lineOAuthConfig = &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"profile", "openid", "email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   lineEndpoint("LINE_AUTH_URL", defaultLineAuthURL),
+			TokenURL:  lineEndpoint("LINE_TOKEN_URL", defaultLineTokenURL),
+			AuthStyle: oauth2.AuthStyleInParams, // LINE expects client credentials in the form body
+		},
+		RedirectURL: redirectURL,
+	}
+
+	return lineOAuthConfig, nil
+}
+
+// lineEndpoint returns the endpoint configured in varName, or fallback when not set
+func lineEndpoint(varName, fallback string) string {
+	if value, err := config.GetVariableAsString(varName); err == nil {
+		return value
+	}
+	return fallback
+}
+
+// newLineProvider is the registry entry of LINE. LINE signs its ID tokens with the channel
+// secret, so they are checked by the LINE verify endpoint rather than with a JWKS.
+func newLineProvider() *oauthProvider {
+	return &oauthProvider{
+		Name:         models.AuthProviderLine,
+		DisplayName:  "LINE",
+		LoginPath:    apipaths.LineLoginPath,
+		CallbackPath: apipaths.LineCallbackPath,
+		UsesIDToken:  true,
+		config:       getLineOAuthConfig,
+		identify:     identifyLineUser,
+	}
+}
+
+// identifyLineUser verifies the ID token LINE returns next to the access token before
+// trusting the subject in it
+func identifyLineUser(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, nonce string) (oauthIdentity, error) {
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return oauthIdentity{}, fmt.Errorf("%w: missing LINE ID token", errInvalidIDToken)
+	}
+
+	idToken, err := verifyLineIDToken(rawIDToken, conf.ClientID, nonce)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("%w: %v", errInvalidIDToken, err)
+	}
+
+	profile, err := fetchLineProfile(token.AccessToken)
+	if err != nil {
+		return oauthIdentity{}, err
+	}
+
+	if profile.UserID != idToken.Sub {
+		return oauthIdentity{}, fmt.Errorf("%w: LINE profile does not match ID token", errInvalidIDToken)
+	}
+
+	// LINE only shares the email when the channel has the email permission. The ID token
+	// has no email_verified claim, so the email is not trusted to link or verify an account.
+	return oauthIdentity{
+		Subject:       idToken.Sub,
+		Email:         idToken.Email,
+		EmailVerified: false,
+		Nicknames:     []string{profile.DisplayName, idToken.Name},
+	}, nil
+}
+
+type lineIDToken struct {
+	Iss   string `json:"iss"`
+	Sub   string `json:"sub"`
+	Aud   string `json:"aud"`
+	Exp   int64  `json:"exp"`
+	Nonce string `json:"nonce"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type lineProfile struct {
+	UserID      string `json:"userId"`
+	DisplayName string `json:"displayName"`
+	PictureURL  string `json:"pictureUrl"`
+}
+
+// verifyLineIDToken asks LINE to verify the ID token, including its nonce, and returns its claims
+func verifyLineIDToken(rawIDToken, clientID, nonce string) (*lineIDToken, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	form := url.Values{}
+	form.Set("id_token", rawIDToken)
+	form.Set("client_id", clientID)
+	form.Set("nonce", nonce)
+	resp, err := client.PostForm(lineEndpoint("LINE_VERIFY_URL", defaultLineVerifyURL), form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var t lineIDToken
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+
+	// The verify endpoint already checks signature and expiry, double check the essentials
+	if t.Sub == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	if t.Aud != clientID {
+		return nil, fmt.Errorf("unexpected audience: %s", t.Aud)
+	}
+	if t.Exp != 0 && time.Now().Unix() > t.Exp {
+		return nil, fmt.Errorf("id token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	return &t, nil
+}
+
+func fetchLineProfile(accessToken string) (*lineProfile, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, _ := http.NewRequest("GET", lineEndpoint("LINE_PROFILE_URL", defaultLineProfileURL), nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	var p lineProfile
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(p.UserID) == "" {
+		return nil, fmt.Errorf("missing user id")
+	}
+	return &p, nil
+}
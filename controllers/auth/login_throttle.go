@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"personal_site/attempts"
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Failed password checks are counted per IP address and per account (by email, whether it
+// exists or not). Once a counter passes a third of its limit every further attempt has to
+// wait an exponentially growing delay (up to LOGIN_MAX_BACKOFF); at the limit the IP or
+// account is locked out for LOGIN_LOCKOUT_DURATION.
+const (
+	ThrottleKindAccount = "account"
+	ThrottleKindIP      = "ip"
+
+	maxBackoffExponent = 20
+)
+
+type throttleTarget struct {
+	kind        string
+	subject     string
+	maxFailures int
+}
+
+// passwordAttemptTargets returns the counters a password check of email from the client counts against
+func passwordAttemptTargets(c *gin.Context, email string) []throttleTarget {
+	return []throttleTarget{
+		{kind: ThrottleKindIP, subject: c.ClientIP(), maxFailures: getLoginMaxFailures("LOGIN_MAX_FAILURES_PER_IP", 100)},
+		{kind: ThrottleKindAccount, subject: strings.ToLower(email), maxFailures: getLoginMaxFailures("LOGIN_MAX_FAILURES_PER_ACCOUNT", 10)},
+	}
+}
+
+func throttleKey(kind, subject string) string {
+	return kind + ":" + subject
+}
+
+// allowPasswordAttempt aborts with 429 when the IP or the account has to wait before trying again
+func allowPasswordAttempt(c *gin.Context, email string) bool {
+	now := time.Now()
+	var until time.Time
+	for _, target := range passwordAttemptTargets(c, email) {
+		record, err := attempts.Default().Get(throttleKey(target.kind, target.subject))
+		if err != nil {
+			// Do not lock everyone out when the store is down
+			log.Println("[LoginThrottle] get attempts error:", err)
+			continue
+		}
+		if t := throttledUntil(record, target.maxFailures, now); t.After(until) {
+			until = t
+		}
+	}
+	if !now.Before(until) {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(429, gin.H{"error": "Too many failed attempts, try again later", "retry_after": retryAfter})
+	return false
+}
+
+// passwordAttemptFailed counts a failed password check and locks the IP or the account out
+// when it reaches its limit. userID is 0 when email does not belong to a user.
+func passwordAttemptFailed(c *gin.Context, db *gorm.DB, email string, userID uint) {
+	now := time.Now()
+	for _, target := range passwordAttemptTargets(c, email) {
+		key := throttleKey(target.kind, target.subject)
+		record, err := attempts.Default().AddFailure(key, now, getLoginFailureWindow())
+		if err != nil {
+			log.Println("[LoginThrottle] add failure error:", err)
+			continue
+		}
+		if record.Failures < target.maxFailures || record.Locked(now) {
+			continue
+		}
+
+		lockedUntil := now.Add(getLoginLockoutDuration())
+		if err := attempts.Default().Lock(key, lockedUntil); err != nil {
+			log.Println("[LoginThrottle] lock error:", err)
+			continue
+		}
+
+		lockout := models.LoginLockout{
+			Kind:        target.kind,
+			Subject:     target.subject,
+			IP:          c.ClientIP(),
+			Failures:    record.Failures,
+			LockedUntil: lockedUntil,
+		}
+		if target.kind == ThrottleKindAccount && userID != 0 {
+			lockout.UserID = &userID
+		}
+		if err := db.Create(&lockout).Error; err != nil {
+			log.Println("[LoginThrottle] record lockout error:", err, "subject:", target.subject)
+		}
+		var targetUserID uint
+		if lockout.UserID != nil {
+			targetUserID = *lockout.UserID
+		}
+		audit.Record(db, c, audit.Entry{
+			Action:       audit.ActionLockout,
+			Outcome:      audit.OutcomeDenied,
+			TargetUserID: targetUserID,
+			Details:      map[string]any{"kind": target.kind, "subject": target.subject, "failures": record.Failures},
+		})
+	}
+}
+
+// passwordAttemptSucceeded clears the account counter. The IP counter is kept, otherwise
+// an attacker could reset it by logging in to their own account in between.
+func passwordAttemptSucceeded(email string) {
+	if err := attempts.Default().Reset(throttleKey(ThrottleKindAccount, strings.ToLower(email))); err != nil {
+		log.Println("[LoginThrottle] reset error:", err)
+	}
+}
+
+// UnlockLogin clears the counter of an account (by email) or IP address and marks its
+// active lockouts as unlocked by adminID
+func UnlockLogin(db *gorm.DB, kind, subject string, adminID uint) (int64, error) {
+	if kind == ThrottleKindAccount {
+		subject = strings.ToLower(subject)
+	}
+	if err := attempts.Default().Reset(throttleKey(kind, subject)); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	result := db.Model(&models.LoginLockout{}).
+		Where("kind = ? AND subject = ? AND unlocked_at IS NULL AND locked_until > ?", kind, subject, now).
+		Updates(map[string]any{"unlocked_at": now, "unlocked_by": adminID})
+	return result.RowsAffected, result.Error
+}
+
+// throttledUntil returns when the next attempt after now is allowed for record. An expired
+// lock stays in the record, the backoff of the failures since then applies instead.
+func throttledUntil(record attempts.Record, maxFailures int, now time.Time) time.Time {
+	if record.Locked(now) {
+		return record.LockedUntil
+	}
+
+	backoffAfter := max(maxFailures/3, 1)
+	if record.Failures < backoffAfter {
+		return time.Time{}
+	}
+	exponent := min(record.Failures-backoffAfter, maxBackoffExponent)
+	delay := min(getLoginBackoffBase()<<exponent, getLoginMaxBackoff())
+	return record.LastFailure.Add(delay)
+}
+
+func getLoginMaxFailures(varName string, fallback int) int {
+	n, err := config.GetVariableAsInt(varName)
+	if err != nil || n < 1 {
+		return fallback
+	}
+	return n
+}
+
+func getLoginBackoffBase() time.Duration {
+	base, err := config.GetVariableAsTimeDuration("LOGIN_BACKOFF_BASE")
+	if err != nil {
+		return time.Second // Default to 1 second if not set
+	}
+	return base
+}
+
+func getLoginMaxBackoff() time.Duration {
+	backoff, err := config.GetVariableAsTimeDuration("LOGIN_MAX_BACKOFF")
+	if err != nil {
+		return time.Minute // Default to 1 minute if not set
+	}
+	return backoff
+}
+
+func getLoginLockoutDuration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("LOGIN_LOCKOUT_DURATION")
+	if err != nil {
+		return 15 * time.Minute // Default to 15 minutes if not set
+	}
+	return exp
+}
+
+func getLoginFailureWindow() time.Duration {
+	window, err := config.GetVariableAsTimeDuration("LOGIN_FAILURE_WINDOW")
+	if err != nil {
+		return 15 * time.Minute // Default to 15 minutes if not set
+	}
+	return window
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"personal_site/apipaths"
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/mailer"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// amrEmail is the amr of a magic link login, the user proved access to the mailbox
+const amrEmail = "email"
+
+type magicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type magicLinkLoginRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// RequestMagicLink emails a single-use login link. Every address gets one, an unknown
+// address signs up when the link is used, so the response tells nothing about the account.
+// Requests are limited per email and IP address.
+func RequestMagicLink(c *gin.Context, db *gorm.DB) {
+	var req magicLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if !allowEmailRequest(c, email) {
+		return
+	}
+
+	ttl := getMagicLinkExpiration()
+	token, err := generatePurposeToken(purposeMagicLink, 0, ttl, map[string]string{"email": email})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate login link", "details": err.Error()})
+		return
+	}
+
+	err = mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Hi,\n\nOpen the link below to log in:\n\n%s\n\n"+
+			"The link expires in %s and can only be used once. If it was not you, you can ignore this email.\n",
+			magicLinkURL(token), ttl),
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to send login link", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionMagicLinkRequest, Details: map[string]any{"email": email}})
+
+	c.JSON(200, gin.H{"message": "Login link sent, check your email"})
+}
+
+// MagicLinkLogin uses a login link. It logs in the account of the email, creating it on
+// first use; accounts with TOTP enabled still need their code.
+func MagicLinkLogin(c *gin.Context, db *gorm.DB) {
+	var req magicLinkLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := validatePurposeToken(req.Token, purposeMagicLink)
+	if err == nil {
+		err = consumePurposeToken(db, claims)
+	}
+	if err != nil || claims.Data["email"] == "" {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionLogin, Outcome: audit.OutcomeFailure, Details: map[string]any{"method": amrEmail, "reason": "invalid link"}})
+		c.JSON(400, gin.H{"error": "Invalid or expired login link"})
+		return
+	}
+	email := claims.Data["email"]
+
+	user, err := findMagicLinkUser(db, email)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if user.ID == 0 {
+		now := time.Now()
+		user = models.User{
+			Nickname:        fallbackNickname(strings.Split(email, "@")[0]),
+			Role:            models.RoleUser,
+			Provider:        models.AuthProviderEmail,
+			Email:           email,
+			EmailVerifiedAt: &now, // the link was opened from the mailbox
+		}
+		if err := db.Create(&user).Error; err != nil {
+			audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, Outcome: audit.OutcomeFailure, Details: map[string]any{"email": email, "provider": user.Provider}})
+			c.JSON(500, gin.H{"error": "Failed to create user", "details": err.Error()})
+			return
+		}
+		audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, ActorID: user.ID, TargetUserID: user.ID, Details: map[string]any{"provider": user.Provider}})
+	}
+
+	mfaEnabled, err := hasConfirmedTOTP(db, user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if mfaEnabled && userStatusError(user) == nil {
+		respondMFARequired(c, user, false, amrEmail)
+		return
+	}
+
+	finishLogin(c, db, user, false, amrEmail)
+}
+
+// findMagicLinkUser returns the account a login link for email opens, or a zero user when a
+// new one should be created. That is the magic link account of the email, else an account
+// that verified the email. An account with the email unverified may belong to someone who
+// typed in an address that is not theirs, so it is never taken over.
+// Unscoped, so a deleted user is refused instead of being created again.
+func findMagicLinkUser(db *gorm.DB, email string) (models.User, error) {
+	var user models.User
+	err := db.Unscoped().Where("email = ? AND provider = ?", email, models.AuthProviderEmail).Limit(1).Find(&user).Error
+	if err != nil || user.ID != 0 {
+		return user, err
+	}
+	err = db.Unscoped().Where("email = ? AND email_verified_at IS NOT NULL", email).Order("id").Limit(1).Find(&user).Error
+	return user, err
+}
+
+// magicLinkURL points at MAGIC_LINK_URL (the frontend page) with the token as query parameter
+func magicLinkURL(token string) string {
+	base, err := config.GetVariableAsString("MAGIC_LINK_URL")
+	if err != nil {
+		base = computeRedirectURL(apipaths.MagicLinkPath + "/verify")
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+func getMagicLinkExpiration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("MAGIC_LINK_EXPIRATION")
+	if err != nil {
+		exp = 15 * time.Minute // Default to 15 minutes if not set
+	}
+	return exp
+}
@@ -0,0 +1,421 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+	"gorm.io/gorm"
+)
+
+const recoveryCodeCount = 10
+
+type mfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type verifyMFARequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP code or recovery code
+}
+
+type mfaPendingResponse struct {
+	Message     string `json:"message"`
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// SetupTOTP creates a new unconfirmed TOTP secret for the current password account
+// and returns it together with a QR code for authenticator apps
+func SetupTOTP(c *gin.Context, db *gorm.DB) {
+	user, ok := currentPasswordUser(c, db)
+	if !ok {
+		return
+	}
+
+	var cred models.TOTPCredential
+	err := db.Where("user_id = ?", user.ID).First(&cred).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if err == nil && cred.ConfirmedAt != nil {
+		c.JSON(409, gin.H{"error": "TOTP is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate secret", "details": err.Error()})
+		return
+	}
+
+	cred.UserID = user.ID
+	cred.Secret = secret
+	cred.LastUsedStep = 0
+	if err := db.Save(&cred).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to save TOTP secret", "details": err.Error()})
+		return
+	}
+
+	uri := totpProvisioningURI(secret, user.Email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate QR code", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret":      secret,
+		"otpauth_url": uri,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTOTP enables TOTP after the user proved the authenticator works, and returns
+// the recovery codes. The codes are only shown this one time.
+func ConfirmTOTP(c *gin.Context, db *gorm.DB) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentPasswordUser(c, db)
+	if !ok {
+		return
+	}
+
+	var cred models.TOTPCredential
+	if err := db.Where("user_id = ? AND confirmed_at IS NULL", user.ID).First(&cred).Error; err != nil {
+		c.JSON(400, gin.H{"error": "No pending TOTP setup"})
+		return
+	}
+
+	step, valid := validateTOTPCode(cred.Secret, req.Code, cred.LastUsedStep, time.Now())
+	if !valid {
+		c.JSON(400, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	now := time.Now()
+	cred.ConfirmedAt = &now
+	cred.LastUsedStep = step
+	if err := db.Save(&cred).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to enable TOTP", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionMFAEnable, TargetUserID: user.ID, Details: map[string]any{"method": "totp"}})
+
+	codes, err := replaceRecoveryCodes(db, user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate recovery codes", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "TOTP enabled", "recovery_codes": codes})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes, it requires a current TOTP code
+func RegenerateRecoveryCodes(c *gin.Context, db *gorm.DB) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentPasswordUser(c, db)
+	if !ok {
+		return
+	}
+
+	cred, err := findConfirmedTOTP(db, user.ID)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "TOTP is not enabled"})
+		return
+	}
+	if !checkTOTP(db, &cred, req.Code) {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionRecoveryCodes, Outcome: audit.OutcomeFailure, TargetUserID: user.ID})
+		c.JSON(403, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(db, user.ID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate recovery codes", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionRecoveryCodes, TargetUserID: user.ID})
+
+	c.JSON(200, gin.H{"message": "Recovery codes regenerated", "recovery_codes": codes})
+}
+
+// DisableTOTP removes the authenticator and recovery codes, it requires a TOTP or recovery code
+func DisableTOTP(c *gin.Context, db *gorm.DB) {
+	var req mfaCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, ok := currentPasswordUser(c, db)
+	if !ok {
+		return
+	}
+
+	cred, err := findConfirmedTOTP(db, user.ID)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "TOTP is not enabled"})
+		return
+	}
+	if !checkMFACode(db, &cred, req.Code) {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionMFADisable, Outcome: audit.OutcomeFailure, TargetUserID: user.ID})
+		c.JSON(403, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(&cred).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to disable TOTP", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionMFADisable, TargetUserID: user.ID, Details: map[string]any{"method": "totp"}})
+
+	c.JSON(200, gin.H{"message": "TOTP disabled"})
+}
+
+// VerifyMFA finishes a login that returned mfa_required: it exchanges the pending
+// token plus a TOTP or recovery code for a real session
+func VerifyMFA(c *gin.Context, db *gorm.DB) {
+	var req verifyMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := validatePurposeToken(req.MFAToken, purposeMFAPending)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if revoked, err := getRevocationCache(db).isTokenIDRevoked(claims.ID, getRevocationCacheTTL()); err != nil || revoked {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, claims.UserID()).Error; err != nil {
+		c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	cred, err := findConfirmedTOTP(db, user.ID)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "TOTP is not enabled"})
+		return
+	}
+	// Codes are counted against the same limits as passwords
+	if !allowPasswordAttempt(c, user.Email) {
+		return
+	}
+	if !checkMFACode(db, &cred, req.Code) {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionMFAVerify, Outcome: audit.OutcomeFailure, TargetUserID: user.ID})
+		passwordAttemptFailed(c, db, user.Email, user.ID)
+		c.JSON(401, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// The pending token is single use, of two requests racing with it only one gets a session
+	if err := consumePurposeToken(db, claims); err != nil {
+		if errors.Is(err, errPurposeTokenUsed) {
+			c.JSON(401, gin.H{"error": "Invalid or expired MFA token"})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to finish login", "details": err.Error()})
+		return
+	}
+	passwordAttemptSucceeded(user.Email)
+
+	firstFactor := claims.Data["first_factor"]
+	if firstFactor == "" {
+		firstFactor = amrPassword
+	}
+	finishLogin(c, db, user, claims.Data["delivery"] == deliveryBody, firstFactor, amrOTP, amrMFA)
+}
+
+// respondMFARequired answers a login whose first factor (an amr value) succeeded for a user
+// with TOTP enabled. The pending token remembers how /auth/mfa/verify should answer.
+func respondMFARequired(c *gin.Context, user models.User, inBody bool, firstFactor string) {
+	mfaToken, err := generateMFAPendingToken(user, inBody, firstFactor)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate MFA token", "details": err.Error()})
+		return
+	}
+	c.JSON(200, mfaPendingResponse{
+		Message:     "MFA required",
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+}
+
+// generateMFAPendingToken returns the token /auth/mfa/verify takes with the code after the
+// first factor succeeded for user
+func generateMFAPendingToken(user models.User, inBody bool, firstFactor string) (string, error) {
+	data := map[string]string{"first_factor": firstFactor}
+	if inBody {
+		data["delivery"] = deliveryBody // /auth/mfa/verify answers like this request
+	}
+	return generatePurposeToken(purposeMFAPending, user.ID, getMFAPendingTokenExpiration(), data)
+}
+
+// RoleRequiresMFA reports whether MFA_REQUIRED_ROLES (comma separated) contains role
+func RoleRequiresMFA(role string) bool {
+	roles, err := config.GetVariableAsString("MFA_REQUIRED_ROLES")
+	if err != nil {
+		return false
+	}
+	for _, r := range strings.Split(roles, ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// getMFAPendingTokenExpiration is how long the user has to enter the code after the password step
+func getMFAPendingTokenExpiration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("MFA_PENDING_TOKEN_EXPIRATION")
+	if err != nil {
+		exp = 5 * time.Minute // Default to 5 minutes if not set
+	}
+	return exp
+}
+
+// hasConfirmedTOTP reports whether login of the user needs a second step
+func hasConfirmedTOTP(db *gorm.DB, userID uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.TOTPCredential{}).Where("user_id = ? AND confirmed_at IS NOT NULL", userID).Count(&count).Error
+	return count > 0, err
+}
+
+func findConfirmedTOTP(db *gorm.DB, userID uint) (models.TOTPCredential, error) {
+	var cred models.TOTPCredential
+	err := db.Where("user_id = ? AND confirmed_at IS NOT NULL", userID).First(&cred).Error
+	return cred, err
+}
+
+// checkMFACode accepts either a TOTP code or an unused recovery code
+func checkMFACode(db *gorm.DB, cred *models.TOTPCredential, code string) bool {
+	if checkTOTP(db, cred, code) {
+		return true
+	}
+	return useRecoveryCode(db, cred.UserID, code)
+}
+
+// checkTOTP validates a TOTP code and remembers its step so it cannot be used twice
+func checkTOTP(db *gorm.DB, cred *models.TOTPCredential, code string) bool {
+	step, valid := validateTOTPCode(cred.Secret, code, cred.LastUsedStep, time.Now())
+	if !valid {
+		return false
+	}
+
+	result := db.Model(&models.TOTPCredential{}).
+		Where("id = ? AND last_used_step < ?", cred.ID, step).
+		Update("last_used_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	cred.LastUsedStep = step
+	return true
+}
+
+// useRecoveryCode marks a matching unused recovery code as used
+func useRecoveryCode(db *gorm.DB, userID uint, code string) bool {
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false
+	}
+
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalized)).
+		Update("used_at", time.Now())
+	return result.Error == nil && result.RowsAffected > 0
+}
+
+// replaceRecoveryCodes deletes the old recovery codes of the user and returns new plain codes
+func replaceRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]models.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		secret, err := generateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secret[:5] + "-" + secret[5:10])
+		codes = append(codes, code)
+		rows = append(rows, models.RecoveryCode{UserID: userID, CodeHash: hashToken(normalizeRecoveryCode(code))})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes the user may type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+	return code
+}
+
+// currentPasswordUser loads the logged in user, MFA is only offered for password accounts
+func currentPasswordUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	tokenUser, err := utils.GetTokenUser(c)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Unauthorized"})
+		return models.User{}, false
+	}
+
+	var user models.User
+	if err := db.First(&user, tokenUser.ID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to find user"})
+		return models.User{}, false
+	}
+
+	if user.Provider != models.AuthProviderPassword {
+		c.JSON(403, gin.H{"error": "MFA is only available for password-based accounts"})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+// MFASatisfied reports whether the token meets the MFA requirement of its role
+func MFASatisfied(claims *schemas.TokenClaims) bool {
+	return !RoleRequiresMFA(claims.Payload.Role) || claims.HasAuthMethod(amrMFA)
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"personal_site/schemas"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTP(t *testing.T) {
+	// Test vector from RFC 6238 appendix B, truncated to 6 digits
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	t.Run("Matches RFC 6238", func(t *testing.T) {
+		code, err := totpCode(secret, 59/totpPeriod)
+		require.NoError(t, err)
+		assert.Equal(t, "287082", code)
+
+		code, err = totpCode(secret, 1111111109/totpPeriod)
+		require.NoError(t, err)
+		assert.Equal(t, "081804", code)
+	})
+
+	t.Run("Accepts adjacent steps and rejects replays", func(t *testing.T) {
+		now := time.Unix(1111111109, 0)
+		previous, err := totpCode(secret, now.Unix()/totpPeriod-1)
+		require.NoError(t, err)
+
+		step, ok := validateTOTPCode(secret, previous, 0, now)
+		assert.True(t, ok, "Code of the previous step should be accepted")
+
+		_, ok = validateTOTPCode(secret, previous, step, now)
+		assert.False(t, ok, "Code should not be accepted twice")
+
+		_, ok = validateTOTPCode(secret, "000000", 0, now)
+		assert.False(t, ok)
+	})
+
+	t.Run("Provisioning URI", func(t *testing.T) {
+		uri := totpProvisioningURI(secret, "user@example.com")
+		assert.Contains(t, uri, "otpauth://totp/")
+		assert.Contains(t, uri, "secret="+secret)
+	})
+}
+
+func TestMFASatisfied(t *testing.T) {
+	t.Setenv("MFA_REQUIRED_ROLES", "admin, editor")
+
+	admin := &schemas.TokenClaims{Payload: schemas.TokenPayload{Role: "admin"}}
+	assert.False(t, MFASatisfied(admin), "Admin without MFA should be rejected")
+
+	admin.AuthMethods = []string{amrPassword, amrOTP, amrMFA}
+	assert.True(t, MFASatisfied(admin))
+
+	user := &schemas.TokenClaims{Payload: schemas.TokenPayload{Role: "user"}}
+	assert.True(t, MFASatisfied(user), "Roles not listed do not need MFA")
+}
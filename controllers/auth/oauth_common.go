@@ -1,8 +1,6 @@
 package auth
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"net/url"
 	"strconv"
 	"strings"
@@ -11,42 +9,8 @@ import (
 	"personal_site/models"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-// encodeOAuthState packs redirect and a nonce into a base64url JSON string
-func encodeOAuthState(redirect string) string {
-	payload := map[string]string{
-		"n": randomState(),
-		"r": redirect,
-	}
-	b, err := json.Marshal(payload)
-	if err != nil {
-		delete(payload, "r") // If we can't marshal, just remove nonce
-		b, err = json.Marshal(payload)
-		if err != nil {
-			b = []byte(randomState())
-		}
-	}
-	return base64.RawURLEncoding.EncodeToString(b)
-}
-
-// decodeOAuthStateRedirect extracts the redirect from state
-func decodeOAuthStateRedirect(raw string) string {
-	if raw == "" {
-		return ""
-	}
-	if b, err := base64.RawURLEncoding.DecodeString(raw); err == nil {
-		var m map[string]string
-		if json.Unmarshal(b, &m) == nil {
-			if r, ok := m["r"]; ok {
-				return r
-			}
-		}
-	}
-	return ""
-}
-
 // finalizeLoginResponse redirects back with user info in query, or returns JSON when no redirect
 func finalizeLoginResponse(c *gin.Context, redirectBack string, user models.User, message string) {
 	if redirectBack != "" {
@@ -64,28 +28,6 @@ func finalizeLoginResponse(c *gin.Context, redirectBack string, user models.User
 	c.JSON(200, gin.H{"message": message, "user_id": user.ID, "role": user.Role, "nickname": user.Nickname})
 }
 
-// ensureUserFromOAuth finds or creates a user from provider + providerID
-func ensureUserFromOAuth(db *gorm.DB, provider models.AuthProvider, providerID, email string, nicknameCandidates ...string) (models.User, error) {
-	var user models.User
-	if err := db.Where("provider = ? AND identifier = ?", provider, providerID).First(&user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			user = models.User{
-				Nickname:   fallbackNickname(nicknameCandidates...),
-				Role:       models.RoleUser,
-				Provider:   provider,
-				Email:      email,
-				Identifier: providerID,
-			}
-			if err := db.Create(&user).Error; err != nil {
-				return models.User{}, err
-			}
-		} else {
-			return models.User{}, err
-		}
-	}
-	return user, nil
-}
-
 // computeRedirectURL builds an absolute callback URL based on the current request's scheme/host and a router path
 func computeRedirectURL(callbackPath string) string {
 	// Read base URL from environment (.env), e.g. PUBLIC_BASE_URL=https://example.com
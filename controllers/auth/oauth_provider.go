@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"personal_site/apipaths"
+	"personal_site/config"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+// errInvalidIDToken marks identify errors caused by what the provider sent, they are
+// answered with 401 instead of 500
+var errInvalidIDToken = errors.New("invalid ID token")
+
+// oidcProviderName is what an OpenID Connect provider can be called in OIDC_PROVIDERS, it
+// becomes the provider column of the users and identities tables (size 16)
+var oidcProviderName = regexp.MustCompile(`^[a-z][a-z0-9-]{0,15}$`)
+
+// oauthProvider is an entry of the login provider registry. Each entry knows how to build
+// its OAuth2 config and how to turn the exchanged token into an identity, the start and
+// callback handlers are shared. Every flow uses PKCE; providers with ID tokens also get a
+// nonce, which identify has to find in the ID token.
+type oauthProvider struct {
+	Name         models.AuthProvider
+	DisplayName  string
+	LoginPath    string
+	CallbackPath string
+	UsesIDToken  bool
+	config       func() (*oauth2.Config, error)
+	identify     func(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, nonce string) (oauthIdentity, error)
+}
+
+type oauthProviderResponse struct {
+	Name        models.AuthProvider `json:"name"`
+	DisplayName string              `json:"display_name"`
+	LoginPath   string              `json:"login_path"`
+}
+
+var (
+	oauthProviders   map[models.AuthProvider]*oauthProvider
+	oauthProviderIDs []models.AuthProvider // registration order, for listing
+	oauthProvidersMu sync.RWMutex
+)
+
+// LoadOAuthProviders (re)builds the registry: GitHub, Google and LINE, followed by every
+// OpenID Connect provider listed in OIDC_PROVIDERS. Entries read their credentials when
+// they are first used, so a provider without credentials only fails its own logins.
+// Invalid names are skipped and reported in the returned error.
+func LoadOAuthProviders() error {
+	providers := []*oauthProvider{
+		newGitHubProvider(),
+		newGoogleProvider(),
+		newLineProvider(),
+	}
+
+	var errs []error
+	if names, err := config.GetVariableAsString("OIDC_PROVIDERS"); err == nil {
+		for _, name := range strings.Split(names, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if !oidcProviderName.MatchString(name) {
+				errs = append(errs, fmt.Errorf("invalid OIDC provider name %q", name))
+				continue
+			}
+			if slices.ContainsFunc(providers, func(p *oauthProvider) bool { return string(p.Name) == name }) ||
+				models.AuthProvider(name).IsLocal() {
+				errs = append(errs, fmt.Errorf("OIDC provider %q is already defined", name))
+				continue
+			}
+			providers = append(providers, newConfiguredOIDCProvider(name))
+		}
+	}
+
+	registry := make(map[models.AuthProvider]*oauthProvider, len(providers))
+	ids := make([]models.AuthProvider, 0, len(providers))
+	for _, p := range providers {
+		models.RegisterAuthProvider(p.Name)
+		registry[p.Name] = p
+		ids = append(ids, p.Name)
+	}
+
+	oauthProvidersMu.Lock()
+	oauthProviders = registry
+	oauthProviderIDs = ids
+	oauthProvidersMu.Unlock()
+	return errors.Join(errs...)
+}
+
+// registeredOAuthProviders returns the registry and its order, loading it on first use.
+// The registry is replaced as a whole on reload, so the returned map is never modified.
+func registeredOAuthProviders() (map[models.AuthProvider]*oauthProvider, []models.AuthProvider) {
+	oauthProvidersMu.RLock()
+	registry, ids := oauthProviders, oauthProviderIDs
+	oauthProvidersMu.RUnlock()
+	if registry != nil {
+		return registry, ids
+	}
+
+	if err := LoadOAuthProviders(); err != nil {
+		log.Println("[OAuth] load providers error:", err)
+	}
+	oauthProvidersMu.RLock()
+	defer oauthProvidersMu.RUnlock()
+	return oauthProviders, oauthProviderIDs
+}
+
+// lookupOAuthProvider returns the registry entry of name
+func lookupOAuthProvider(name models.AuthProvider) (*oauthProvider, bool) {
+	registry, _ := registeredOAuthProviders()
+	p, ok := registry[name]
+	return p, ok
+}
+
+// ListOAuthProviders lists the login providers, so the frontend can render its buttons
+func ListOAuthProviders(c *gin.Context) {
+	registry, ids := registeredOAuthProviders()
+	resp := make([]oauthProviderResponse, 0, len(ids))
+	for _, id := range ids {
+		p := registry[id]
+		resp = append(resp, oauthProviderResponse{Name: p.Name, DisplayName: p.DisplayName, LoginPath: p.LoginPath})
+	}
+	c.JSON(200, gin.H{"providers": resp})
+}
+
+// OAuthLoginStart redirects the user to the authorization URL of provider
+func OAuthLoginStart(c *gin.Context, provider models.AuthProvider) {
+	p, ok := lookupOAuthProvider(provider)
+	if !ok {
+		c.JSON(404, gin.H{"error": "Unknown provider"})
+		return
+	}
+	conf, err := p.config()
+	if err != nil {
+		c.JSON(500, gin.H{"error": p.DisplayName + " OAuth not configured", "details": err.Error()})
+		return
+	}
+	state, err := beginOAuthState(c)
+	if err != nil {
+		abortOAuthState(c, err)
+		return
+	}
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOnline, oauth2.S256ChallengeOption(state.Verifier)}
+	if p.UsesIDToken {
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", state.IDNonce))
+	}
+	authURL := conf.AuthCodeURL(state.Nonce, opts...)
+	c.Redirect(302, authURL)
+}
+
+// OAuthLoginCallback handles the redirect back from provider
+func OAuthLoginCallback(c *gin.Context, db *gorm.DB, provider models.AuthProvider) {
+	p, ok := lookupOAuthProvider(provider)
+	if !ok {
+		c.JSON(404, gin.H{"error": "Unknown provider"})
+		return
+	}
+	conf, err := p.config()
+	if err != nil {
+		c.JSON(500, gin.H{"error": p.DisplayName + " OAuth not configured", "details": err.Error()})
+		return
+	}
+
+	state, err := finishOAuthState(c)
+	if err != nil {
+		abortOAuthState(c, err)
+		return
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		c.JSON(400, gin.H{"error": "Missing code"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	token, err := conf.Exchange(ctx, code, oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Code exchange failed", "details": err.Error()})
+		return
+	}
+
+	ident, err := p.identify(ctx, conf, token, state.IDNonce)
+	if err != nil {
+		if errors.Is(err, errInvalidIDToken) {
+			c.JSON(401, gin.H{"error": "Invalid " + p.DisplayName + " login", "details": err.Error()})
+			return
+		}
+		c.JSON(500, gin.H{"error": "Failed to fetch " + p.DisplayName + " user", "details": err.Error()})
+		return
+	}
+	ident.Provider = p.Name
+	if ident.Email == "" {
+		// Create a synthetic email to satisfy NOT NULL + UNIQUE constraint
+		ident.Email = fmt.Sprintf("%s_%s@users.noreply.%s.local", p.Name, ident.Subject, p.Name)
+		ident.EmailVerified = false
+	}
+
+	completeOAuthLogin(c, db, ident, state.Redirect, p.DisplayName+" login successful")
+}
+
+// oidcLoginPath and oidcCallbackPath are the router paths of a configured OIDC provider
+func oidcLoginPath(name string) string {
+	return apipaths.AuthGroup + apipaths.OIDCRel + "/" + name
+}
+
+func oidcCallbackPath(name string) string {
+	return oidcLoginPath(name) + "/callback"
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"personal_site/config"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauthStateCookieName = "oauth_state"
+	oauthStateExpiration = 10 * time.Minute
+)
+
+var (
+	errInvalidOAuthState  = errors.New("invalid OAuth state")
+	errRedirectNotAllowed = errors.New("redirect is not an allowed origin")
+)
+
+// oauthState is kept in an encrypted cookie between the login start and the callback.
+// The nonce is also sent to the provider as the state parameter, so a callback can
+// only be completed by the browser that started the login. Verifier is the PKCE code
+// verifier and IDNonce the nonce the ID token of an OpenID Connect provider must carry;
+// both must stay secret from the browser, hence the encryption.
+type oauthState struct {
+	Nonce     string `json:"n"`
+	Redirect  string `json:"r,omitempty"`
+	ExpiresAt int64  `json:"e"`
+	Verifier  string `json:"v"`
+	IDNonce   string `json:"i"`
+}
+
+// beginOAuthState checks the redirect query parameter against the allowlist, stores a new
+// state in the cookie and returns it. Its Nonce is the OAuth state parameter.
+func beginOAuthState(c *gin.Context) (oauthState, error) {
+	redirect := c.Query("redirect")
+	if redirect != "" && !isAllowedRedirect(redirect) {
+		return oauthState{}, errRedirectNotAllowed
+	}
+
+	state := oauthState{
+		Nonce:     randomState(),
+		Redirect:  redirect,
+		ExpiresAt: time.Now().Add(oauthStateExpiration).Unix(),
+		Verifier:  oauth2.GenerateVerifier(),
+		IDNonce:   randomState(),
+	}
+	value, err := sealOAuthState(state)
+	if err != nil {
+		return oauthState{}, err
+	}
+
+	setOAuthStateCookie(c, value, oauthStateExpiration)
+	return state, nil
+}
+
+// finishOAuthState validates the state parameter of the callback against the cookie and
+// returns the state saved at the start. The cookie is removed so it is used only once.
+func finishOAuthState(c *gin.Context) (oauthState, error) {
+	value, err := c.Cookie(oauthStateCookieName)
+	if err != nil || value == "" {
+		return oauthState{}, errInvalidOAuthState
+	}
+	setOAuthStateCookie(c, "", -1)
+
+	state, err := openOAuthState(value)
+	if err != nil {
+		return oauthState{}, err
+	}
+	if time.Now().Unix() > state.ExpiresAt {
+		return oauthState{}, errInvalidOAuthState
+	}
+	if subtle.ConstantTimeCompare([]byte(state.Nonce), []byte(c.Query("state"))) != 1 {
+		return oauthState{}, errInvalidOAuthState
+	}
+	// The allowlist may have changed since the start
+	if state.Redirect != "" && !isAllowedRedirect(state.Redirect) {
+		return oauthState{}, errRedirectNotAllowed
+	}
+	return state, nil
+}
+
+// abortOAuthState answers a start or callback whose state or redirect was rejected
+func abortOAuthState(c *gin.Context, err error) {
+	if errors.Is(err, errRedirectNotAllowed) {
+		c.JSON(400, gin.H{"error": "Redirect not allowed", "details": err.Error()})
+		return
+	}
+	if errors.Is(err, errInvalidOAuthState) {
+		c.JSON(400, gin.H{"error": "Invalid OAuth state"})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to handle OAuth state", "details": err.Error()})
+}
+
+// sealOAuthState encrypts state with AES-256-GCM as base64url(nonce + ciphertext)
+func sealOAuthState(state oauthState) (string, error) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	aead, err := oauthStateAEAD()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, payload, []byte(oauthStateCookieName))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openOAuthState decrypts a cookie of sealOAuthState, any tampering makes it invalid
+func openOAuthState(value string) (oauthState, error) {
+	aead, err := oauthStateAEAD()
+	if err != nil {
+		return oauthState{}, err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return oauthState{}, errInvalidOAuthState
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, ciphertext, []byte(oauthStateCookieName))
+	if err != nil {
+		return oauthState{}, errInvalidOAuthState
+	}
+
+	var state oauthState
+	if err := json.Unmarshal(payload, &state); err != nil || state.Nonce == "" || state.Verifier == "" {
+		return oauthState{}, errInvalidOAuthState
+	}
+	return state, nil
+}
+
+// oauthStateAEAD derives the cookie encryption key from the state secret, so the secret
+// itself can have any length
+func oauthStateAEAD() (cipher.AEAD, error) {
+	secret, err := getOAuthStateKey()
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("oauth-state-encryption"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// getOAuthStateKey reads OAUTH_STATE_SECRET, falling back to JWT_SECRET_KEY
+func getOAuthStateKey() ([]byte, error) {
+	if key, err := config.GetVariableAsByteArr("OAUTH_STATE_SECRET"); err == nil {
+		return key, nil
+	}
+	return config.GetVariableAsByteArr("JWT_SECRET_KEY")
+}
+
+// isAllowedRedirect reports whether raw is an absolute http(s) URL on one of the
+// origins in CORS_ALLOWED_ORIGINS, so logins cannot be bounced to foreign hosts
+func isAllowedRedirect(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+
+	return isAllowedOrigin(u.Scheme + "://" + u.Host)
+}
+
+// isAllowedOrigin reports whether origin ("scheme://host[:port]") is in CORS_ALLOWED_ORIGINS
+func isAllowedOrigin(origin string) bool {
+	origins, err := config.GetVariableAsString("CORS_ALLOWED_ORIGINS")
+	if err != nil {
+		return false
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range strings.Split(origins, ",") {
+		if strings.ToLower(strings.TrimRight(strings.TrimSpace(allowed), "/")) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func setOAuthStateCookie(c *gin.Context, value string, exp time.Duration) {
+	maxAge := int(exp.Seconds())
+	if exp < 0 {
+		maxAge = -1
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		oauthStateCookieName, // cookie name
+		value,                // cookie value
+		maxAge,               // max age in seconds
+		refreshCookiePath(),  // path, the callbacks are under /auth
+		"",                   // domain (empty means current domain)
+		true,                 // secure (set to true in production with HTTPS)
+		true,                 // httpOnly
+	)
+}
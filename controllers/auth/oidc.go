@@ -0,0 +1,383 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"personal_site/config"
+	"personal_site/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Refetch the JWKS of an issuer at most this often when a token has an unknown kid
+	oidcJWKSRefreshInterval = time.Minute
+	// Clock skew allowed when checking exp, iat and nbf of ID tokens
+	oidcClockSkew = time.Minute
+)
+
+var defaultOIDCScopes = []string{"openid", "email", "profile"}
+
+// oidcIDTokenMethods are the signatures accepted on ID tokens, "none" and HMAC never are
+var oidcIDTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcSettings describes where an OpenID Connect provider reads its configuration
+type oidcSettings struct {
+	Name            models.AuthProvider
+	DisplayName     string
+	LoginPath       string
+	CallbackPath    string
+	IssuerVar       string
+	DefaultIssuer   string // used when IssuerVar is not set, empty makes the issuer required
+	ClientIDVar     string
+	ClientSecretVar string
+	ScopesVar       string   // optional, space or comma separated
+	ExtraIssuers    []string // other iss values the provider puts in its ID tokens
+}
+
+// oidcDiscovery is the part of .well-known/openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClient discovers the endpoints of an issuer on first use and verifies its ID tokens
+// with the keys of its JWKS. A failed discovery is retried on the next login.
+type oidcClient struct {
+	settings oidcSettings
+
+	mu            sync.Mutex
+	conf          *oauth2.Config
+	discovery     oidcDiscovery
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	AuthorizedParty   string   `json:"azp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+type oidcUserinfo struct {
+	Sub               string   `json:"sub"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// flexBool accepts both true and "true", some providers send email_verified as a string
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean %s", data)
+	}
+	return nil
+}
+
+// newOIDCProvider returns the registry entry of an OpenID Connect provider
+func newOIDCProvider(settings oidcSettings) *oauthProvider {
+	client := &oidcClient{settings: settings}
+	return &oauthProvider{
+		Name:         settings.Name,
+		DisplayName:  settings.DisplayName,
+		LoginPath:    settings.LoginPath,
+		CallbackPath: settings.CallbackPath,
+		UsesIDToken:  true,
+		config:       client.config,
+		identify:     client.identify,
+	}
+}
+
+// newConfiguredOIDCProvider returns the entry of a provider listed in OIDC_PROVIDERS. For
+// name "keycloak" it reads OIDC_KEYCLOAK_ISSUER, OIDC_KEYCLOAK_CLIENT_ID,
+// OIDC_KEYCLOAK_CLIENT_SECRET and optionally OIDC_KEYCLOAK_SCOPES and OIDC_KEYCLOAK_DISPLAY_NAME.
+func newConfiguredOIDCProvider(name string) *oauthProvider {
+	prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	displayName, err := config.GetVariableAsString(prefix + "DISPLAY_NAME")
+	if err != nil {
+		displayName = name
+	}
+	return newOIDCProvider(oidcSettings{
+		Name:            models.AuthProvider(name),
+		DisplayName:     displayName,
+		LoginPath:       oidcLoginPath(name),
+		CallbackPath:    oidcCallbackPath(name),
+		IssuerVar:       prefix + "ISSUER",
+		ClientIDVar:     prefix + "CLIENT_ID",
+		ClientSecretVar: prefix + "CLIENT_SECRET",
+		ScopesVar:       prefix + "SCOPES",
+	})
+}
+
+func (o *oidcClient) config() (*oauth2.Config, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conf != nil {
+		return o.conf, nil
+	}
+
+	s := o.settings
+	issuer, err := config.GetVariableAsString(s.IssuerVar)
+	if err != nil {
+		if s.DefaultIssuer == "" {
+			return nil, err
+		}
+		issuer = s.DefaultIssuer
+	}
+	clientID, err := config.GetVariableAsString(s.ClientIDVar)
+	if err != nil {
+		return nil, err
+	}
+	clientSecret, err := config.GetVariableAsString(s.ClientSecretVar)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery, err := discoverOIDC(context.Background(), issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovery of %s failed: %w", issuer, err)
+	}
+
+	o.discovery = discovery
+	o.conf = &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       o.scopes(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+		// Build redirect URL from shared path constant
+		RedirectURL: computeRedirectURL(s.CallbackPath),
+	}
+	return o.conf, nil
+}
+
+// scopes returns the configured scopes, openid is always requested
+func (o *oidcClient) scopes() []string {
+	if o.settings.ScopesVar == "" {
+		return defaultOIDCScopes
+	}
+	value, err := config.GetVariableAsString(o.settings.ScopesVar)
+	if err != nil {
+		return defaultOIDCScopes
+	}
+	scopes := strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	if !slices.Contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	return scopes
+}
+
+// identify verifies the ID token of the token response, it must carry the nonce sent with
+// the authorization request. When the ID token has no email, the userinfo endpoint is
+// asked, as some providers only put the email there.
+func (o *oidcClient) identify(ctx context.Context, conf *oauth2.Config, token *oauth2.Token, nonce string) (oauthIdentity, error) {
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return oauthIdentity{}, fmt.Errorf("%w: missing ID token", errInvalidIDToken)
+	}
+	claims, err := o.verifyIDToken(ctx, rawIDToken, conf.ClientID)
+	if err != nil {
+		return oauthIdentity{}, fmt.Errorf("%w: %v", errInvalidIDToken, err)
+	}
+	// The nonce ties the ID token to this login, a token from another login cannot be replayed
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return oauthIdentity{}, fmt.Errorf("%w: nonce mismatch", errInvalidIDToken)
+	}
+
+	ident := oauthIdentity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.Email != "" && bool(claims.EmailVerified),
+		Nicknames:     []string{claims.Name, claims.PreferredUsername},
+	}
+
+	o.mu.Lock()
+	userinfoURL := o.discovery.UserinfoEndpoint
+	o.mu.Unlock()
+	if ident.Email == "" && userinfoURL != "" {
+		info, err := fetchOIDCUserinfo(ctx, userinfoURL, token.AccessToken)
+		if err != nil {
+			return oauthIdentity{}, err
+		}
+		// The userinfo response is only about our user when the subjects match
+		if info.Sub != claims.Subject {
+			return oauthIdentity{}, fmt.Errorf("%w: userinfo does not match ID token", errInvalidIDToken)
+		}
+		ident.Email = info.Email
+		ident.EmailVerified = info.Email != "" && bool(info.EmailVerified)
+		ident.Nicknames = append(ident.Nicknames, info.Name, info.PreferredUsername)
+	}
+	return ident, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience and lifetime of an ID token
+func (o *oidcClient) verifyIDToken(ctx context.Context, rawIDToken, clientID string) (*oidcClaims, error) {
+	claims := &oidcClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return o.verificationKey(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcIDTokenMethods),
+		jwt.WithAudience(clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	issuers := append([]string{o.discovery.Issuer}, o.settings.ExtraIssuers...)
+	o.mu.Unlock()
+	if !slices.Contains(issuers, claims.Issuer) {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	// A token for several audiences has to name us as the party it was issued to
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != clientID {
+		return nil, fmt.Errorf("unexpected authorized party %q", claims.AuthorizedParty)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	return claims, nil
+}
+
+// verificationKey returns the issuer key kid, the JWKS is refetched when kid is unknown
+// (the issuer rotated its keys) but not more often than oidcJWKSRefreshInterval
+func (o *oidcClient) verificationKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := pickOIDCKey(o.keys, kid); ok {
+		return key, nil
+	}
+	if o.keys != nil && time.Since(o.keysFetchedAt) < oidcJWKSRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	keys, err := fetchOIDCKeys(ctx, o.discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	o.keys = keys
+	o.keysFetchedAt = time.Now()
+
+	if key, ok := pickOIDCKey(o.keys, kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// pickOIDCKey finds kid in keys, a token without kid can only use the single key of a JWKS
+func pickOIDCKey(keys map[string]crypto.PublicKey, kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// discoverOIDC reads the OpenID Provider metadata of issuer
+func discoverOIDC(ctx context.Context, issuer string) (oidcDiscovery, error) {
+	var discovery oidcDiscovery
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getOIDCJSON(ctx, wellKnown, "", &discovery); err != nil {
+		return oidcDiscovery{}, err
+	}
+	// The metadata must be about the issuer we asked for, otherwise any token it vouches
+	// for could claim another issuer
+	if discovery.Issuer != issuer {
+		return oidcDiscovery{}, fmt.Errorf("issuer mismatch: %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return oidcDiscovery{}, fmt.Errorf("incomplete provider metadata")
+	}
+	return discovery, nil
+}
+
+// fetchOIDCKeys downloads a JWKS and decodes its signing keys, keys it cannot use are skipped
+func fetchOIDCKeys(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getOIDCJSON(ctx, jwksURL, "", &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in %s", jwksURL)
+	}
+	return keys, nil
+}
+
+func fetchOIDCUserinfo(ctx context.Context, userinfoURL, accessToken string) (*oidcUserinfo, error) {
+	var info oidcUserinfo
+	if err := getOIDCJSON(ctx, userinfoURL, accessToken, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// getOIDCJSON fetches url, with accessToken as Bearer when set, and decodes the JSON response into v
+func getOIDCJSON(ctx context.Context, url, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
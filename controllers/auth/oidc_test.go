@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyOIDCIDToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	client := &oidcClient{
+		settings:      oidcSettings{ExtraIssuers: []string{"issuer.example.com"}},
+		discovery:     oidcDiscovery{Issuer: "https://issuer.example.com"},
+		keys:          map[string]crypto.PublicKey{"k1": &key.PublicKey},
+		keysFetchedAt: time.Now(), // an unknown kid must not trigger a fetch
+	}
+
+	sign := func(method jwt.SigningMethod, signKey any, kid string, change func(jwt.MapClaims)) string {
+		claims := jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"sub": "subject",
+			"aud": "client",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		if change != nil {
+			change(claims)
+		}
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(signKey)
+		require.NoError(t, err)
+		return signed
+	}
+	verify := func(raw string) error {
+		_, err := client.verifyIDToken(context.Background(), raw, "client")
+		return err
+	}
+
+	claims, err := client.verifyIDToken(context.Background(), sign(jwt.SigningMethodES256, key, "k1", nil), "client")
+	require.NoError(t, err)
+	assert.Equal(t, "subject", claims.Subject)
+
+	assert.NoError(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { c["iss"] = "issuer.example.com" })),
+		"Extra issuers should be accepted")
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" })))
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { c["aud"] = "other" })))
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() })))
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { delete(c, "exp") })))
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) { c["sub"] = "" })))
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k1", func(c jwt.MapClaims) {
+		c["aud"] = []string{"client", "other"}
+		c["azp"] = "other"
+	})), "A token for several audiences must be issued to us")
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, key, "k2", nil)), "Unknown kid")
+	assert.Error(t, verify(sign(jwt.SigningMethodHS256, []byte("secret"), "k1", nil)), "HMAC must not be accepted")
+
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Error(t, verify(sign(jwt.SigningMethodES256, other, "k1", nil)), "Signature of another key")
+}
+
+func TestJSONWebKeyPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwk := jsonWebKey{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+	}
+	pub, err := jwk.publicKey()
+	require.NoError(t, err)
+	assert.True(t, key.PublicKey.Equal(pub))
+
+	_, err = jsonWebKey{Kty: "oct"}.publicKey()
+	assert.Error(t, err)
+}
+
+func TestFlexBool(t *testing.T) {
+	var v struct {
+		A flexBool `json:"a"`
+		B flexBool `json:"b"`
+		C flexBool `json:"c"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"a":true,"b":"true","c":"false"}`), &v))
+	assert.True(t, bool(v.A))
+	assert.True(t, bool(v.B))
+	assert.False(t, bool(v.C))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"a":"yes"}`), &v))
+}
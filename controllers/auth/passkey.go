@@ -0,0 +1,555 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+	"personal_site/webauthn"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// amrPasskey is the amr of a passkey login. Passkeys are always user verified, so the
+	// login also counts as MFA.
+	amrPasskey = "hwk"
+
+	passkeyCeremonyTimeout = 5 * time.Minute
+	defaultPasskeyName     = "Passkey"
+	maxPasskeyNameLength   = 64
+)
+
+var errInvalidPasskeyName = errors.New("name must be at most 64 characters")
+
+type passkeyCreateBeginRequest struct {
+	Email    string `json:"email" binding:"omitempty,email"`
+	Nickname string `json:"nickname"`
+}
+
+type passkeyCreateFinishRequest struct {
+	ChallengeToken string                        `json:"challenge_token" binding:"required"`
+	Name           string                        `json:"name"`
+	Credential     webauthn.RegistrationResponse `json:"credential"`
+}
+
+type passkeyLoginFinishRequest struct {
+	ChallengeToken string                     `json:"challenge_token" binding:"required"`
+	Credential     webauthn.AssertionResponse `json:"credential"`
+}
+
+type renamePasskeyRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type passkeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	BackedUp   bool       `json:"backed_up"`
+	Transports []string   `json:"transports"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func newPasskeyResponse(cred models.WebAuthnCredential) passkeyResponse {
+	return passkeyResponse{
+		ID:         cred.ID,
+		Name:       cred.Name,
+		BackedUp:   cred.BackedUp,
+		Transports: strings.Fields(cred.Transports),
+		CreatedAt:  cred.CreatedAt,
+		LastUsedAt: cred.LastUsedAt,
+	}
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create. A logged in
+// user adds a passkey to the account, anyone else signs up with email and nickname and gets
+// an account without password.
+func BeginPasskeyRegistration(c *gin.Context, db *gorm.DB) {
+	cfg, err := webauthnConfig()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Passkeys not configured", "details": err.Error()})
+		return
+	}
+
+	data := map[string]string{}
+	var wUser webauthn.User
+	var exclude []webauthn.CredentialDescriptor
+	userID := utils.GetUserID(c)
+	if userID != 0 {
+		if rejectGuest(c, db) {
+			return
+		}
+		user, ok := currentUser(c, db)
+		if !ok {
+			return
+		}
+		var creds []models.WebAuthnCredential
+		if err := db.Where("user_id = ?", user.ID).Find(&creds).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+			return
+		}
+		handle, err := passkeyUserHandle(creds)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to start registration", "details": err.Error()})
+			return
+		}
+		for _, cred := range creds {
+			id, _ := base64.RawURLEncoding.DecodeString(cred.CredentialID)
+			exclude = append(exclude, webauthn.CredentialDescriptor{Type: "public-key", ID: id, Transports: strings.Fields(cred.Transports)})
+		}
+		wUser = webauthn.User{ID: handle, Name: user.Email, DisplayName: user.Nickname}
+	} else {
+		var req passkeyCreateBeginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Email == "" {
+			c.JSON(400, gin.H{"error": "Email and nickname are required to sign up"})
+			return
+		}
+		nickname, err := normalizeNickname(req.Nickname)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid nickname", "details": err.Error()})
+			return
+		}
+		// A known email logs in first and adds the passkey, instead of getting a second account.
+		// Only verified emails count, anyone can sign up with an address that is not theirs.
+		var count int64
+		if err := db.Unscoped().Model(&models.User{}).Where("email = ? AND email_verified_at IS NOT NULL", req.Email).Count(&count).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+			return
+		}
+		if count > 0 {
+			c.JSON(409, gin.H{"error": "Email already registered, log in to add a passkey"})
+			return
+		}
+		handle, err := passkeyUserHandle(nil)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to start registration", "details": err.Error()})
+			return
+		}
+		wUser = webauthn.User{ID: handle, Name: req.Email, DisplayName: nickname}
+		data["email"] = req.Email
+		data["nickname"] = nickname
+	}
+
+	challenge, err := newPasskeyChallenge()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start registration", "details": err.Error()})
+		return
+	}
+	data["challenge"] = base64.RawURLEncoding.EncodeToString(challenge)
+	data["user_handle"] = base64.RawURLEncoding.EncodeToString(wUser.ID)
+	token, err := generatePurposeToken(purposePasskeyCreate, userID, passkeyCeremonyTimeout, data)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start registration", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"options": cfg.NewCreationOptions(wUser, challenge, exclude), "challenge_token": token})
+}
+
+// FinishPasskeyRegistration verifies the new credential. A sign up creates the user and logs
+// in, a logged in user gets the passkey added to the account.
+func FinishPasskeyRegistration(c *gin.Context, db *gorm.DB) {
+	var req passkeyCreateFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := normalizePasskeyName(req.Name)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid name", "details": err.Error()})
+		return
+	}
+	cfg, err := webauthnConfig()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Passkeys not configured", "details": err.Error()})
+		return
+	}
+
+	claims, challenge, ok := openPasskeyChallenge(c, db, req.ChallengeToken, purposePasskeyCreate)
+	if !ok {
+		return
+	}
+	// The account that started the ceremony must also finish it
+	if claims.UserID() != utils.GetUserID(c) {
+		c.JSON(403, gin.H{"error": "Registration was started by another user"})
+		return
+	}
+
+	verified, err := cfg.VerifyRegistration(challenge, req.Credential)
+	if err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionPasskeyAdd, Outcome: audit.OutcomeFailure, TargetUserID: claims.UserID(), Details: map[string]any{"reason": err.Error()}})
+		c.JSON(400, gin.H{"error": "Invalid passkey", "details": err.Error()})
+		return
+	}
+	handle, _ := base64.RawURLEncoding.DecodeString(claims.Data["user_handle"])
+	cred := models.WebAuthnCredential{
+		Name:             name,
+		CredentialID:     base64.RawURLEncoding.EncodeToString(verified.ID),
+		CredentialIDHash: passkeyIDHash(verified.ID),
+		UserHandle:       handle,
+		PublicKey:        verified.PublicKey,
+		SignCount:        verified.SignCount,
+		AAGUID:           formatAAGUID(verified.AAGUID),
+		Transports:       strings.Join(req.Credential.Response.Transports, " "),
+		BackupEligible:   verified.Flags&webauthn.FlagBackupEligible != 0,
+		BackedUp:         verified.Flags&webauthn.FlagBackedUp != 0,
+	}
+	if len(cred.Transports) > 128 {
+		cred.Transports = ""
+	}
+
+	if claims.UserID() != 0 {
+		cred.UserID = claims.UserID()
+		if err := db.Create(&cred).Error; err != nil {
+			abortPasskeyCreate(c, db, err)
+			return
+		}
+		audit.Record(db, c, audit.Entry{Action: audit.ActionPasskeyAdd, TargetUserID: cred.UserID, Details: map[string]any{"passkey_id": cred.ID}})
+		c.JSON(200, gin.H{"message": "Passkey added", "passkey": newPasskeyResponse(cred)})
+		return
+	}
+
+	user := models.User{
+		Nickname:   claims.Data["nickname"],
+		Role:       models.RoleUser,
+		Provider:   models.AuthProviderPasskey,
+		Email:      claims.Data["email"],
+		Identifier: claims.Data["user_handle"],
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := releaseUnverifiedEmail(tx, user.Provider, user.Email); err != nil {
+			return err
+		}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		cred.UserID = user.ID
+		return tx.Create(&cred).Error
+	})
+	if err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, Outcome: audit.OutcomeFailure, Details: map[string]any{"email": user.Email, "provider": user.Provider}})
+		abortPasskeyCreate(c, db, err)
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionRegister, ActorID: user.ID, TargetUserID: user.ID, Details: map[string]any{"provider": user.Provider}})
+
+	if err := sendVerificationEmail(user); err != nil {
+		log.Println("[FinishPasskeyRegistration] send verification email error:", err, "user:", user.ID)
+	}
+	finishLogin(c, db, user, false, amrPasskey, amrMFA)
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get. Passkeys are
+// discoverable, so the browser offers the passkeys it has and no email is needed.
+func BeginPasskeyLogin(c *gin.Context) {
+	cfg, err := webauthnConfig()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Passkeys not configured", "details": err.Error()})
+		return
+	}
+
+	challenge, err := newPasskeyChallenge()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start login", "details": err.Error()})
+		return
+	}
+	token, err := generatePurposeToken(purposePasskeyLogin, 0, passkeyCeremonyTimeout, map[string]string{
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+	})
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to start login", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"options": cfg.NewRequestOptions(challenge), "challenge_token": token})
+}
+
+// FinishPasskeyLogin verifies the assertion and logs in the owner of the passkey
+func FinishPasskeyLogin(c *gin.Context, db *gorm.DB) {
+	var req passkeyLoginFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	cfg, err := webauthnConfig()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Passkeys not configured", "details": err.Error()})
+		return
+	}
+
+	_, challenge, ok := openPasskeyChallenge(c, db, req.ChallengeToken, purposePasskeyLogin)
+	if !ok {
+		return
+	}
+
+	rawID := []byte(req.Credential.RawID)
+	if len(rawID) == 0 {
+		rawID, _ = base64.RawURLEncoding.DecodeString(req.Credential.ID)
+	}
+	var cred models.WebAuthnCredential
+	if err := db.Where("credential_id_hash = ?", passkeyIDHash(rawID)).First(&cred).Error; err != nil {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionLogin, Outcome: audit.OutcomeFailure, Details: map[string]any{"method": amrPasskey, "reason": "unknown passkey"}})
+		c.JSON(401, gin.H{"error": "Unknown passkey"})
+		return
+	}
+
+	userHandle := req.Credential.Response.UserHandle
+	verified, err := cfg.VerifyAssertion(challenge, req.Credential, cred.PublicKey, cred.SignCount)
+	if err == nil && len(userHandle) > 0 && string(userHandle) != string(cred.UserHandle) {
+		err = errors.New("user handle does not match the passkey")
+	}
+	if err != nil {
+		if errors.Is(err, webauthn.ErrSignCountRegressed) {
+			log.Println("[FinishPasskeyLogin] possibly cloned passkey:", cred.ID, "user:", cred.UserID)
+		}
+		audit.Record(db, c, audit.Entry{Action: audit.ActionLogin, Outcome: audit.OutcomeFailure, TargetUserID: cred.UserID, Details: map[string]any{"method": amrPasskey, "reason": err.Error()}})
+		c.JSON(401, gin.H{"error": "Invalid passkey", "details": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	if err := db.Model(&cred).Updates(map[string]any{
+		"sign_count":   verified.SignCount,
+		"backed_up":    verified.Flags&webauthn.FlagBackedUp != 0,
+		"last_used_at": &now,
+	}).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	// Unscoped, so a deleted user is refused instead of looking like an unknown passkey
+	var user models.User
+	if err := db.Unscoped().Limit(1).Find(&user, cred.UserID).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	finishLogin(c, db, user, false, amrPasskey, amrMFA)
+}
+
+// ListPasskeys lists the passkeys of the logged in user
+func ListPasskeys(c *gin.Context, db *gorm.DB) {
+	var creds []models.WebAuthnCredential
+	if err := db.Where("user_id = ?", utils.GetUserID(c)).Order("id").Find(&creds).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	resp := make([]passkeyResponse, 0, len(creds))
+	for _, cred := range creds {
+		resp = append(resp, newPasskeyResponse(cred))
+	}
+	c.JSON(200, gin.H{"passkeys": resp})
+}
+
+// RenamePasskey changes the name the user gave a passkey
+func RenamePasskey(c *gin.Context, db *gorm.DB) {
+	var req renamePasskeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	name, err := normalizePasskeyName(req.Name)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid name", "details": err.Error()})
+		return
+	}
+
+	cred, ok := findOwnPasskey(c, db)
+	if !ok {
+		return
+	}
+	if err := db.Model(&cred).Update("name", name).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to rename passkey", "details": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"message": "Passkey renamed", "passkey": newPasskeyResponse(cred)})
+}
+
+// DeletePasskey removes a passkey, the last way to log in cannot be removed
+func DeletePasskey(c *gin.Context, db *gorm.DB) {
+	cred, ok := findOwnPasskey(c, db)
+	if !ok {
+		return
+	}
+
+	methods, err := countLoginMethods(db, cred.UserID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	if methods <= 1 {
+		c.JSON(409, gin.H{"error": "Cannot remove the last login method"})
+		return
+	}
+
+	// Hard delete, so the authenticator can register the credential again
+	if err := db.Unscoped().Delete(&cred).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete passkey", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionPasskeyRemove, TargetUserID: cred.UserID, Details: map[string]any{"passkey_id": cred.ID}})
+
+	c.JSON(200, gin.H{"message": "Passkey deleted", "id": cred.ID})
+}
+
+// findOwnPasskey loads the passkey of the :id parameter if it belongs to the logged in user
+func findOwnPasskey(c *gin.Context, db *gorm.DB) (models.WebAuthnCredential, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid id"})
+		return models.WebAuthnCredential{}, false
+	}
+
+	var cred models.WebAuthnCredential
+	if err := db.Where("id = ? AND user_id = ?", id, utils.GetUserID(c)).First(&cred).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Passkey not found"})
+		return models.WebAuthnCredential{}, false
+	}
+	return cred, true
+}
+
+// openPasskeyChallenge validates and consumes the challenge token of a ceremony, it answers
+// the request when that fails
+func openPasskeyChallenge(c *gin.Context, db *gorm.DB, token, purpose string) (*purposeClaims, []byte, bool) {
+	claims, err := validatePurposeToken(token, purpose)
+	if err == nil {
+		err = consumePurposeToken(db, claims)
+	}
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid or expired challenge"})
+		return nil, nil, false
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(claims.Data["challenge"])
+	if err != nil || len(challenge) == 0 {
+		c.JSON(400, gin.H{"error": "Invalid or expired challenge"})
+		return nil, nil, false
+	}
+	return claims, challenge, true
+}
+
+// releaseUnverifiedEmail replaces email on the account of provider that never verified it,
+// so an address typed in by someone else does not keep its owner from signing up. The
+// account keeps working with its passkeys, its verification link stops working.
+func releaseUnverifiedEmail(tx *gorm.DB, provider models.AuthProvider, email string) error {
+	var squatter models.User
+	err := tx.Unscoped().Where("provider = ? AND email = ? AND email_verified_at IS NULL", provider, email).Limit(1).Find(&squatter).Error
+	if err != nil || squatter.ID == 0 {
+		return err
+	}
+	placeholder := fmt.Sprintf("unverified-%d@%s.invalid", squatter.ID, provider)
+	return tx.Model(&models.User{}).Where("id = ?", squatter.ID).UpdateColumn("email", placeholder).Error
+}
+
+// abortPasskeyCreate answers a registration whose rows could not be stored
+func abortPasskeyCreate(c *gin.Context, db *gorm.DB, err error) {
+	if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(strings.ToLower(err.Error()), "unique") {
+		c.JSON(409, gin.H{"error": "Passkey or email already registered"})
+		return
+	}
+	c.JSON(500, gin.H{"error": "Failed to save passkey", "details": err.Error()})
+}
+
+// webauthnConfig is the relying party: WEBAUTHN_RP_ID defaults to the host of
+// PUBLIC_BASE_URL and WEBAUTHN_ORIGINS to CORS_ALLOWED_ORIGINS
+func webauthnConfig() (webauthn.Config, error) {
+	rpID, err := config.GetVariableAsString("WEBAUTHN_RP_ID")
+	if err != nil {
+		base, err := config.GetVariableAsString("PUBLIC_BASE_URL")
+		if err != nil {
+			return webauthn.Config{}, errors.New("WEBAUTHN_RP_ID or PUBLIC_BASE_URL is required")
+		}
+		u, err := url.Parse(base)
+		if err != nil || u.Hostname() == "" {
+			return webauthn.Config{}, errors.New("PUBLIC_BASE_URL has no host")
+		}
+		rpID = u.Hostname()
+	}
+
+	origins, err := config.GetVariableAsString("WEBAUTHN_ORIGINS")
+	if err != nil {
+		origins, err = config.GetVariableAsString("CORS_ALLOWED_ORIGINS")
+		if err != nil {
+			return webauthn.Config{}, errors.New("WEBAUTHN_ORIGINS or CORS_ALLOWED_ORIGINS is required")
+		}
+	}
+
+	rpName, err := config.GetVariableAsString("WEBAUTHN_RP_NAME")
+	if err != nil {
+		rpName = "personal_site"
+	}
+
+	cfg := webauthn.Config{
+		RPID:    rpID,
+		RPName:  rpName,
+		Timeout: int(passkeyCeremonyTimeout.Milliseconds()),
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			cfg.Origins = append(cfg.Origins, origin)
+		}
+	}
+	return cfg, nil
+}
+
+// passkeyUserHandle returns the user handle the passkeys of a user share, a random one for
+// the first passkey
+func passkeyUserHandle(creds []models.WebAuthnCredential) ([]byte, error) {
+	for _, cred := range creds {
+		if len(cred.UserHandle) > 0 {
+			return cred.UserHandle, nil
+		}
+	}
+	return newPasskeyChallenge()
+}
+
+func newPasskeyChallenge() ([]byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func passkeyIDHash(id []byte) string {
+	sum := sha256.Sum256(id)
+	return hex.EncodeToString(sum[:])
+}
+
+// formatAAGUID formats the authenticator model id like a UUID
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	h := hex.EncodeToString(aaguid)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func normalizePasskeyName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return defaultPasskeyName, nil
+	}
+	if utf8.RuneCountInString(name) > maxPasskeyNameLength {
+		return "", errInvalidPasskeyName
+	}
+	return name, nil
+}
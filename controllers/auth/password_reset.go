@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"personal_site/apipaths"
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/mailer"
+	"personal_site/models"
+	"personal_site/password"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+var errInvalidResetToken = errors.New("invalid or expired reset token")
+
+// ForgotPassword emails a reset link to a password account. The response is the same
+// whether or not the email exists, and the email is sent in the background so the
+// response time does not tell either. Requests are limited per email and IP address.
+func ForgotPassword(c *gin.Context, db *gorm.DB) {
+	var req forgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if !allowEmailRequest(c, req.Email) {
+		return
+	}
+
+	var user models.User
+	err := db.Where("provider = ? AND email = ?", models.AuthProviderPassword, req.Email).Limit(1).Find(&user).Error
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	audit.Record(db, c, audit.Entry{Action: audit.ActionPasswordResetRequest, TargetUserID: user.ID, Details: map[string]any{"email": req.Email}})
+	if user.ID != 0 {
+		go func() {
+			if err := sendPasswordResetEmail(db, user); err != nil {
+				log.Println("[ForgotPassword] send reset email error:", err, "user:", user.ID)
+			}
+		}()
+	}
+
+	c.JSON(200, gin.H{"message": "If the email is registered, a password reset link has been sent"})
+}
+
+// ResetPassword sets a new password with a reset token and logs the user out everywhere
+func ResetPassword(c *gin.Context, db *gorm.DB) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var resetToken models.PasswordResetToken
+		if err := tx.Where("token_hash = ?", hashToken(req.Token)).Limit(1).Find(&resetToken).Error; err != nil {
+			return err
+		}
+		if resetToken.ID == 0 || resetToken.UsedAt != nil || time.Now().After(resetToken.ExpiresAt) {
+			return errInvalidResetToken
+		}
+
+		// Mark it used first, only one concurrent request can win
+		now := time.Now()
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", resetToken.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidResetToken
+		}
+
+		if err := tx.First(&user, resetToken.UserID).Error; err != nil {
+			return errInvalidResetToken
+		}
+		if user.Provider != models.AuthProviderPassword {
+			return errInvalidResetToken
+		}
+
+		// A rejected password rolls back, the token can be used again with another one
+		err := password.FromConfig().Check(req.NewPassword, password.User{Email: user.Email, Nickname: user.Nickname})
+		if err != nil {
+			return err
+		}
+		hashedPassword, err := hashPassword(req.NewPassword)
+		if err != nil {
+			return err
+		}
+
+		// Receiving the email also proves the user owns the address
+		updates := map[string]any{"identifier": hashedPassword}
+		if !user.IsEmailVerified() {
+			updates["email_verified_at"] = now
+		}
+		return tx.Model(&user).Updates(updates).Error
+	})
+	if errors.Is(err, errInvalidResetToken) {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionPasswordReset, Outcome: audit.OutcomeFailure})
+		c.JSON(400, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+	var policyErr *password.PolicyError
+	if errors.As(err, &policyErr) {
+		respondPasswordPolicyError(c, policyErr)
+		return
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to reset password", "details": err.Error()})
+		return
+	}
+
+	audit.Record(db, c, audit.Entry{Action: audit.ActionPasswordReset, TargetUserID: user.ID})
+
+	// Whoever knew the old password must not stay logged in
+	if err := RevokeAllUserTokens(db, user.ID, revokeReasonPasswordReset); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to revoke sessions", "details": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Password has been reset, please log in again"})
+}
+
+// sendPasswordResetEmail replaces any unused reset token of the user with a new one and mails it
+func sendPasswordResetEmail(db *gorm.DB, user models.User) error {
+	token, err := randomToken(32)
+	if err != nil {
+		return err
+	}
+
+	ttl := getPasswordResetTokenExpiration()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    user.ID,
+			TokenHash: hashToken(token),
+			ExpiresAt: time.Now().Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. Open the link below to choose a new password:\n\n%s\n\n"+
+			"The link expires in %s and can only be used once. If it was not you, you can ignore this email.\n",
+			user.Nickname, passwordResetLink(token), ttl),
+	})
+}
+
+// passwordResetLink points at PASSWORD_RESET_URL (the frontend page) with the token as query parameter
+func passwordResetLink(token string) string {
+	base, err := config.GetVariableAsString("PASSWORD_RESET_URL")
+	if err != nil {
+		base = computeRedirectURL(apipaths.ResetPasswordPath)
+	}
+
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+func getPasswordResetTokenExpiration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("PASSWORD_RESET_TOKEN_EXPIRATION")
+	if err != nil {
+		exp = time.Hour // Default to 1 hour if not set
+	}
+	return exp
+}
@@ -0,0 +1,326 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/controllers/storage"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const maxNicknameLength = 64
+
+var errInvalidNickname = errors.New("nickname must be 1 to 64 characters, without slashes or control characters")
+
+type meResponse struct {
+	ID            uint                `json:"id"`
+	Email         string              `json:"email"`
+	Nickname      string              `json:"nickname"`
+	Role          models.Role         `json:"role"`
+	Provider      models.AuthProvider `json:"provider"`
+	EmailVerified bool                `json:"email_verified"`
+	MFAEnabled    bool                `json:"mfa_enabled"`
+	CreatedAt     time.Time           `json:"created_at"`
+	ExpiresAt     *time.Time          `json:"expires_at,omitempty"` // guests only
+}
+
+type updateMeRequest struct {
+	Nickname string `json:"nickname" binding:"required"`
+}
+
+type deleteMeRequest struct {
+	Password string `json:"password"`
+}
+
+// GetMe returns the logged in user as stored in the database, the token only carries a
+// snapshot of the nickname and role
+func GetMe(c *gin.Context, db *gorm.DB) {
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+
+	resp, err := newMeResponse(db, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// UpdateMe changes the nickname of the logged in user. The nickname is part of the access
+// token, so a new token is issued for the current session: as a cookie for cookie clients,
+// in the body for Bearer clients. Other sessions see the new nickname on their next refresh.
+func UpdateMe(c *gin.Context, db *gorm.DB) {
+	var req updateMeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	nickname, err := normalizeNickname(req.Nickname)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid nickname", "details": err.Error()})
+		return
+	}
+
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+
+	oldNickname := user.Nickname
+	if nickname != oldNickname {
+		// Storage paths contain the nickname, keep the files with the user
+		if err := storage.RenameUserFolder(user.ID, oldNickname, nickname); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to move the storage folder", "details": err.Error()})
+			return
+		}
+		if err := db.Model(&user).Update("nickname", nickname).Error; err != nil {
+			if err := storage.RenameUserFolder(user.ID, nickname, oldNickname); err != nil {
+				log.Println("[UpdateMe] restore storage folder error:", err, "user:", user.ID)
+			}
+			c.JSON(500, gin.H{"error": "Failed to update profile", "details": err.Error()})
+			return
+		}
+		audit.Record(db, c, audit.Entry{
+			Action:       audit.ActionProfileUpdate,
+			TargetUserID: user.ID,
+			Details:      map[string]any{"old_nickname": oldNickname, "nickname": nickname},
+		})
+
+		// Tokens of the other sessions carry the old nickname until they are refreshed
+		if err := BumpTokenVersion(db, user.ID); err != nil {
+			c.JSON(500, gin.H{"error": "Failed to update profile", "details": err.Error()})
+			return
+		}
+		user.TokenVersion++
+	}
+
+	accessToken, claims, err := reissueAccessToken(c, db, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token", "details": err.Error()})
+		return
+	}
+
+	resp, err := newMeResponse(db, user)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+	respondWithReissuedToken(c, gin.H{"message": "Profile updated", "user": resp}, accessToken, claims)
+}
+
+// DeleteMe deletes the account of the logged in user together with the reurls, linked
+// accounts, API keys, MFA credentials and stored files of the user. Password accounts
+// confirm with their password, accounts without one with a recent login, so a stolen
+// access token cannot delete the account.
+func DeleteMe(c *gin.Context, db *gorm.DB) {
+	var req deleteMeRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	user, ok := currentUser(c, db)
+	if !ok {
+		return
+	}
+
+	switch {
+	case user.IsGuest():
+		// A guest cannot log in again, its session is the only proof it has
+	case user.Provider != models.AuthProviderPassword:
+		if !requireRecentLogin(c, db, user) {
+			return
+		}
+	default:
+		if req.Password == "" {
+			c.JSON(400, gin.H{"error": "Password is required"})
+			return
+		}
+		if !allowPasswordAttempt(c, user.Email) {
+			return
+		}
+		if !checkPasswordHash(req.Password, user.Identifier) {
+			audit.Record(db, c, audit.Entry{Action: audit.ActionAccountDelete, Outcome: audit.OutcomeFailure, TargetUserID: user.ID})
+			passwordAttemptFailed(c, db, user.Email, user.ID)
+			c.JSON(401, gin.H{"error": "Invalid password"})
+			return
+		}
+	}
+
+	if err := deleteAccount(db, user); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to delete account", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionAccountDelete, TargetUserID: user.ID, Details: map[string]any{"email": user.Email}})
+
+	ForgetUserStatus(db, user.ID)
+	if err := RevokeAllUserTokens(db, user.ID, revokeReasonDeleted); err != nil {
+		log.Println("[DeleteMe] revoke tokens error:", err, "user:", user.ID)
+	}
+	// The rows are gone, leftover files are only logged
+	if err := storage.RemoveUserStorage(user.ID); err != nil {
+		log.Println("[DeleteMe] remove storage error:", err, "user:", user.ID)
+	}
+
+	clearSessionCookies(c)
+	c.JSON(200, gin.H{"message": "Account deleted", "user_id": user.ID})
+}
+
+// deleteAccount soft deletes user like an admin delete does, and removes what belongs to
+// the user for good. Reurls are hard deleted so their keys can be used again. The email and
+// identifier of the row are replaced first, so the address can sign up again.
+func deleteAccount(db *gorm.DB, user models.User) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		owned := []struct {
+			model any
+			where string
+		}{
+			{&models.Reurl{}, "owner_id = ?"},
+			{&models.Identity{}, "user_id = ?"},
+			{&models.APIKey{}, "user_id = ?"},
+			{&models.TOTPCredential{}, "user_id = ?"},
+			{&models.RecoveryCode{}, "user_id = ?"},
+			{&models.PasswordResetToken{}, "user_id = ?"},
+			{&models.WebAuthnCredential{}, "user_id = ?"},
+		}
+		for _, o := range owned {
+			if err := tx.Unscoped().Where(o.where, user.ID).Delete(o.model).Error; err != nil {
+				return err
+			}
+		}
+		err := tx.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumns(map[string]any{
+			"email":      fmt.Sprintf("deleted-%d@deleted.invalid", user.ID),
+			"identifier": "",
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&user).Error
+	})
+}
+
+// requireRecentLogin answers 403 and returns false unless the session of the request logged
+// user in within RECENT_LOGIN_MAX_AGE. Accounts without a password confirm destructive
+// actions by logging in again, with whatever method they have.
+func requireRecentLogin(c *gin.Context, db *gorm.DB, user models.User) bool {
+	var session models.Session
+	if sid := currentSessionID(c); sid != "" {
+		if err := db.Where("public_id = ? AND user_id = ?", sid, user.ID).Limit(1).Find(&session).Error; err != nil {
+			c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+			return false
+		}
+	}
+	if session.ID == 0 || !session.IsActive() || time.Since(session.CreatedAt) > getRecentLoginMaxAge() {
+		c.JSON(403, gin.H{"error": "Log in again to confirm", "reauth_required": true})
+		return false
+	}
+	return true
+}
+
+func getRecentLoginMaxAge() time.Duration {
+	maxAge, err := config.GetVariableAsTimeDuration("RECENT_LOGIN_MAX_AGE")
+	if err != nil {
+		return 10 * time.Minute // Default to 10 minutes if not set
+	}
+	return maxAge
+}
+
+// reissueAccessToken issues a token with the current profile of user for the session of
+// the request, keeping the authentication methods of the login
+func reissueAccessToken(c *gin.Context, db *gorm.DB, user models.User) (string, *schemas.TokenClaims, error) {
+	value, _ := c.Get("token_claims")
+	current, ok := value.(*schemas.TokenClaims)
+	if !ok {
+		return "", nil, errors.New("missing token claims")
+	}
+
+	claims := schemas.NewTokenClaims(user.ID)
+	claims.SessionID = current.SessionID
+	claims.AuthMethods = current.AuthMethods
+	claims.Payload = newTokenPayload(user)
+	token, err := signClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Admins revoke the session of a token by its jti
+	if claims.SessionID != "" {
+		if err := db.Model(&models.Session{}).Where("public_id = ?", claims.SessionID).Update("token_id", claims.ID).Error; err != nil {
+			return "", nil, err
+		}
+	}
+	return token, claims, nil
+}
+
+// respondWithReissuedToken answers with body and the reissued access token, delivered like
+// the token of the request: in the body for Bearer clients, as cookie otherwise
+func respondWithReissuedToken(c *gin.Context, body gin.H, accessToken string, claims *schemas.TokenClaims) {
+	if source, _ := c.Get("auth_source"); source == TokenSourceBearer {
+		body["access_token"] = accessToken
+		body["token_type"] = "Bearer"
+		body["expires_in"] = int64(time.Until(claims.ExpiresAt.Time).Seconds())
+	} else {
+		setAuthCookie(c, accessToken)
+	}
+	c.JSON(200, body)
+}
+
+// currentUser loads the logged in user, it answers the request when that fails
+func currentUser(c *gin.Context, db *gorm.DB) (models.User, bool) {
+	var user models.User
+	if err := db.First(&user, utils.GetUserID(c)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(404, gin.H{"error": "User not found"})
+			return models.User{}, false
+		}
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return models.User{}, false
+	}
+	return user, true
+}
+
+func newMeResponse(db *gorm.DB, user models.User) (meResponse, error) {
+	mfaEnabled, err := hasConfirmedTOTP(db, user.ID)
+	if err != nil {
+		return meResponse{}, err
+	}
+	return meResponse{
+		ID:            user.ID,
+		Email:         user.Email,
+		Nickname:      user.Nickname,
+		Role:          user.Role,
+		Provider:      user.Provider,
+		EmailVerified: user.IsEmailVerified(),
+		MFAEnabled:    mfaEnabled,
+		CreatedAt:     user.CreatedAt,
+		ExpiresAt:     user.ExpiresAt,
+	}, nil
+}
+
+// normalizeNickname trims nickname and checks it can be a storage folder name
+func normalizeNickname(nickname string) (string, error) {
+	nickname = strings.TrimSpace(nickname)
+	if nickname == "" || nickname == "." || nickname == ".." || utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return "", errInvalidNickname
+	}
+	if strings.ContainsAny(nickname, `/\`) || strings.ContainsFunc(nickname, unicode.IsControl) {
+		return "", errInvalidNickname
+	}
+	return nickname, nil
+}
@@ -0,0 +1,22 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeNickname(t *testing.T) {
+	nickname, err := normalizeNickname("  夢 user ")
+	assert.NoError(t, err)
+	assert.Equal(t, "夢 user", nickname)
+
+	_, err = normalizeNickname(strings.Repeat("夢", maxNicknameLength))
+	assert.NoError(t, err, "The limit counts characters, not bytes")
+
+	for _, invalid := range []string{"", " ", ".", "..", "a/b", `a\b`, "a\nb", strings.Repeat("a", maxNicknameLength+1)} {
+		_, err := normalizeNickname(invalid)
+		assert.ErrorIs(t, err, errInvalidNickname, invalid)
+	}
+}
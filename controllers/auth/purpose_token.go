@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Purposes of short-lived tokens, the purpose is used as the audience of the token
+const (
+	purposeMFAPending    = "mfa-pending"
+	purposeVerifyEmail   = "verify-email"
+	purposeLinkIntent    = "link-intent"  // the logged in user started linking a provider
+	purposeLinkPending   = "link-pending" // a provider login matched the verified email of a user
+	purposePasskeyCreate = "passkey-create"
+	purposePasskeyLogin  = "passkey-login"
+	purposeMagicLink     = "magic-link"
+	purposeGuestMerge    = "guest-merge" // the guest agreed to move its data to the account it logs in to
+)
+
+var errPurposeTokenUsed = errors.New("token was already used")
+
+// purposeClaims are short-lived tokens that only allow one specific step, e.g. finishing
+// an MFA login. Their audience is the purpose, so they are never accepted as access tokens.
+type purposeClaims struct {
+	jwt.RegisteredClaims
+	Purpose string            `json:"purpose"`
+	Data    map[string]string `json:"data,omitempty"` // extra values bound to the token, e.g. the email to verify
+}
+
+// UserID returns the subject of the token as a user id
+func (p *purposeClaims) UserID() uint {
+	id, err := strconv.ParseUint(p.Subject, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+// generatePurposeToken signs a token for userID that is only valid for purpose during ttl
+func generatePurposeToken(purpose string, userID uint, ttl time.Duration, data map[string]string) (string, error) {
+	now := time.Now()
+	claims := &purposeClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    schemas.TokenIssuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			Audience:  []string{purpose},
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        uuid.NewString(),
+		},
+		Purpose: purpose,
+		Data:    data,
+	}
+	return signClaims(claims)
+}
+
+// validatePurposeToken verifies tokenString and makes sure it was issued for purpose
+func validatePurposeToken(tokenString, purpose string) (*purposeClaims, error) {
+	token, err := parseToken(tokenString, &purposeClaims{}, jwt.WithAudience(purpose))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*purposeClaims)
+	if !ok || claims.Purpose != purpose {
+		return nil, fmt.Errorf("token is not valid for %s", purpose)
+	}
+	return claims, nil
+}
+
+// consumePurposeToken makes a single-use token unusable, it fails when the token was
+// consumed before. The jti is kept on the revocation list until the token expires.
+func consumePurposeToken(db *gorm.DB, claims *purposeClaims) error {
+	used := models.RevokedToken{
+		TokenID:   claims.ID,
+		UserID:    claims.UserID(),
+		ExpiresAt: claims.ExpiresAt.Time,
+		Reason:    "used:" + claims.Purpose,
+	}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&used)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errPurposeTokenUsed
+	}
+
+	cache := getRevocationCache(db)
+	cache.mu.Lock()
+	cache.tokens[claims.ID] = cachedTokenRevocation{revoked: true, fetchedAt: time.Now()}
+	cache.mu.Unlock()
+	return nil
+}
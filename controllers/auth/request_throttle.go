@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"personal_site/attempts"
+
+	"github.com/gin-gonic/gin"
+)
+
+// allowCountedRequest counts a request against targets in the attempts store and aborts with
+// 429 and message when one of them reached its limit within window. Refused requests are
+// not counted, so the limit ends one window after the last allowed request.
+func allowCountedRequest(c *gin.Context, targets []throttleTarget, window time.Duration, message string) bool {
+	now := time.Now()
+
+	var until time.Time
+	for _, target := range targets {
+		record, err := attempts.Default().Get(throttleKey(target.kind, target.subject))
+		if err != nil {
+			// Do not stop all requests when the store is down
+			log.Println("[RequestThrottle] get attempts error:", err)
+			continue
+		}
+		if record.Failures < target.maxFailures {
+			continue
+		}
+		if t := record.LastFailure.Add(window); t.After(until) {
+			until = t
+		}
+	}
+	if now.Before(until) {
+		retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(429, gin.H{"error": message, "retry_after": retryAfter})
+		return false
+	}
+
+	for _, target := range targets {
+		if _, err := attempts.Default().AddFailure(throttleKey(target.kind, target.subject), now, window); err != nil {
+			log.Println("[RequestThrottle] add attempt error:", err)
+		}
+	}
+	return true
+}
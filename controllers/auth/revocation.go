@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"personal_site/config"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// revocationCache keeps recent revocation lookups of tokens, sessions and users in memory
+// so the middlewares do not hit the database on every request. Revocations made by this
+// process are visible immediately, revocations made by other instances after the cache TTL.
+type revocationCache struct {
+	mu       sync.Mutex
+	db       *gorm.DB
+	tokens   map[string]cachedTokenRevocation
+	sessions map[string]cachedTokenRevocation // by session public id
+	users    map[uint]cachedUserRevocation
+}
+
+type cachedTokenRevocation struct {
+	revoked   bool
+	fetchedAt time.Time
+}
+
+type cachedUserRevocation struct {
+	revokedBefore time.Time // zero when the user has no revocation
+	fetchedAt     time.Time
+}
+
+// maxCachedRevocations bounds the cache, stale entries are swept when it is reached
+const maxCachedRevocations = 10000
+
+var revocations = &revocationCache{}
+
+// getRevocationCache returns the cache for db, a new database (e.g. in tests) gets an empty cache
+func getRevocationCache(db *gorm.DB) *revocationCache {
+	revocations.mu.Lock()
+	defer revocations.mu.Unlock()
+	if revocations.db != db {
+		revocations.db = db
+		revocations.tokens = make(map[string]cachedTokenRevocation)
+		revocations.sessions = make(map[string]cachedTokenRevocation)
+		revocations.users = make(map[uint]cachedUserRevocation)
+	}
+	return revocations
+}
+
+func getRevocationCacheTTL() time.Duration {
+	ttl, err := config.GetVariableAsTimeDuration("REVOCATION_CACHE_TTL")
+	if err != nil {
+		return time.Minute // Default to 1 minute if not set
+	}
+	return ttl
+}
+
+// IsTokenRevoked reports whether the token was revoked by its jti, by the revocation of its
+// session or by a per-user revocation
+func IsTokenRevoked(db *gorm.DB, claims *schemas.TokenClaims) (bool, error) {
+	cache := getRevocationCache(db)
+	ttl := getRevocationCacheTTL()
+
+	revoked, err := cache.isTokenIDRevoked(claims.ID, ttl)
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	revoked, err = cache.isSessionRevoked(claims.SessionID, ttl)
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	revokedBefore, err := cache.userRevokedBefore(claims.Payload.UserID, ttl)
+	if err != nil {
+		return false, err
+	}
+	if revokedBefore.IsZero() || claims.IssuedAt == nil {
+		return false, nil
+	}
+	// Timestamps are truncated to milliseconds, a token from the same millisecond counts as revoked
+	return !claims.IssuedAt.Time.After(revokedBefore), nil
+}
+
+func (r *revocationCache) isTokenIDRevoked(tokenID string, ttl time.Duration) (bool, error) {
+	if tokenID == "" {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	entry, found := r.tokens[tokenID]
+	r.mu.Unlock()
+	if found && time.Since(entry.fetchedAt) < ttl {
+		return entry.revoked, nil
+	}
+
+	var count int64
+	if err := r.db.Model(&models.RevokedToken{}).Where("token_id = ?", tokenID).Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.sweep(ttl)
+	r.tokens[tokenID] = cachedTokenRevocation{revoked: count > 0, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	return count > 0, nil
+}
+
+// isSessionRevoked reports whether the session was revoked, a session that does not exist
+// anymore counts as revoked. Tokens without session (empty publicID) are not affected.
+func (r *revocationCache) isSessionRevoked(publicID string, ttl time.Duration) (bool, error) {
+	if publicID == "" {
+		return false, nil
+	}
+
+	r.mu.Lock()
+	entry, found := r.sessions[publicID]
+	r.mu.Unlock()
+	if found && time.Since(entry.fetchedAt) < ttl {
+		return entry.revoked, nil
+	}
+
+	var sessions []models.Session
+	if err := r.db.Select("id", "revoked_at").Where("public_id = ?", publicID).Limit(1).Find(&sessions).Error; err != nil {
+		return false, err
+	}
+	revoked := len(sessions) == 0 || sessions[0].RevokedAt != nil
+
+	r.mu.Lock()
+	r.sweep(ttl)
+	r.sessions[publicID] = cachedTokenRevocation{revoked: revoked, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	return revoked, nil
+}
+
+func (r *revocationCache) userRevokedBefore(userID uint, ttl time.Duration) (time.Time, error) {
+	if userID == 0 {
+		return time.Time{}, nil
+	}
+
+	r.mu.Lock()
+	entry, found := r.users[userID]
+	r.mu.Unlock()
+	if found && time.Since(entry.fetchedAt) < ttl {
+		return entry.revokedBefore, nil
+	}
+
+	// Find instead of First, a missing row is the normal case and should not be logged
+	var revocation models.UserTokenRevocation
+	if err := r.db.Where("user_id = ?", userID).Limit(1).Find(&revocation).Error; err != nil {
+		return time.Time{}, err
+	}
+
+	r.mu.Lock()
+	r.sweep(ttl)
+	r.users[userID] = cachedUserRevocation{revokedBefore: revocation.RevokedBefore, fetchedAt: time.Now()}
+	r.mu.Unlock()
+	return revocation.RevokedBefore, nil
+}
+
+// sweep drops stale entries once the cache is full, caller must hold r.mu
+func (r *revocationCache) sweep(ttl time.Duration) {
+	if len(r.tokens)+len(r.sessions)+len(r.users) < maxCachedRevocations {
+		return
+	}
+	for k, v := range r.tokens {
+		if time.Since(v.fetchedAt) >= ttl {
+			delete(r.tokens, k)
+		}
+	}
+	for k, v := range r.sessions {
+		if time.Since(v.fetchedAt) >= ttl {
+			delete(r.sessions, k)
+		}
+	}
+	for k, v := range r.users {
+		if time.Since(v.fetchedAt) >= ttl {
+			delete(r.users, k)
+		}
+	}
+}
+
+// RevokeToken adds a single token to the revocation list. expiresAt should be the
+// expiry of the token so the row can be pruned afterwards.
+func RevokeToken(db *gorm.DB, tokenID string, userID uint, expiresAt time.Time, reason string) error {
+	if tokenID == "" {
+		return errors.New("token id is required")
+	}
+
+	revoked := models.RevokedToken{
+		TokenID:   tokenID,
+		UserID:    userID,
+		ExpiresAt: expiresAt,
+		Reason:    reason,
+	}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&revoked).Error; err != nil {
+		return err
+	}
+
+	cache := getRevocationCache(db)
+	cache.mu.Lock()
+	cache.tokens[tokenID] = cachedTokenRevocation{revoked: true, fetchedAt: time.Now()}
+	cache.mu.Unlock()
+	return nil
+}
+
+// RevokeSession revokes a session: it cannot be refreshed anymore and every access token
+// of it is rejected right away, also by the cached checks of this instance
+func RevokeSession(db *gorm.DB, session *models.Session, reason string) error {
+	return revokeSession(db, session, reason)
+}
+
+// RevokeAllUserTokens rejects every token issued to the user until now and revokes all of
+// the user's sessions, which forces the user to log in again everywhere.
+func RevokeAllUserTokens(db *gorm.DB, userID uint, reason string) error {
+	// Tokens carry millisecond timestamps (see schemas), which is also what the database keeps
+	revokedBefore := time.Now().Truncate(time.Millisecond)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		revocation := models.UserTokenRevocation{UserID: userID, RevokedBefore: revokedBefore}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"revoked_before", "updated_at"}),
+		}).Create(&revocation).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&models.Session{}).
+			Where("user_id = ? AND revoked_at IS NULL", userID).
+			Updates(map[string]any{"revoked_at": time.Now(), "revoke_reason": reason}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	cache := getRevocationCache(db)
+	cache.mu.Lock()
+	cache.users[userID] = cachedUserRevocation{revokedBefore: revokedBefore, fetchedAt: time.Now()}
+	cache.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,496 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"personal_site/apipaths"
+	"personal_site/audit"
+	"personal_site/config"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const refreshCookieName = "refresh_token"
+
+// deliveryBody marks a pending login whose tokens go in the response body instead of cookies
+const deliveryBody = "body"
+
+// Reasons stored in models.Session.RevokeReason
+const (
+	revokeReasonLogout         = "logout"
+	revokeReasonRefreshReuse   = "refresh_token_reuse"
+	revokeReasonUserMissing    = "user_missing"
+	revokeReasonPasswordReset  = "password_reset"
+	revokeReasonDeleted        = "deleted"
+	revokeReasonSignedOut      = "signed_out" // ended from the session list of the user
+	revokeReasonPasswordChange = "password_change"
+	revokeReasonExpired        = "expired" // the guest account expired
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// Authentication methods (amr claim) recorded for a session
+const (
+	amrPassword = "pwd"
+	amrOAuth    = "oauth"
+	amrOTP      = "otp"
+	amrMFA      = "mfa"
+)
+
+// sessionTokens are the credentials of a session, sent as cookies or in the response body
+type sessionTokens struct {
+	AccessToken      string
+	AccessExpiresIn  time.Duration
+	RefreshToken     string
+	RefreshExpiresIn time.Duration
+}
+
+// tokenResponse is returned by the endpoints that deliver tokens in the body instead of cookies
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"` // seconds
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"` // seconds
+	UserID           uint   `json:"user_id"`
+	Message          string `json:"message"`
+	Role             string `json:"role"`
+	Nickname         string `json:"nickname"`
+}
+
+func newTokenResponse(tokens sessionTokens, user models.User, message string) tokenResponse {
+	return tokenResponse{
+		AccessToken:      tokens.AccessToken,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(tokens.AccessExpiresIn.Seconds()),
+		RefreshToken:     tokens.RefreshToken,
+		RefreshExpiresIn: int64(tokens.RefreshExpiresIn.Seconds()),
+		UserID:           user.ID,
+		Message:          message,
+		Role:             string(user.Role),
+		Nickname:         user.Nickname,
+	}
+}
+
+// startSession creates a new session for user, then sets the access and refresh token cookies.
+// authMethods are the amr values of this login and are kept across refreshes.
+func startSession(c *gin.Context, db *gorm.DB, user models.User, authMethods ...string) error {
+	tokens, err := createSession(c, db, user, authMethods...)
+	if err != nil {
+		return err
+	}
+
+	setAuthCookie(c, tokens.AccessToken)
+	setRefreshCookie(c, tokens.RefreshToken, tokens.RefreshExpiresIn)
+	return nil
+}
+
+// finishLogin starts a session and answers the login. With inBody the tokens are returned
+// in the response body for Bearer clients, otherwise they are set as cookies.
+func finishLogin(c *gin.Context, db *gorm.DB, user models.User, inBody bool, authMethods ...string) {
+	if inBody {
+		tokens, err := createSession(c, db, user, authMethods...)
+		auditLogin(c, db, user, err, map[string]any{"amr": authMethods})
+		if err != nil {
+			abortSessionStart(c, err)
+			return
+		}
+		c.JSON(200, newTokenResponse(tokens, user, "Login successful"))
+		return
+	}
+
+	err := startSession(c, db, user, authMethods...)
+	auditLogin(c, db, user, err, map[string]any{"amr": authMethods})
+	if err != nil {
+		abortSessionStart(c, err)
+		return
+	}
+	c.JSON(200, loginResponse{
+		UserID:   user.ID,
+		Message:  "Login successful",
+		Role:     string(user.Role),
+		Nickname: user.Nickname,
+	})
+}
+
+// auditLogin records a login whose session start ended with err
+func auditLogin(c *gin.Context, db *gorm.DB, user models.User, err error, details map[string]any) {
+	outcome := audit.OutcomeSuccess
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUserDisabled), errors.Is(err, ErrUserNotFound):
+		outcome = audit.OutcomeDenied
+	default:
+		outcome = audit.OutcomeFailure
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionLogin, Outcome: outcome, ActorID: user.ID, TargetUserID: user.ID, Details: details})
+}
+
+// abortSessionStart answers a login whose session could not be started
+func abortSessionStart(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrUserDisabled):
+		c.JSON(403, gin.H{"error": "Account is disabled"})
+	case errors.Is(err, ErrUserNotFound):
+		c.JSON(403, gin.H{"error": "Account has been deleted"})
+	default:
+		c.JSON(500, gin.H{"error": "Failed to start session", "details": err.Error()})
+	}
+}
+
+// createSession stores a new session for user and issues its first access and refresh token.
+// The device of the request is recorded with the session.
+// It fails with ErrUserDisabled or ErrUserNotFound for users that may not log in.
+func createSession(c *gin.Context, db *gorm.DB, user models.User, authMethods ...string) (sessionTokens, error) {
+	if err := userStatusError(user); err != nil {
+		return sessionTokens{}, err
+	}
+
+	refreshExp := getRefreshTokenExpiration()
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:           user.ID,
+		PublicID:         uuid.NewString(),
+		RefreshTokenHash: hashToken(secret),
+		AuthMethods:      strings.Join(authMethods, " "),
+		ExpiresAt:        now.Add(refreshExp),
+		UserAgent:        truncateString(c.Request.UserAgent(), 256),
+		IP:               c.ClientIP(),
+		LastSeenAt:       &now,
+	}
+
+	accessToken, claims, err := generateSessionToken(user, session)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	session.TokenID = claims.ID
+
+	if err := db.Create(&session).Error; err != nil {
+		return sessionTokens{}, err
+	}
+
+	return sessionTokens{
+		AccessToken:      accessToken,
+		AccessExpiresIn:  time.Until(claims.ExpiresAt.Time),
+		RefreshToken:     session.PublicID + "." + secret,
+		RefreshExpiresIn: refreshExp,
+	}, nil
+}
+
+// generateSessionToken issues an access token for user bound to session.
+// It returns the signed token and its claims.
+func generateSessionToken(user models.User, session models.Session) (string, *schemas.TokenClaims, error) {
+	claims := schemas.NewTokenClaims(user.ID)
+	claims.SessionID = session.PublicID
+	claims.AuthMethods = strings.Fields(session.AuthMethods)
+	claims.Payload = newTokenPayload(user)
+
+	token, err := signClaims(claims)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, claims, nil
+}
+
+// newTokenPayload is the snapshot of user carried by its access tokens
+func newTokenPayload(user models.User) schemas.TokenPayload {
+	return schemas.TokenPayload{
+		UserID:       user.ID,
+		Role:         string(user.Role),
+		Nickname:     user.Nickname,
+		TokenVersion: user.TokenVersion,
+	}
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh rotates the refresh token of the current session and issues a new access token.
+// Presenting an already rotated refresh token revokes the whole session.
+// A refresh_token in the JSON body is answered in the body, otherwise the cookie is used.
+func Refresh(c *gin.Context, db *gorm.DB) {
+	var req refreshRequest
+	if c.Request.ContentLength != 0 {
+		_ = c.ShouldBindJSON(&req)
+	}
+
+	inBody := req.RefreshToken != ""
+	rawToken := req.RefreshToken
+	if !inBody {
+		rawToken, _ = c.Cookie(refreshCookieName)
+	}
+	if rawToken == "" {
+		c.JSON(401, gin.H{"error": "Refresh token is required"})
+		return
+	}
+
+	// Failed refreshes are audited, successful ones would only be noise
+	fail := func(message string, userID uint) {
+		audit.Record(db, c, audit.Entry{
+			Action:       audit.ActionRefresh,
+			Outcome:      audit.OutcomeFailure,
+			TargetUserID: userID,
+			Details:      map[string]any{"reason": message},
+		})
+		if !inBody {
+			clearSessionCookies(c)
+		}
+		c.JSON(401, gin.H{"error": message})
+	}
+
+	session, secret, err := findSessionByRefreshToken(db, rawToken)
+	if err != nil {
+		fail("Invalid refresh token", 0)
+		return
+	}
+
+	if !session.IsActive() {
+		fail("Session expired or revoked", session.UserID)
+		return
+	}
+
+	oldHash := session.RefreshTokenHash
+	if hashToken(secret) != oldHash {
+		// The refresh token was already used once, someone holds a copy of it
+		_ = revokeSession(db, &session, revokeReasonRefreshReuse)
+		fail("Refresh token reuse detected, session revoked", session.UserID)
+		return
+	}
+
+	var user models.User
+	if err := db.First(&user, session.UserID).Error; err != nil {
+		_ = revokeSession(db, &session, revokeReasonUserMissing)
+		fail("User not found", session.UserID)
+		return
+	}
+	if user.IsDisabled() {
+		fail("Account is disabled", user.ID)
+		return
+	}
+	if user.IsExpired() {
+		_ = revokeSession(db, &session, revokeReasonExpired)
+		fail("Guest account expired", user.ID)
+		return
+	}
+
+	newSecret, err := randomToken(32)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate refresh token", "details": err.Error()})
+		return
+	}
+
+	accessToken, claims, err := generateSessionToken(user, session)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to generate token", "details": err.Error()})
+		return
+	}
+
+	// Only rotate when nobody rotated the token in between
+	result := db.Model(&models.Session{}).
+		Where("id = ? AND refresh_token_hash = ?", session.ID, oldHash).
+		Updates(map[string]any{
+			"refresh_token_hash": hashToken(newSecret),
+			"token_id":           claims.ID,
+			"ip":                 c.ClientIP(),
+			"last_seen_at":       time.Now(),
+		})
+	if result.Error != nil {
+		c.JSON(500, gin.H{"error": "Failed to rotate refresh token", "details": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		_ = revokeSession(db, &session, revokeReasonRefreshReuse)
+		fail("Refresh token reuse detected, session revoked", session.UserID)
+		return
+	}
+
+	tokens := sessionTokens{
+		AccessToken:      accessToken,
+		AccessExpiresIn:  time.Until(claims.ExpiresAt.Time),
+		RefreshToken:     session.PublicID + "." + newSecret,
+		RefreshExpiresIn: time.Until(session.ExpiresAt),
+	}
+	if inBody {
+		c.JSON(200, newTokenResponse(tokens, user, "Token refreshed"))
+		return
+	}
+
+	setAuthCookie(c, tokens.AccessToken)
+	setRefreshCookie(c, tokens.RefreshToken, tokens.RefreshExpiresIn)
+
+	c.JSON(200, loginResponse{
+		UserID:   user.ID,
+		Message:  "Token refreshed",
+		Role:     string(user.Role),
+		Nickname: user.Nickname,
+	})
+}
+
+// currentSessionFromRequest finds the session of the caller by refresh token cookie or access token.
+// The refresh token only counts when its secret matches, the public id alone is no proof.
+func currentSessionFromRequest(c *gin.Context, db *gorm.DB) (models.Session, error) {
+	if rawToken, err := c.Cookie(refreshCookieName); err == nil && rawToken != "" {
+		if session, secret, err := findSessionByRefreshToken(db, rawToken); err == nil && hashToken(secret) == session.RefreshTokenHash {
+			return session, nil
+		}
+	}
+
+	claims, err := accessClaimsFromRequest(c)
+	if err != nil {
+		return models.Session{}, err
+	}
+	if claims.SessionID == "" {
+		return models.Session{}, gorm.ErrRecordNotFound
+	}
+
+	var session models.Session
+	if err := db.Where("public_id = ?", claims.SessionID).First(&session).Error; err != nil {
+		return models.Session{}, err
+	}
+	return session, nil
+}
+
+// accessClaimsFromRequest validates the Bearer token or auth_token cookie and returns its claims
+func accessClaimsFromRequest(c *gin.Context) (*schemas.TokenClaims, error) {
+	accessToken, _, err := AccessTokenFromRequest(c)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken == "" {
+		return nil, errors.New("missing access token")
+	}
+	token, err := ValidateToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(*schemas.TokenClaims)
+	if !ok {
+		return nil, errors.New("invalid token claims")
+	}
+	return claims, nil
+}
+
+// findSessionByRefreshToken splits "<public id>.<secret>" and loads the matching session
+func findSessionByRefreshToken(db *gorm.DB, rawToken string) (models.Session, string, error) {
+	publicID, secret, found := strings.Cut(rawToken, ".")
+	if !found || publicID == "" || secret == "" {
+		return models.Session{}, "", errInvalidRefreshToken
+	}
+
+	var session models.Session
+	if err := db.Where("public_id = ?", publicID).First(&session).Error; err != nil {
+		return models.Session{}, "", err
+	}
+	return session, secret, nil
+}
+
+// revokeSession marks the session as revoked, a revoked session can never be refreshed again
+// and its access tokens are rejected
+func revokeSession(db *gorm.DB, session *models.Session, reason string) error {
+	if session.RevokedAt != nil {
+		return nil
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	session.RevokeReason = reason
+	if err := db.Model(session).Updates(map[string]any{"revoked_at": now, "revoke_reason": reason}).Error; err != nil {
+		return err
+	}
+
+	cache := getRevocationCache(db)
+	cache.mu.Lock()
+	cache.sessions[session.PublicID] = cachedTokenRevocation{revoked: true, fetchedAt: time.Now()}
+	cache.mu.Unlock()
+	return nil
+}
+
+func getRefreshTokenExpiration() time.Duration {
+	exp, err := config.GetVariableAsTimeDuration("REFRESH_TOKEN_EXPIRATION")
+	if err != nil {
+		return 30 * 24 * time.Hour // Default to 30 days if not set
+	}
+	return exp
+}
+
+// hashToken returns the hex sha256 of an opaque token, only the hash is stored in database
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// truncateString cuts s to at most n bytes without splitting a UTF-8 character
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// randomToken returns n random bytes encoded as base64url
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// refreshCookiePath limits the refresh token cookie to the auth endpoints
+func refreshCookiePath() string {
+	apiPathPrefix, _ := config.GetVariableAsString("API_PATH_PREFIX")
+	return strings.TrimRight(apiPathPrefix, "/") + apipaths.AuthGroup
+}
+
+func setRefreshCookie(c *gin.Context, token string, exp time.Duration) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		refreshCookieName,   // cookie name
+		token,               // cookie value
+		int(exp.Seconds()),  // max age in seconds
+		refreshCookiePath(), // path
+		"",                  // domain (empty means current domain)
+		true,                // secure (set to true in production with HTTPS)
+		true,                // httpOnly
+	)
+}
+
+// clearSessionCookies removes both the access token and the refresh token cookies
+func clearSessionCookies(c *gin.Context) {
+	removeAuthCookie(c)
+	removeRefreshCookie(c)
+}
+
+func removeRefreshCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(
+		refreshCookieName,   // cookie name
+		"",                  // empty value
+		-1,                  // max age -1 (delete immediately)
+		refreshCookiePath(), // path
+		"",                  // domain (empty means current domain)
+		true,                // secure (set to true in production with HTTPS)
+		true,                // httpOnly
+	)
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"personal_site/audit"
+	"personal_site/controllers/utils"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Only refresh LastSeenAt this often, so every request of a session does not write
+const sessionLastSeenPrecision = time.Minute
+
+type sessionResponse struct {
+	ID          uint       `json:"id"`
+	UserAgent   string     `json:"user_agent"`
+	IP          string     `json:"ip"`
+	AuthMethods []string   `json:"auth_methods"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastSeenAt  *time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	Current     bool       `json:"current"` // the session of this request
+}
+
+func newSessionResponse(session models.Session, currentID string) sessionResponse {
+	return sessionResponse{
+		ID:          session.ID,
+		UserAgent:   session.UserAgent,
+		IP:          session.IP,
+		AuthMethods: strings.Fields(session.AuthMethods),
+		CreatedAt:   session.CreatedAt,
+		LastSeenAt:  session.LastSeenAt,
+		ExpiresAt:   session.ExpiresAt,
+		Current:     currentID != "" && session.PublicID == currentID,
+	}
+}
+
+// ListSessions lists the active sessions of the logged in user, the devices it is logged in on
+func ListSessions(c *gin.Context, db *gorm.DB) {
+	var sessions []models.Session
+	if err := activeSessions(db, utils.GetUserID(c)).Order("last_seen_at DESC, id DESC").Find(&sessions).Error; err != nil {
+		c.JSON(500, gin.H{"error": "Database error", "details": err.Error()})
+		return
+	}
+
+	currentID := currentSessionID(c)
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, newSessionResponse(session, currentID))
+	}
+	c.JSON(200, gin.H{"sessions": resp})
+}
+
+// SignOutSession revokes one session of the logged in user, its refresh token and access
+// tokens stop working. Signing out the current session also clears the cookies.
+func SignOutSession(c *gin.Context, db *gorm.DB) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid id"})
+		return
+	}
+
+	userID := utils.GetUserID(c)
+	var session models.Session
+	if err := activeSessions(db, userID).Where("id = ?", id).First(&session).Error; err != nil {
+		c.JSON(404, gin.H{"error": "Session not found"})
+		return
+	}
+	if err := revokeSession(db, &session, revokeReasonSignedOut); err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sign out session", "details": err.Error()})
+		return
+	}
+	audit.Record(db, c, audit.Entry{Action: audit.ActionSessionRevoke, TargetUserID: userID, Details: map[string]any{"session_id": session.ID}})
+
+	if session.PublicID == currentSessionID(c) {
+		clearSessionCookies(c)
+	}
+	c.JSON(200, gin.H{"message": "Session signed out", "id": session.ID})
+}
+
+// SignOutOtherSessions revokes every session of the logged in user except the current one
+func SignOutOtherSessions(c *gin.Context, db *gorm.DB) {
+	userID := utils.GetUserID(c)
+	revoked, err := revokeOtherSessions(c, db, userID, revokeReasonSignedOut)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to sign out sessions", "details": err.Error()})
+		return
+	}
+	if revoked > 0 {
+		audit.Record(db, c, audit.Entry{Action: audit.ActionSessionRevoke, TargetUserID: userID, Details: map[string]any{"others": revoked}})
+	}
+
+	c.JSON(200, gin.H{"message": "Other sessions signed out", "revoked": revoked})
+}
+
+// revokeOtherSessions revokes the active sessions of userID except the session of the
+// request, it returns how many were revoked
+func revokeOtherSessions(c *gin.Context, db *gorm.DB, userID uint, reason string) (int, error) {
+	query := activeSessions(db, userID)
+	if currentID := currentSessionID(c); currentID != "" {
+		query = query.Where("public_id <> ?", currentID)
+	}
+
+	var sessions []models.Session
+	if err := query.Find(&sessions).Error; err != nil {
+		return 0, err
+	}
+	for i := range sessions {
+		if err := revokeSession(db, &sessions[i], reason); err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// TouchSession records that the session of claims made a request, from the client IP of c.
+// It writes at most once per sessionLastSeenPrecision and session.
+func TouchSession(c *gin.Context, db *gorm.DB, claims *schemas.TokenClaims) {
+	if claims.SessionID == "" {
+		return
+	}
+
+	cache := getSessionActivityCache(db)
+	now := time.Now()
+	cache.mu.Lock()
+	if seen, found := cache.seen[claims.SessionID]; found && now.Sub(seen) < sessionLastSeenPrecision {
+		cache.mu.Unlock()
+		return
+	}
+	if len(cache.seen) >= maxCachedRevocations {
+		for k, v := range cache.seen {
+			if now.Sub(v) >= sessionLastSeenPrecision {
+				delete(cache.seen, k)
+			}
+		}
+	}
+	cache.seen[claims.SessionID] = now
+	cache.mu.Unlock()
+
+	err := db.Model(&models.Session{}).
+		Where("public_id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)", claims.SessionID, now.Add(-sessionLastSeenPrecision)).
+		Updates(map[string]any{"last_seen_at": now, "ip": c.ClientIP()}).Error
+	if err != nil {
+		log.Println("[TouchSession] update error:", err, "session:", claims.SessionID)
+	}
+}
+
+// sessionActivityCache remembers when this process last wrote LastSeenAt of a session
+type sessionActivityCache struct {
+	mu   sync.Mutex
+	db   *gorm.DB
+	seen map[string]time.Time
+}
+
+var sessionActivity = &sessionActivityCache{}
+
+// getSessionActivityCache returns the cache for db, a new database (e.g. in tests) gets an empty cache
+func getSessionActivityCache(db *gorm.DB) *sessionActivityCache {
+	sessionActivity.mu.Lock()
+	defer sessionActivity.mu.Unlock()
+	if sessionActivity.db != db {
+		sessionActivity.db = db
+		sessionActivity.seen = make(map[string]time.Time)
+	}
+	return sessionActivity
+}
+
+// activeSessions selects the sessions of userID that can still be refreshed
+func activeSessions(db *gorm.DB, userID uint) *gorm.DB {
+	return db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now())
+}
+
+// currentSessionID returns the public id of the session of the request's access token
+func currentSessionID(c *gin.Context) string {
+	value, _ := c.Get("token_claims")
+	if claims, ok := value.(*schemas.TokenClaims); ok {
+		return claims.SessionID
+	}
+	return ""
+}
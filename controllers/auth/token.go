@@ -21,27 +21,71 @@ func GenerateToken(payload schemas.TokenPayload, id uint) (string, error) {
 	claims := schemas.NewTokenClaims(id)
 	claims.Payload = payload
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signClaims(claims)
+}
 
-	key, err := getSecretKey()
+// signClaims signs any claims with the configured signing method. Asymmetric
+// tokens carry the kid of the active key in their header.
+func signClaims(claims jwt.Claims) (string, error) {
+	ks, err := getKeySet()
 	if err != nil {
-		return "", fmt.Errorf("failed to get secret key: %v", err)
+		return "", fmt.Errorf("failed to load signing keys: %v", err)
 	}
-	return token.SignedString(key)
+
+	if ks.isSymmetric() {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+		key, err := getSecretKey()
+		if err != nil {
+			return "", fmt.Errorf("failed to get secret key: %v", err)
+		}
+		return token.SignedString(key)
+	}
+
+	token := jwt.NewWithClaims(ks.Active.Method, claims)
+	token.Header["kid"] = ks.Active.ID
+	return token.SignedString(ks.Active.Private)
 }
 
+// ValidateToken verifies an access token, tokens issued for other purposes are rejected by their audience
 func ValidateToken(tokenString string) (*jwt.Token, error) {
-	key, err := getSecretKey()
+	return parseToken(tokenString, &schemas.TokenClaims{}, jwt.WithAudience(schemas.TokenIssuer))
+}
+
+// parseToken verifies tokenString with the configured keys and parses it into claims
+func parseToken(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	ks, err := getKeySet()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get secret key: %v", err)
+		return nil, fmt.Errorf("failed to load signing keys: %v", err)
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &schemas.TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	var keyFunc jwt.Keyfunc
+	if ks.isSymmetric() {
+		key, err := getSecretKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get secret key: %v", err)
+		}
+		keyFunc = func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key, nil
 		}
-		return key, nil
-	})
+	} else {
+		keyFunc = func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			key, ok := ks.Keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown key id: %q", kid)
+			}
+			if token.Method.Alg() != key.Method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			return key.Public, nil
+		}
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc, opts...)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %v", err)
@@ -1,11 +1,17 @@
 package auth
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
 	"fmt"
+	"net/http/httptest"
 	"personal_site/schemas"
 	"testing"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -175,3 +181,112 @@ func TestValidateToken(t *testing.T) {
 		assert.Nil(t, validatedToken)
 	})
 }
+
+// useKeySet replaces the configured keys for the duration of the test
+func useKeySet(t *testing.T, ks *keySet) {
+	original := getKeySet
+	getKeySet = func() (*keySet, error) {
+		return ks, nil
+	}
+	t.Cleanup(func() { getKeySet = original })
+}
+
+func newRSAKey(t *testing.T, kid string) *signingKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return &signingKey{ID: kid, Method: jwt.SigningMethodRS256, Private: key, Public: &key.PublicKey}
+}
+
+func newEd25519Key(t *testing.T, kid string) *signingKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return &signingKey{ID: kid, Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}
+}
+
+func TestAsymmetricToken(t *testing.T) {
+	payload := schemas.TokenPayload{
+		UserID:   123,
+		Role:     "user",
+		Nickname: "testuser",
+	}
+
+	t.Run("RS256 token carries kid and validates", func(t *testing.T) {
+		key := newRSAKey(t, "rsa-1")
+		useKeySet(t, &keySet{Method: jwt.SigningMethodRS256, Active: key, Keys: map[string]*signingKey{"rsa-1": key}})
+
+		tokenStr, err := GenerateToken(payload, 123)
+		require.NoError(t, err)
+
+		parsed, _, err := jwt.NewParser().ParseUnverified(tokenStr, &schemas.TokenClaims{})
+		require.NoError(t, err)
+		assert.Equal(t, "rsa-1", parsed.Header["kid"])
+		assert.Equal(t, "RS256", parsed.Header["alg"])
+
+		validatedToken, err := ValidateToken(tokenStr)
+		require.NoError(t, err)
+		assert.Equal(t, payload, validatedToken.Claims.(*schemas.TokenClaims).Payload)
+	})
+
+	t.Run("EdDSA token validates", func(t *testing.T) {
+		key := newEd25519Key(t, "ed-1")
+		useKeySet(t, &keySet{Method: jwt.SigningMethodEdDSA, Active: key, Keys: map[string]*signingKey{"ed-1": key}})
+
+		tokenStr, err := GenerateToken(payload, 123)
+		require.NoError(t, err)
+
+		_, err = ValidateToken(tokenStr)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Tokens of a rotated key stay valid", func(t *testing.T) {
+		oldKey := newEd25519Key(t, "ed-old")
+		newKey := newEd25519Key(t, "ed-new")
+		keys := map[string]*signingKey{"ed-old": oldKey, "ed-new": newKey}
+
+		useKeySet(t, &keySet{Method: jwt.SigningMethodEdDSA, Active: oldKey, Keys: keys})
+		oldToken, err := GenerateToken(payload, 123)
+		require.NoError(t, err)
+
+		useKeySet(t, &keySet{Method: jwt.SigningMethodEdDSA, Active: newKey, Keys: keys})
+		_, err = ValidateToken(oldToken)
+		assert.NoError(t, err, "Token signed by the previous key should still validate")
+
+		useKeySet(t, &keySet{Method: jwt.SigningMethodEdDSA, Active: newKey, Keys: map[string]*signingKey{"ed-new": newKey}})
+		_, err = ValidateToken(oldToken)
+		assert.Error(t, err, "Token signed by a removed key should be rejected")
+	})
+
+	t.Run("HMAC token rejected when asymmetric keys are configured", func(t *testing.T) {
+		key := newRSAKey(t, "rsa-1")
+		useKeySet(t, &keySet{Method: jwt.SigningMethodRS256, Active: key, Keys: map[string]*signingKey{"rsa-1": key}})
+
+		claims := schemas.NewTokenClaims("123")
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = "rsa-1"
+		tokenStr, err := token.SignedString([]byte("fake_secret_value"))
+		require.NoError(t, err)
+
+		_, err = ValidateToken(tokenStr)
+		assert.Error(t, err)
+	})
+
+	t.Run("JWKS publishes the public keys", func(t *testing.T) {
+		rsaKey := newRSAKey(t, "rsa-1")
+		useKeySet(t, &keySet{Method: jwt.SigningMethodRS256, Active: rsaKey, Keys: map[string]*signingKey{"rsa-1": rsaKey}})
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		JWKS(c)
+
+		assert.Equal(t, 200, w.Code)
+		var body struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Len(t, body.Keys, 1)
+		assert.Equal(t, "rsa-1", body.Keys[0].Kid)
+		assert.Equal(t, "RSA", body.Keys[0].Kty)
+		assert.Equal(t, "AQAB", body.Keys[0].E)
+		assert.NotEmpty(t, body.Keys[0].N)
+	})
+}
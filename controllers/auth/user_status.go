@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"personal_site/config"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserDisabled  = errors.New("account is disabled")
+	ErrUserNotFound  = errors.New("user not found")
+	ErrTokenOutdated = errors.New("token was issued before the account changed")
+)
+
+// userStatusCache remembers whether users are disabled or deleted and their token version,
+// so the middlewares do not load the user on every request. Changes made by this process
+// are visible immediately, changes made by other instances after USER_STATUS_CACHE_TTL.
+type userStatusCache struct {
+	mu    sync.Mutex
+	db    *gorm.DB
+	users map[uint]cachedUserStatus
+}
+
+type cachedUserStatus struct {
+	err          error // nil, ErrUserDisabled or ErrUserNotFound
+	tokenVersion uint
+	fetchedAt    time.Time
+}
+
+var userStatuses = &userStatusCache{}
+
+// getUserStatusCache returns the cache for db, a new database (e.g. in tests) gets an empty cache
+func getUserStatusCache(db *gorm.DB) *userStatusCache {
+	userStatuses.mu.Lock()
+	defer userStatuses.mu.Unlock()
+	if userStatuses.db != db {
+		userStatuses.db = db
+		userStatuses.users = make(map[uint]cachedUserStatus)
+	}
+	return userStatuses
+}
+
+// CheckTokenUser returns ErrUserDisabled or ErrUserNotFound when the user of payload must
+// not be authenticated anymore, and ErrTokenOutdated when the user changed since the token
+// was issued (its role or nickname may be stale). Anonymous (id 0) is always accepted.
+func CheckTokenUser(db *gorm.DB, payload schemas.TokenPayload) error {
+	if payload.UserID == 0 {
+		return nil
+	}
+
+	status, err := getUserStatus(db, payload.UserID)
+	if err != nil {
+		return err
+	}
+	if status.err != nil {
+		return status.err
+	}
+	if payload.TokenVersion < status.tokenVersion {
+		return ErrTokenOutdated
+	}
+	return nil
+}
+
+func getUserStatus(db *gorm.DB, userID uint) (cachedUserStatus, error) {
+	cache := getUserStatusCache(db)
+	ttl := getUserStatusCacheTTL()
+
+	cache.mu.Lock()
+	entry, found := cache.users[userID]
+	cache.mu.Unlock()
+	if found && time.Since(entry.fetchedAt) < ttl {
+		return entry, nil
+	}
+
+	var user models.User
+	if err := db.Select("id", "disabled_at", "token_version", "expires_at", "provider").Where("id = ?", userID).Limit(1).Find(&user).Error; err != nil {
+		return cachedUserStatus{}, err
+	}
+	entry = cachedUserStatus{err: userStatusError(user), tokenVersion: user.TokenVersion, fetchedAt: time.Now()}
+
+	cache.mu.Lock()
+	if len(cache.users) >= maxCachedRevocations {
+		for k, v := range cache.users {
+			if time.Since(v.fetchedAt) >= ttl {
+				delete(cache.users, k)
+			}
+		}
+	}
+	cache.users[userID] = entry
+	cache.mu.Unlock()
+	return entry, nil
+}
+
+// BumpTokenVersion makes every access token issued to the user so far outdated, so the
+// middlewares reject them and the clients refresh to get one with the current role and
+// nickname. Sessions are kept, use RevokeAllUserTokens to end them.
+func BumpTokenVersion(db *gorm.DB, userID uint) error {
+	err := db.Model(&models.User{}).Where("id = ?", userID).
+		UpdateColumn("token_version", gorm.Expr("token_version + 1")).Error
+	ForgetUserStatus(db, userID)
+	return err
+}
+
+func getUserStatusCacheTTL() time.Duration {
+	ttl, err := config.GetVariableAsTimeDuration("USER_STATUS_CACHE_TTL")
+	if err != nil {
+		return 10 * time.Second // Default to 10 seconds if not set
+	}
+	return ttl
+}
+
+// ForgetUserStatus drops the cached status of a user, call it after disabling, enabling or
+// deleting the user, BumpTokenVersion calls it itself
+func ForgetUserStatus(db *gorm.DB, userID uint) {
+	cache := getUserStatusCache(db)
+	cache.mu.Lock()
+	delete(cache.users, userID)
+	cache.mu.Unlock()
+}
+
+// userStatusError tells whether a loaded user may log in, user.ID is 0 when it was not found.
+// An expired guest counts as not found, DeleteExpiredGuests removes it later.
+func userStatusError(user models.User) error {
+	if user.ID == 0 || user.DeletedAt.Valid || user.IsExpired() {
+		return ErrUserNotFound
+	}
+	if user.IsDisabled() {
+		return ErrUserDisabled
+	}
+	return nil
+}
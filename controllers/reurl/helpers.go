@@ -2,6 +2,7 @@ package reurl
 
 import (
     "errors"
+    "personal_site/config"
     "personal_site/models"
     "time"
 
@@ -62,3 +63,25 @@ func ClearExpiredUrls(db *gorm.DB, owner *uint, key *string, id *uint) error {
 
     return query.Delete(&models.Reurl{}).Error
 }
+
+// guestReurlLimit returns how many reurls owner may still hold, or -1 when owner is not a
+// guest account. Guests skip the email verification, so GUEST_MAX_REURLS keeps them from
+// using the site as a free link shortener.
+func guestReurlLimit(db *gorm.DB, owner uint) (int, error) {
+    var user models.User
+    if err := db.Select("ID", "Provider", "ExpiresAt").Where("id = ?", owner).Limit(1).Find(&user).Error; err != nil {
+        return 0, err
+    }
+    if !user.IsGuest() {
+        return -1, nil
+    }
+    return getGuestMaxReurls(), nil
+}
+
+func getGuestMaxReurls() int {
+    n, err := config.GetVariableAsInt("GUEST_MAX_REURLS")
+    if err != nil || n < 0 {
+        return 10 // Default to 10 if not set
+    }
+    return n
+}
@@ -6,6 +6,7 @@ import (
     "net/http"
     "personal_site/controllers/utils"
     "personal_site/models"
+    "personal_site/policy"
     "time"
 
     "github.com/gin-gonic/gin"
@@ -41,6 +42,24 @@ func CreateReurl(c *gin.Context, db *gorm.DB) {
         return
     }
 
+    // guests hold a limited number of live reurls
+    limit, err := guestReurlLimit(db, user.ID)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+        return
+    }
+    if limit >= 0 {
+        var owned int64
+        if err := db.Model(&models.Reurl{}).Where("owner_id = ? AND (expires_at IS NULL OR expires_at >= ?)", user.ID, time.Now()).Count(&owned).Error; err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
+            return
+        }
+        if owned >= int64(limit) {
+            c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("guest accounts can hold at most %d reurls, sign up for more", limit)})
+            return
+        }
+    }
+
     // Validate expires: default to 7d when not specified
     var expiresAt *time.Time
     if req.ExpiresIn == nil {
@@ -101,12 +120,12 @@ func CreateReurl(c *gin.Context, db *gorm.DB) {
     c.JSON(http.StatusCreated, gin.H{"data": reurl})
 }
 
-// ListReurls lists mappings. Admins see all, regular users see their own.
+// ListReurls lists mappings. Roles with reurl:list:any see all, the others their own.
 func ListReurls(c *gin.Context, db *gorm.DB) {
     user, _ := utils.GetTokenUser(c) // AuthRequired ensures existence
 
     var results []models.Reurl
-    if utils.IsAdminUser(c) {
+    if policy.Can(c, policy.ReurlList.Any()) {
 		_ = ClearExpiredUrls(db, nil, nil, nil)
         if err := db.Preload("Owner").Find(&results).Error; err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "db error", "details": err.Error()})
@@ -125,7 +144,7 @@ func ListReurls(c *gin.Context, db *gorm.DB) {
     c.JSON(http.StatusOK, gin.H{"data": results})
 }
 
-// GetReurl returns a single mapping by ID. Admins can view any; users can view only their own.
+// GetReurl returns a single mapping by ID. Access is declared with RequirePermission(policy.ReurlRead).
 func GetReurl(c *gin.Context, db *gorm.DB) {
     idStr := c.Param("id")
 
@@ -149,18 +168,14 @@ func GetReurl(c *gin.Context, db *gorm.DB) {
         return
     }
 
-    if !utils.IsAdminUser(c) {
-        user, _ := utils.GetTokenUser(c)
-        if reurl.OwnerID != user.ID {
-            c.JSON(http.StatusForbidden, gin.H{"error": "not allowed"})
-            return
-        }
+    if !policy.AuthorizeOwner(c, reurl.OwnerID) {
+        return
     }
 
     c.JSON(http.StatusOK, gin.H{"data": reurl})
 }
 
-// PatchReurl updates fields that are provided. Admins can update any; users only their own.
+// PatchReurl updates fields that are provided. Access is declared with RequirePermission(policy.ReurlUpdate).
 func PatchReurl(c *gin.Context, db *gorm.DB) {
     idStr := c.Param("id")
 
@@ -184,12 +199,8 @@ func PatchReurl(c *gin.Context, db *gorm.DB) {
         return
     }
 
-    if !utils.IsAdminUser(c) {
-        user, _ := utils.GetTokenUser(c)
-        if reurl.OwnerID != user.ID {
-            c.JSON(http.StatusForbidden, gin.H{"error": "not allowed"})
-            return
-        }
+    if !policy.AuthorizeOwner(c, reurl.OwnerID) {
+        return
     }
 
     var req PatchReurlRequest
@@ -240,7 +251,7 @@ func PatchReurl(c *gin.Context, db *gorm.DB) {
     c.JSON(http.StatusOK, gin.H{"data": reurl})
 }
 
-// DeleteReurl deletes a mapping. Admins can delete any; users only their own.
+// DeleteReurl deletes a mapping. Access is declared with RequirePermission(policy.ReurlDelete).
 func DeleteReurl(c *gin.Context, db *gorm.DB) {
     idStr := c.Param("id")
 
@@ -264,12 +275,8 @@ func DeleteReurl(c *gin.Context, db *gorm.DB) {
         return
     }
 
-    if !utils.IsAdminUser(c) {
-        user, _ := utils.GetTokenUser(c)
-        if reurl.OwnerID != user.ID {
-            c.JSON(http.StatusForbidden, gin.H{"error": "not allowed"})
-            return
-        }
+    if !policy.AuthorizeOwner(c, reurl.OwnerID) {
+        return
     }
 
     if err := db.Delete(&reurl).Error; err != nil {
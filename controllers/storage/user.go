@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// userDataPath is the folder holding every storage tree of a user, convertToStoragePath
+// puts the files below "<userDataPath>/<nickname>"
+func userDataPath(userID uint) (string, error) {
+	storageRoot, err := GetStorageRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(storageRoot, "data", fmt.Sprintf("%d", userID)), nil
+}
+
+// RenameUserFolder moves the files of a user to the folder of the new nickname, storage
+// paths contain the nickname of the token. A user without files has nothing to move.
+func RenameUserFolder(userID uint, oldNickname, newNickname string) error {
+	dataPath, err := userDataPath(userID)
+	if err != nil {
+		return err
+	}
+	oldPath := filepath.Join(dataPath, oldNickname)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return nil
+	}
+	return move(oldPath, filepath.Join(dataPath, newNickname))
+}
+
+// RemoveUserStorage deletes the files and unfinished uploads of a user
+func RemoveUserStorage(userID uint) error {
+	dataPath, err := userDataPath(userID)
+	if err != nil {
+		return err
+	}
+	if err := rmdir(dataPath); err != nil {
+		return err
+	}
+
+	storageRoot, err := GetStorageRoot()
+	if err != nil {
+		return err
+	}
+	return rmdir(filepath.Join(storageRoot, "tmp", fmt.Sprintf("%d", userID)))
+}
+
+// MoveUserStorage moves the files of a user to another user, e.g. when a guest is merged into an
+// account. When the other user already has files, they go to a folder named after fromNickname.
+func MoveUserStorage(fromID uint, fromNickname string, toID uint, toNickname string) error {
+	fromPath, err := userDataPath(fromID)
+	if err != nil {
+		return err
+	}
+	oldPath := filepath.Join(fromPath, fromNickname)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	toPath, err := userDataPath(toID)
+	if err != nil {
+		return err
+	}
+	newPath := filepath.Join(toPath, toNickname)
+	if _, err := os.Stat(newPath); err == nil {
+		newPath = filepath.Join(newPath, fromNickname)
+	}
+	if err := mkDirIfNotExists(filepath.Dir(newPath)); err != nil {
+		return err
+	}
+	return move(oldPath, newPath)
+}
@@ -20,8 +20,8 @@ func initMySQLDB(dsn string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect to MySQL database: %v", err)
 	}
 
-	if err := db.AutoMigrate(&models.User{}, &models.YTDataAPITokenHistory{}, &models.BattleCatLevel{}, &models.Reurl{}); err != nil {
-		return nil, fmt.Errorf("auto migrate failed: %v", err)
+	if err := autoMigrate(db); err != nil {
+		return nil, err
 	}
 
 	return db, nil
@@ -33,13 +33,70 @@ func initSQLiteDB(dsn string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect to SQLite database: %v", err)
 	}
 
-	if err := db.AutoMigrate(&models.User{}, &models.YTDataAPITokenHistory{}, &models.BattleCatLevel{}, &models.Reurl{}); err != nil {
-		return nil, fmt.Errorf("auto migrate failed: %v", err)
+	if err := autoMigrate(db); err != nil {
+		return nil, err
 	}
 
 	return db, nil
 }
 
+func autoMigrate(db *gorm.DB) error {
+	// OAuth users created before account linking only have User.Provider + User.Identifier
+	backfillIdentities := !db.Migrator().HasTable(&models.Identity{})
+
+	// Users that existed before email verification was added stay unverified: nothing was
+	// recorded about their emails. They verify through the emailed link, or their next OAuth
+	// login when the provider confirms the email (see markProviderVerifiedEmail).
+	if err := db.AutoMigrate(
+		&models.User{},
+		&models.YTDataAPITokenHistory{},
+		&models.BattleCatLevel{},
+		&models.Reurl{},
+		&models.Session{},
+		&models.RevokedToken{},
+		&models.UserTokenRevocation{},
+		&models.TOTPCredential{},
+		&models.RecoveryCode{},
+		&models.PasswordResetToken{},
+		&models.Identity{},
+		&models.APIKey{},
+		&models.LoginLockout{},
+		&models.AuditEvent{},
+		&models.WebAuthnCredential{},
+	); err != nil {
+		return fmt.Errorf("auto migrate failed: %v", err)
+	}
+
+	if backfillIdentities {
+		if err := backfillOAuthIdentities(db); err != nil {
+			return fmt.Errorf("backfill identities failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// backfillOAuthIdentities creates the identity of every existing OAuth user
+func backfillOAuthIdentities(db *gorm.DB) error {
+	var users []models.User
+	if err := db.Where("provider <> ?", models.AuthProviderPassword).Find(&users).Error; err != nil {
+		return err
+	}
+
+	identities := make([]models.Identity, 0, len(users))
+	for _, user := range users {
+		identities = append(identities, models.Identity{
+			UserID:   user.ID,
+			Provider: user.Provider,
+			Subject:  user.Identifier,
+			Email:    user.Email,
+		})
+	}
+	if len(identities) == 0 {
+		return nil
+	}
+	return db.CreateInBatches(identities, 100).Error
+}
+
 func InitDB() (*gorm.DB, error) {
 
 	dsn, err := config.GetVariableAsString("DATABASE_DSN")
@@ -0,0 +1,15 @@
+package mailer
+
+import (
+	"log"
+)
+
+// LogMailer only prints emails to the log, for development
+type LogMailer struct {
+	From string
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	log.Printf("[Mailer] from=%s to=%s subject=%q\n%s", m.From, msg.To, msg.Subject, msg.Body)
+	return nil
+}
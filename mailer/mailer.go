@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"personal_site/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. Implementations: SMTPMailer, LogMailer and FileMailer.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var (
+	defaultMailer Mailer
+	defaultMu     sync.Mutex
+)
+
+// Default returns the mailer selected by MAILER (smtp, log or file), it defaults to log
+func Default() (Mailer, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultMailer != nil {
+		return defaultMailer, nil
+	}
+
+	m, err := fromConfig()
+	if err != nil {
+		return nil, err
+	}
+	defaultMailer = m
+	return m, nil
+}
+
+// SetDefault replaces the mailer returned by Default, e.g. with a stand-in in tests
+func SetDefault(m Mailer) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultMailer = m
+}
+
+// Send delivers msg through the default mailer
+func Send(msg Message) error {
+	m, err := Default()
+	if err != nil {
+		return err
+	}
+	return m.Send(msg)
+}
+
+func fromConfig() (Mailer, error) {
+	kind, err := config.GetVariableAsString("MAILER")
+	if err != nil {
+		kind = "log" // Default to only logging emails if not set
+	}
+
+	from, err := config.GetVariableAsString("MAIL_FROM")
+	if err != nil {
+		from = "no-reply@localhost"
+	}
+
+	switch strings.ToLower(kind) {
+	case "smtp":
+		host, err := config.GetVariableAsString("SMTP_HOST")
+		if err != nil {
+			return nil, err
+		}
+		port, err := config.GetVariableAsString("SMTP_PORT")
+		if err != nil {
+			port = "587"
+		}
+		username, _ := config.GetVariableAsString("SMTP_USERNAME")
+		password, _ := config.GetVariableAsString("SMTP_PASSWORD")
+		return &SMTPMailer{
+			Addr:     host + ":" + port,
+			Host:     host,
+			Username: username,
+			Password: password,
+			From:     from,
+		}, nil
+	case "log":
+		return &LogMailer{From: from}, nil
+	case "file":
+		dir, err := config.GetVariableAsString("MAIL_DROP_DIR")
+		if err != nil {
+			return nil, err
+		}
+		return &FileMailer{Dir: dir, From: from}, nil
+	default:
+		return nil, fmt.Errorf("unsupported MAILER: %s", kind)
+	}
+}
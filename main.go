@@ -32,6 +32,11 @@ func main() {
 
 	startSetup()
 
+	// 定期刪除超過保存期限的 audit events
+	tasks.PruneAuditEvents(db)
+	// 定期刪除過期的訪客帳號
+	tasks.ExpireGuestAccounts(db)
+
 	// CORS 配置
 	allowedOrigins, _ := config.GetVariableAsString("CORS_ALLOWED_ORIGINS")
 
@@ -67,6 +72,10 @@ func main() {
 	}
 
 	r := gin.Default()
+	// 只採用 TRUSTED_PROXIES 轉送的 client IP，避免 X-Forwarded-For 被偽造
+	if err := routers.SetTrustedProxies(r); err != nil {
+		panic(err)
+	}
 	r.Use(cors.New(corsConfig))    // cors
 	routers.RegisterRouters(r, db) // endpoints
 
@@ -1,49 +1,53 @@
 package middlewares
 
 import (
+	"errors"
+	"slices"
+
 	authController "personal_site/controllers/auth"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 
+	"personal_site/controllers/utils"
+	"personal_site/policy"
 	"personal_site/schemas"
 )
 
-func AuthRequired() gin.HandlerFunc {
+// AuthRequired accepts an access token from "Authorization: Bearer <token>" or the
+// auth_token cookie, the header takes precedence when both are present
+func AuthRequired(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie("auth_token")
-		if err != nil || token == "" {
-			c.JSON(401, gin.H{"error": "Authorization cookie is required"})
+		token, source, err := authController.AccessTokenFromRequest(c)
+		if err != nil {
+			c.JSON(401, gin.H{"error": "Invalid Authorization header", "details": err.Error()})
 			c.Abort()
 			return
 		}
-
-		validToken, err := authController.ValidateToken(token)
-		if err != nil || !validToken.Valid {
-			c.JSON(401, gin.H{"error": "Invalid or expired token", "details": err.Error()})
+		if token == "" {
+			c.JSON(401, gin.H{"error": "Authorization cookie or Bearer token is required"})
 			c.Abort()
 			return
 		}
 
-		claims, ok := validToken.Claims.(*schemas.TokenClaims)
-		if !ok {
-			c.JSON(401, gin.H{"error": "Invalid token claims"})
-			c.Abort()
+		if !authenticate(c, db, token, source) {
 			return
 		}
 
-		user := (&claims.Payload).ExtractUser()
-
-		c.Set("user", user)
-
 		c.Next()
 	}
 }
 
-func AuthOptional() gin.HandlerFunc {
+func AuthOptional(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := c.Cookie("auth_token")
+		token, source, err := authController.AccessTokenFromRequest(c)
+		if err != nil {
+			c.JSON(401, gin.H{"error": "Invalid Authorization header", "details": err.Error()})
+			c.Abort()
+			return
+		}
 
-		if err != nil || token == "" {
+		if token == "" {
 			// No authentication, continue without setting user
 			anonymousUser := schemas.TokenUser{
 				ID:       0,
@@ -56,25 +60,186 @@ func AuthOptional() gin.HandlerFunc {
 			return
 		}
 
-		validToken, err := authController.ValidateToken(token)
-		if err != nil || !validToken.Valid {
-			// Invalid token, continue without setting user
-			c.JSON(401, gin.H{"error": "Invalid or expired token", "details": err.Error()})
+		if !authenticate(c, db, token, source) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// authenticate validates token and stores the user in the context, it aborts the request
+// and returns false when the token is not accepted
+func authenticate(c *gin.Context, db *gorm.DB, token string, source authController.TokenSource) bool {
+	if source == authController.TokenSourceAPIKey {
+		return authenticateAPIKey(c, db, token)
+	}
+
+	validToken, err := authController.ValidateToken(token)
+	if err != nil || !validToken.Valid {
+		c.JSON(401, gin.H{"error": "Invalid or expired token", "details": errorDetails(err)})
+		c.Abort()
+		return false
+	}
+
+	claims, ok := validToken.Claims.(*schemas.TokenClaims)
+	if !ok {
+		c.JSON(401, gin.H{"error": "Invalid token claims"})
+		c.Abort()
+		return false
+	}
+
+	if !checkNotRevoked(c, db, claims) {
+		return false
+	}
+	if !checkTokenUser(c, db, claims.Payload) {
+		return false
+	}
+
+	if source == authController.TokenSourceCookie && !authController.CheckCookieOrigin(c) {
+		c.JSON(403, gin.H{"error": "Cross-site request rejected"})
+		c.Abort()
+		return false
+	}
+
+	authController.TouchSession(c, db, claims)
+
+	user := (&claims.Payload).ExtractUser()
+	c.Set("user", user)
+	c.Set("token_claims", claims)
+	c.Set("auth_source", source)
+	return true
+}
+
+// authenticateAPIKey accepts a personal API key on routes that declared an APIKeyScope
+// the key was granted, every other route rejects API keys
+func authenticateAPIKey(c *gin.Context, db *gorm.DB, token string) bool {
+	key, user, err := authController.ResolveAPIKey(db, token)
+	if errors.Is(err, authController.ErrUserDisabled) {
+		c.JSON(403, gin.H{"error": "Account is disabled"})
+		c.Abort()
+		return false
+	}
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid API key", "details": err.Error()})
+		c.Abort()
+		return false
+	}
+
+	resource := c.GetString(apiKeyResourceKey)
+	if resource == "" {
+		c.JSON(403, gin.H{"error": "API keys are not accepted for this endpoint"})
+		c.Abort()
+		return false
+	}
+	scope := authController.APIKeyScopeFor(resource, c.Request.Method)
+	if !slices.Contains(key.ScopeList(), scope) {
+		c.JSON(403, gin.H{"error": "API key scope required", "details": scope})
+		c.Abort()
+		return false
+	}
+
+	c.Set("user", user)
+	c.Set("auth_source", authController.TokenSourceAPIKey)
+	return true
+}
+
+func errorDetails(err error) string {
+	if err == nil {
+		return "token is not valid"
+	}
+	return err.Error()
+}
+
+// AdminRequired rejects users whose role lacks admin:access, use it after AuthRequired
+func AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !policy.Can(c, policy.AdminAccess) {
+			c.JSON(403, gin.H{"error": "Admin role required"})
 			c.Abort()
 			return
 		}
 
-		claims, ok := validToken.Claims.(*schemas.TokenClaims)
-		if !ok {
-			// Invalid claims, continue without setting user
-			c.JSON(401, gin.H{"error": "Invalid token claims"})
+		// Roles listed in MFA_REQUIRED_ROLES must have logged in with a second factor
+		value, _ := c.Get("token_claims")
+		if claims, ok := value.(*schemas.TokenClaims); !ok || !authController.MFASatisfied(claims) {
+			c.JSON(403, gin.H{"error": "MFA required for this role"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// VerifiedEmailRequired rejects users that did not verify their email yet. Admins are exempt,
+// and so are guest accounts, which have no email, are deleted when they expire and can only
+// create GUEST_MAX_REURLS reurls. Use it after AuthRequired.
+func VerifiedEmailRequired(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if utils.IsAdminUser(c) {
+			c.Next()
+			return
+		}
+		guest, err := authController.IsGuest(db, utils.GetUserID(c))
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to check email verification", "details": err.Error()})
 			c.Abort()
 			return
 		}
+		if guest {
+			c.Next()
+			return
+		}
 
-		user := (&claims.Payload).ExtractUser()
-		c.Set("user", user)
+		verified, err := authController.IsEmailVerified(db, utils.GetUserID(c))
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Failed to check email verification", "details": err.Error()})
+			c.Abort()
+			return
+		}
+		if !verified {
+			c.JSON(403, gin.H{"error": "Email verification required"})
+			c.Abort()
+			return
+		}
 
 		c.Next()
 	}
 }
+
+// checkNotRevoked aborts the request when the token is on the revocation list
+func checkNotRevoked(c *gin.Context, db *gorm.DB, claims *schemas.TokenClaims) bool {
+	revoked, err := authController.IsTokenRevoked(db, claims)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Failed to check token revocation", "details": err.Error()})
+		c.Abort()
+		return false
+	}
+	if revoked {
+		c.JSON(401, gin.H{"error": "Token has been revoked"})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+// checkTokenUser aborts the request when the user was disabled or deleted, or changed
+// since the token was issued
+func checkTokenUser(c *gin.Context, db *gorm.DB, payload schemas.TokenPayload) bool {
+	err := authController.CheckTokenUser(db, payload)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, authController.ErrUserDisabled):
+		c.JSON(403, gin.H{"error": "Account is disabled"})
+	case errors.Is(err, authController.ErrUserNotFound):
+		c.JSON(401, gin.H{"error": "User not found"})
+	case errors.Is(err, authController.ErrTokenOutdated):
+		c.JSON(401, gin.H{"error": "Token is outdated, please refresh it"})
+	default:
+		c.JSON(500, gin.H{"error": "Failed to check user status", "details": err.Error()})
+	}
+	c.Abort()
+	return false
+}
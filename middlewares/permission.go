@@ -0,0 +1,25 @@
+package middlewares
+
+import (
+	"personal_site/controllers/utils"
+	"personal_site/policy"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission rejects users whose role is not granted p, use it after AuthRequired.
+// For permissions on owned records the role needs p on any or on own records; the handler
+// then calls policy.AuthorizeOwner once it knows the owner.
+func RequirePermission(p policy.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := utils.GetTokenUser(c)
+		if err != nil || !policy.Allows(user.Role, p) {
+			c.JSON(403, gin.H{"error": "Permission required", "details": string(p)})
+			c.Abort()
+			return
+		}
+
+		policy.Require(c, p)
+		c.Next()
+	}
+}
@@ -0,0 +1,17 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+const apiKeyResourceKey = "api_key_resource"
+
+// APIKeyScope declares the resource of a route group, e.g. "storage". Personal API keys
+// are only accepted on declared routes and need "<resource>:read" for safe methods and
+// "<resource>:write" for the others. Register it before AuthRequired or AuthOptional.
+func APIKeyScope(resource string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(apiKeyResourceKey, resource)
+		c.Next()
+	}
+}
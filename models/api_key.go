@@ -0,0 +1,32 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKey is a long-lived personal access key for automation. The key is shown once on
+// creation, only its hash is stored; Prefix is the public part used to find and recognize it.
+type APIKey struct {
+	gorm.Model `gorm:"embedded"`
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"size:64;not null"`
+	Prefix     string `gorm:"size:16;not null;uniqueIndex"`
+	SecretHash string `gorm:"size:64;not null"`  // sha256 of the whole key
+	Scopes     string `gorm:"size:256;not null"` // space separated, e.g. "storage:read reurl:write"
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time `gorm:"index"`
+}
+
+// ScopeList returns the scopes of the key
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// IsActive reports whether the key can still be used
+func (k *APIKey) IsActive() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt))
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// AuditEvent is one entry of the audit trail. ActorID is the user who acted (nil when
+// anonymous), TargetUserID the user the action was applied to, if any. Outcome is
+// "success", "failure" or "denied".
+type AuditEvent struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+	ActorID      *uint     `gorm:"index" json:"actor_id"`
+	TargetUserID *uint     `gorm:"index" json:"target_user_id"`
+	Action       string    `gorm:"size:64;not null;index" json:"action"` // e.g. "auth.login", "admin.user.disable"
+	Outcome      string    `gorm:"size:16;not null;default:success;index" json:"outcome"`
+	Details      string    `gorm:"size:1024" json:"details"` // JSON object
+	IP           string    `gorm:"size:64" json:"ip"`
+	UserAgent    string    `gorm:"size:256" json:"user_agent"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"gorm.io/gorm"
+)
+
+// Identity is an external login (GitHub, Google, LINE, ...) linked to a user.
+// A user can have many identities, each provider account belongs to one user.
+type Identity struct {
+	gorm.Model `gorm:"embedded"`
+	UserID     uint         `gorm:"not null;index"`
+	Provider   AuthProvider `gorm:"size:16;not null;uniqueIndex:uni_identity_provider_subject"`
+	Subject    string       `gorm:"size:256;not null;uniqueIndex:uni_identity_provider_subject"` // provider user id
+	Email      string       `gorm:"size:128"`                                                    // email reported by the provider
+}
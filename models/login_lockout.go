@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// LoginLockout records every time an account or IP address was locked out after too many
+// failed logins, so attacks can be reviewed later. Subject is the email or the IP address.
+type LoginLockout struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Kind        string     `gorm:"size:16;not null;index:idx_login_lockout_subject" json:"kind"` // "account" or "ip"
+	Subject     string     `gorm:"size:128;not null;index:idx_login_lockout_subject" json:"subject"`
+	UserID      *uint      `gorm:"index" json:"user_id"` // the locked account, when it exists
+	IP          string     `gorm:"size:64" json:"ip"`    // address of the attempt that caused the lockout
+	Failures    int        `gorm:"not null" json:"failures"`
+	LockedUntil time.Time  `gorm:"not null" json:"locked_until"`
+	UnlockedAt  *time.Time `json:"unlocked_at"`
+	UnlockedBy  *uint      `json:"unlocked_by"` // admin user id
+}
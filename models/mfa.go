@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TOTPCredential is the RFC 6238 authenticator of a user. It is only enforced
+// on login once ConfirmedAt is set.
+type TOTPCredential struct {
+	gorm.Model   `gorm:"embedded"`
+	UserID       uint   `gorm:"not null;uniqueIndex"`
+	Secret       string `gorm:"size:64;not null"` // base32 encoded shared secret
+	ConfirmedAt  *time.Time
+	LastUsedStep int64 // time step of the last accepted code, a code can only be used once
+}
+
+// RecoveryCode is a single-use fallback code for a user with TOTP, only its hash is stored
+type RecoveryCode struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"size:64;not null;index"`
+	UsedAt    *time.Time
+}
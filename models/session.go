@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Session represents one login of a user and owns the refresh token of that login.
+// PublicID is shared by the refresh token and the `sid` claim of the access tokens,
+// TokenID is the `jti` of the latest access token issued for this session.
+type Session struct {
+	gorm.Model       `gorm:"embedded"`
+	UserID           uint       `gorm:"not null;index"`
+	PublicID         string     `gorm:"size:64;not null;uniqueIndex"`
+	TokenID          string     `gorm:"size:64;not null;index"`
+	RefreshTokenHash string     `gorm:"size:64;not null;index"` // sha256 of the current refresh token secret
+	AuthMethods      string     `gorm:"size:64"`                // space separated amr values of the login
+	ExpiresAt        time.Time  `gorm:"not null"`
+	RevokedAt        *time.Time `gorm:"index"`
+	RevokeReason     string     `gorm:"size:32"`
+	UserAgent        string     `gorm:"size:256"` // device of the login
+	IP               string     `gorm:"size:64"`  // client IP of the latest request
+	LastSeenAt       *time.Time // latest request or refresh, updated at most once a minute
+}
+
+// IsActive reports whether the session can still be refreshed
+func (s *Session) IsActive() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
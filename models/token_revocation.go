@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// RevokedToken is an access token (by its jti) that must not be accepted anymore.
+// Rows can be pruned once ExpiresAt has passed since the token is expired anyway.
+type RevokedToken struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	TokenID   string    `gorm:"size:64;not null;uniqueIndex"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	Reason    string    `gorm:"size:64"`
+}
+
+// UserTokenRevocation rejects every token of a user issued before RevokedBefore
+type UserTokenRevocation struct {
+	UserID        uint      `gorm:"primaryKey;autoIncrement:false"`
+	RevokedBefore time.Time `gorm:"not null"`
+	UpdatedAt     time.Time
+}
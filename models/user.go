@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -30,24 +32,75 @@ const (
 	AuthProviderGitHub   AuthProvider = "github"
 	AuthProviderGoogle   AuthProvider = "google"
 	AuthProviderLine     AuthProvider = "line"
+	AuthProviderPasskey  AuthProvider = "passkey" // WebAuthn only, Identifier is the user handle
+	AuthProviderEmail    AuthProvider = "email"   // magic link only, Identifier is empty
+	AuthProviderGuest    AuthProvider = "guest"   // guest account, Email is a placeholder and Identifier is empty
 )
 
+// extraAuthProviders are the OpenID Connect providers added from configuration
+var (
+	extraAuthProviders   = map[AuthProvider]bool{}
+	extraAuthProvidersMu sync.RWMutex
+)
+
+// RegisterAuthProvider makes a provider configured at runtime valid
+func RegisterAuthProvider(a AuthProvider) {
+	extraAuthProvidersMu.Lock()
+	extraAuthProviders[a] = true
+	extraAuthProvidersMu.Unlock()
+}
+
 func (a AuthProvider) IsValid() bool {
 	switch a {
-	case AuthProviderPassword, AuthProviderGitHub, AuthProviderGoogle, AuthProviderLine:
+	case AuthProviderPassword, AuthProviderGitHub, AuthProviderGoogle, AuthProviderLine, AuthProviderPasskey, AuthProviderEmail, AuthProviderGuest:
 		return true
-	default:
-		return false
 	}
+	extraAuthProvidersMu.RLock()
+	defer extraAuthProvidersMu.RUnlock()
+	return extraAuthProviders[a]
+}
+
+// IsLocal reports whether the provider is handled by this site instead of an OAuth provider
+func (a AuthProvider) IsLocal() bool {
+	switch a {
+	case AuthProviderPassword, AuthProviderPasskey, AuthProviderEmail, AuthProviderGuest:
+		return true
+	}
+	return false
 }
 
 type User struct {
-	gorm.Model `gorm:"embedded"` // ID, CreatedAt, UpdatedAt
-	Nickname   string            `gorm:"size:64;not null"`
-	Role       Role              `gorm:"size:32;not null"`
-	Provider   AuthProvider      `gorm:"size:16;not null;index:,unique,composite:uni_provider_email"`
-	Email      string            `gorm:"size:128;not null;index:,unique,composite:uni_provider_email"`
-	Identifier string            `gorm:"size:256;not null;index"` // hashed password, or provider id
+	gorm.Model      `gorm:"embedded"` // ID, CreatedAt, UpdatedAt
+	Nickname        string            `gorm:"size:64;not null"`
+	Role            Role              `gorm:"size:32;not null"`
+	Provider        AuthProvider      `gorm:"size:16;not null;index:,unique,composite:uni_provider_email"`
+	Email           string            `gorm:"size:128;not null;index:,unique,composite:uni_provider_email"`
+	Identifier      string            `gorm:"size:256;not null;index"` // hashed password, or provider id
+	EmailVerifiedAt *time.Time        // nil until the user proved they own Email
+	DisabledAt      *time.Time        // set by an admin, disabled users cannot log in
+	TokenVersion    uint              `gorm:"not null;default:0"` // security stamp, access tokens of an older version are rejected
+	ExpiresAt       *time.Time        `gorm:"index"`              // guests only, the account and its data are deleted after this
+}
+
+// IsEmailVerified reports whether the user verified the email address
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// IsDisabled reports whether an admin disabled the user
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
+// IsGuest reports whether the user is a guest account: the guest provider and an expiry.
+// The guest role alone does not make one, it is only the permissions.
+func (u *User) IsGuest() bool {
+	return u.Provider == AuthProviderGuest && u.ExpiresAt != nil
+}
+
+// IsExpired reports whether the guest account outlived its ExpiresAt
+func (u *User) IsExpired() bool {
+	return u.IsGuest() && time.Now().After(*u.ExpiresAt)
 }
 
 func (u *User) BeforeSave(tx *gorm.DB) (err error) {
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// WebAuthnCredential is a passkey of a user. Credential ids can be up to 1023 bytes, so they
+// are looked up by CredentialIDHash. UserHandle is the WebAuthn user.id, every passkey of a
+// user shares it.
+type WebAuthnCredential struct {
+	gorm.Model       `gorm:"embedded"`
+	UserID           uint   `gorm:"not null;index"`
+	Name             string `gorm:"size:64;not null"`
+	CredentialID     string `gorm:"size:1400;not null"`           // base64url
+	CredentialIDHash string `gorm:"size:64;not null;uniqueIndex"` // sha256 hex of the raw id
+	UserHandle       []byte `gorm:"size:64;not null"`             // random, never the user id
+	PublicKey        []byte `gorm:"size:1024;not null"`           // COSE_Key
+	SignCount        uint32 `gorm:"not null;default:0"`           // 0 when the authenticator has no counter
+	AAGUID           string `gorm:"size:36"`                      // authenticator model, zero for attestation "none"
+	Transports       string `gorm:"size:128"`                     // space separated hints, e.g. "internal hybrid"
+	BackupEligible   bool   `gorm:"not null;default:false"`       // synced passkey
+	BackedUp         bool   `gorm:"not null;default:false"`
+	LastUsedAt       *time.Time
+}
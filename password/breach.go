@@ -0,0 +1,59 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// prefixLength is how many hex digits of the hash name a prefix file
+const prefixLength = 5
+
+// BreachList tells how often a password was seen in known data breaches
+type BreachList interface {
+	Count(password string) (int, error)
+}
+
+// PrefixDir is a BreachList stored on disk in the k-anonymity range format of Pwned Passwords:
+// the SHA-1 hash of a password is looked up in the file named after its first five hex digits,
+// e.g. 5BAA6.txt, which has a "SUFFIX:COUNT" line for every hash with that prefix.
+// Missing files count as empty, so a partial download only checks fewer passwords.
+type PrefixDir string
+
+func (d PrefixDir) Count(password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+
+	file, err := os.Open(filepath.Join(string(d), prefix+".txt"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+		if !found {
+			return 1, nil
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	return 0, scanner.Err()
+}
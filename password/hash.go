@@ -0,0 +1,176 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"personal_site/config"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher creates and checks password hashes of one algorithm. A hash names its algorithm and
+// parameters (e.g. "$argon2id$v=19$m=19456,t=2,p=1$..." or "$2a$10$..." for bcrypt), so hashes
+// of older algorithms and parameters keep working next to new ones.
+type Hasher interface {
+	Hash(password string) (string, error)
+	// Identifies reports whether hash was made by the algorithm of the hasher
+	Identifies(hash string) bool
+	// Verify reports whether password matches hash, with the parameters stored in hash
+	Verify(password, hash string) bool
+	// Outdated reports whether hash was made with other parameters than the hasher's
+	Outdated(hash string) bool
+}
+
+// Argon2id hashes in the PHC string format. Memory is in KiB.
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2idPrefix    = "$argon2id$"
+	argon2idSaltSize  = 16
+	argon2idKeyLength = 32
+)
+
+var errInvalidArgon2idHash = errors.New("invalid argon2id hash")
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, argon2idKeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2id) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, argon2idPrefix)
+}
+
+func (a Argon2id) Verify(password, hash string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+func (a Argon2id) Outdated(hash string) bool {
+	params, _, key, err := parseArgon2id(hash)
+	return err != nil || params != a || len(key) != argon2idKeyLength
+}
+
+// parseArgon2id splits "$argon2id$v=19$m=..,t=..,p=..$salt$key"
+func parseArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return params, nil, nil, errInvalidArgon2idHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, errInvalidArgon2idHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidArgon2idHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return params, nil, nil, errInvalidArgon2idHash
+	}
+	return params, salt, key, nil
+}
+
+// Bcrypt hashes with golang.org/x/crypto/bcrypt, which only uses the first 72 bytes of a password
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b Bcrypt) Identifies(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (b Bcrypt) Verify(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (b Bcrypt) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != b.Cost
+}
+
+// Hash hashes password with the current hasher, see CurrentHasher
+func Hash(password string) (string, error) {
+	return CurrentHasher().Hash(password)
+}
+
+// Verify checks password against a hash of any supported algorithm. needsRehash is true when
+// the password matches but the hash is not one the current hasher would make, the caller
+// should then store Hash(password) instead.
+func Verify(password, hash string) (match bool, needsRehash bool) {
+	current := CurrentHasher()
+	for _, hasher := range []Hasher{Argon2id{}, Bcrypt{}} {
+		if !hasher.Identifies(hash) {
+			continue
+		}
+		if !hasher.Verify(password, hash) {
+			return false, false
+		}
+		return true, !current.Identifies(hash) || current.Outdated(hash)
+	}
+	return false, false
+}
+
+// CurrentHasher returns the hasher for new hashes from the environment:
+//
+//	PASSWORD_HASH_ALGORITHM      argon2id (default) or bcrypt
+//	PASSWORD_ARGON2_MEMORY       in KiB, default 19456 (19 MiB)
+//	PASSWORD_ARGON2_ITERATIONS   default 2
+//	PASSWORD_ARGON2_PARALLELISM  default 1
+//	PASSWORD_BCRYPT_COST         default 10
+func CurrentHasher() Hasher {
+	algorithm, _ := config.GetVariableAsString("PASSWORD_HASH_ALGORITHM")
+	switch algorithm {
+	case "bcrypt":
+		hasher := Bcrypt{Cost: bcrypt.DefaultCost}
+		if n, err := config.GetVariableAsInt("PASSWORD_BCRYPT_COST"); err == nil && n >= bcrypt.MinCost && n <= bcrypt.MaxCost {
+			hasher.Cost = n
+		}
+		return hasher
+	case "", "argon2id":
+	default:
+		log.Println("[password] unknown PASSWORD_HASH_ALGORITHM, using argon2id:", algorithm)
+	}
+
+	// The minimum recommended by OWASP for argon2id
+	hasher := Argon2id{Memory: 19 * 1024, Iterations: 2, Parallelism: 1}
+	if n, err := config.GetVariableAsInt("PASSWORD_ARGON2_MEMORY"); err == nil && n > 0 {
+		hasher.Memory = uint32(n)
+	}
+	if n, err := config.GetVariableAsInt("PASSWORD_ARGON2_ITERATIONS"); err == nil && n > 0 {
+		hasher.Iterations = uint32(n)
+	}
+	if n, err := config.GetVariableAsInt("PASSWORD_ARGON2_PARALLELISM"); err == nil && n > 0 && n <= 255 {
+		hasher.Parallelism = uint8(n)
+	}
+	return hasher
+}
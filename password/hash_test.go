@@ -0,0 +1,67 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestArgon2id(t *testing.T) {
+	hasher := Argon2id{Memory: 1024, Iterations: 1, Parallelism: 1}
+	hash, err := hasher.Hash("correct horse")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$"), hash)
+
+	other, err := hasher.Hash("correct horse")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other, "Every hash has its own salt")
+
+	assert.True(t, hasher.Identifies(hash))
+	assert.True(t, hasher.Verify("correct horse", hash))
+	assert.False(t, hasher.Verify("battery staple", hash))
+	assert.False(t, hasher.Outdated(hash))
+
+	stronger := Argon2id{Memory: 2048, Iterations: 1, Parallelism: 1}
+	assert.True(t, stronger.Verify("correct horse", hash), "The parameters of the hash are used")
+	assert.True(t, stronger.Outdated(hash))
+
+	assert.False(t, hasher.Verify("correct horse", "$argon2id$v=19$m=1024,t=1,p=1$broken"))
+}
+
+func TestBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	hasher := Bcrypt{Cost: bcrypt.MinCost}
+	assert.True(t, hasher.Identifies(string(hash)))
+	assert.True(t, hasher.Verify("correct horse", string(hash)))
+	assert.False(t, hasher.Verify("battery staple", string(hash)))
+	assert.False(t, hasher.Outdated(string(hash)))
+	assert.True(t, Bcrypt{Cost: bcrypt.MinCost + 1}.Outdated(string(hash)))
+}
+
+func TestVerify(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	require.NoError(t, err)
+	match, needsRehash := Verify("correct horse", string(legacy))
+	assert.True(t, match, "Existing bcrypt hashes keep working")
+	assert.True(t, needsRehash, "New hashes use argon2id by default")
+
+	match, needsRehash = Verify("battery staple", string(legacy))
+	assert.False(t, match)
+	assert.False(t, needsRehash)
+
+	hash, err := Hash("correct horse")
+	require.NoError(t, err)
+	match, needsRehash = Verify("correct horse", hash)
+	assert.True(t, match)
+	assert.False(t, needsRehash)
+
+	match, _ = Verify("correct horse", "")
+	assert.False(t, match)
+	match, _ = Verify("", "plain text")
+	assert.False(t, match)
+}
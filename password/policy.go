@@ -0,0 +1,196 @@
+package password
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"personal_site/config"
+)
+
+// Class is a kind of character a policy can require
+type Class string
+
+const (
+	ClassLower  Class = "lower"
+	ClassUpper  Class = "upper"
+	ClassDigit  Class = "digit"
+	ClassSymbol Class = "symbol"
+)
+
+// Rules reported in a Violation
+const (
+	RuleMinLength    = "min_length"
+	RuleMaxLength    = "max_length"
+	RuleClass        = "character_class"
+	RulePersonalInfo = "personal_info"
+	RuleBreached     = "breached"
+)
+
+// Personal info shorter than this is too common to reject, e.g. a nickname "ab"
+const minPersonalInfoLength = 3
+
+// Violation is one rule a password breaks
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule a password breaks
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+	return "password does not meet the policy: " + strings.Join(messages, "; ")
+}
+
+// Policy is what a new password has to meet. Passwords that are already set are not
+// checked again, so a stricter policy only applies to the next change.
+type Policy struct {
+	MinLength          int     // in characters
+	MaxLength          int     // in bytes, 0 for no limit
+	RequiredClasses    []Class // every class needs at least one character
+	RejectPersonalInfo bool    // the password may not contain the email or nickname
+	Breaches           BreachList
+	BreachThreshold    int // rejected when seen in at least this many breaches
+}
+
+// User is the account a password is checked for
+type User struct {
+	Email    string
+	Nickname string
+}
+
+// Check returns a *PolicyError with every rule password breaks, nil when it meets the policy
+func (p Policy) Check(password string, user User) error {
+	var violations []Violation
+	add := func(rule, format string, args ...any) {
+		violations = append(violations, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		add(RuleMinLength, "Password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		add(RuleMaxLength, "Password must be at most %d bytes long", p.MaxLength)
+	}
+	for _, class := range p.RequiredClasses {
+		if !strings.ContainsFunc(password, class.matches) {
+			add(RuleClass, "Password must contain a %s character", class.describe())
+		}
+	}
+	if p.RejectPersonalInfo {
+		if part := personalInfoIn(password, user); part != "" {
+			add(RulePersonalInfo, "Password must not contain your %s", part)
+		}
+	}
+	if p.Breaches != nil {
+		count, err := p.Breaches.Count(password)
+		if err != nil {
+			// The list is a safeguard, a broken list should not stop users from setting a password
+			log.Println("[password] breach list error:", err)
+		} else if count >= max(p.BreachThreshold, 1) {
+			add(RuleBreached, "Password has appeared in a data breach, choose another one")
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// personalInfoIn returns which personal info of user password contains, "" for none
+func personalInfoIn(password string, user User) string {
+	password = strings.ToLower(password)
+	contains := func(s string) bool {
+		s = strings.ToLower(strings.TrimSpace(s))
+		return utf8.RuneCountInString(s) >= minPersonalInfoLength && strings.Contains(password, s)
+	}
+
+	localPart, _, _ := strings.Cut(user.Email, "@")
+	if contains(localPart) {
+		return "email"
+	}
+	if contains(user.Nickname) {
+		return "nickname"
+	}
+	return ""
+}
+
+func (c Class) matches(r rune) bool {
+	switch c {
+	case ClassLower:
+		return unicode.IsLower(r)
+	case ClassUpper:
+		return unicode.IsUpper(r)
+	case ClassDigit:
+		return unicode.IsDigit(r)
+	case ClassSymbol:
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+	}
+	return false
+}
+
+func (c Class) describe() string {
+	switch c {
+	case ClassLower:
+		return "lowercase"
+	case ClassUpper:
+		return "uppercase"
+	}
+	return string(c)
+}
+
+// FromConfig builds the policy from the environment:
+//
+//	PASSWORD_MIN_LENGTH            default 8
+//	PASSWORD_MAX_LENGTH            default 72, the most bcrypt can hash
+//	PASSWORD_REQUIRED_CLASSES      comma separated lower, upper, digit, symbol; default none
+//	PASSWORD_REJECT_PERSONAL_INFO  default true
+//	PASSWORD_BREACH_DIR            directory of breached password prefix files, see PrefixDir; unset disables the check
+//	PASSWORD_BREACH_THRESHOLD      default 1
+func FromConfig() Policy {
+	policy := Policy{
+		MinLength:          8,
+		MaxLength:          72,
+		RejectPersonalInfo: true,
+		BreachThreshold:    1,
+	}
+
+	if n, err := config.GetVariableAsInt("PASSWORD_MIN_LENGTH"); err == nil {
+		policy.MinLength = n
+	}
+	if n, err := config.GetVariableAsInt("PASSWORD_MAX_LENGTH"); err == nil {
+		policy.MaxLength = n
+	}
+	if value, err := config.GetVariableAsString("PASSWORD_REQUIRED_CLASSES"); err == nil {
+		for _, name := range strings.Split(value, ",") {
+			class := Class(strings.ToLower(strings.TrimSpace(name)))
+			switch class {
+			case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+				policy.RequiredClasses = append(policy.RequiredClasses, class)
+			case "":
+			default:
+				log.Println("[password] unknown class in PASSWORD_REQUIRED_CLASSES:", name)
+			}
+		}
+	}
+	if value, err := config.GetVariableAsString("PASSWORD_REJECT_PERSONAL_INFO"); err == nil {
+		policy.RejectPersonalInfo = value != "false"
+	}
+	if dir, err := config.GetVariableAsString("PASSWORD_BREACH_DIR"); err == nil {
+		policy.Breaches = PrefixDir(dir)
+	}
+	if n, err := config.GetVariableAsInt("PASSWORD_BREACH_THRESHOLD"); err == nil {
+		policy.BreachThreshold = n
+	}
+	return policy
+}
@@ -0,0 +1,63 @@
+package password
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func rules(err error) []string {
+	var result []string
+	if policyErr, ok := err.(*PolicyError); ok {
+		for _, v := range policyErr.Violations {
+			result = append(result, v.Rule)
+		}
+	}
+	return result
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := Policy{
+		MinLength:          10,
+		MaxLength:          20,
+		RequiredClasses:    []Class{ClassUpper, ClassDigit, ClassSymbol},
+		RejectPersonalInfo: true,
+	}
+	user := User{Email: "alice.smith@example.com", Nickname: "wonderland"}
+
+	assert.NoError(t, policy.Check("Correct-Horse-9", user))
+	assert.Equal(t, []string{RuleMinLength, RuleClass, RuleClass, RuleClass}, rules(policy.Check("short", user)))
+	assert.Equal(t, []string{RuleMaxLength}, rules(policy.Check(strings.Repeat("Aa1!", 6), user)))
+	assert.Equal(t, []string{RuleMinLength}, rules(policy.Check("Ünïcødé-9", user)), "Length is counted in characters")
+
+	assert.Equal(t, []string{RulePersonalInfo}, rules(policy.Check("X-Alice.Smith-1", user)))
+	assert.Equal(t, []string{RulePersonalInfo}, rules(policy.Check("WONDERLAND-2024", user)))
+	assert.NoError(t, policy.Check("Kb-9-ab-x-yz", User{Nickname: "ab"}), "Short personal info is ignored")
+}
+
+func TestPrefixDir(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("hunter2hunter2"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	lines := "0000000000000000000000000000000000A:0\n" + strings.ToLower(hash[5:]) + ":42\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(lines), 0o644))
+
+	count, err := PrefixDir(dir).Count("hunter2hunter2")
+	require.NoError(t, err)
+	assert.Equal(t, 42, count)
+
+	count, err = PrefixDir(dir).Count("not in the list")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count, "Missing prefix files count as empty")
+
+	policy := Policy{Breaches: PrefixDir(dir), BreachThreshold: 1}
+	assert.Equal(t, []string{RuleBreached}, rules(policy.Check("hunter2hunter2", User{})))
+	policy.BreachThreshold = 100
+	assert.NoError(t, policy.Check("hunter2hunter2", User{}))
+}
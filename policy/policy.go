@@ -0,0 +1,107 @@
+package policy
+
+import (
+	"net/http"
+	"slices"
+
+	"personal_site/controllers/utils"
+	"personal_site/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permission is "<resource>:<action>" for actions on a resource as a whole. Actions on
+// records that belong to a user are granted as "<resource>:<action>:any" (every record)
+// or "<resource>:<action>:own" (only records of the user), see Any and Own.
+type Permission string
+
+const (
+	ReurlCreate Permission = "reurl:create"
+	ReurlList   Permission = "reurl:list"
+	ReurlRead   Permission = "reurl:read"
+	ReurlUpdate Permission = "reurl:update"
+	ReurlDelete Permission = "reurl:delete"
+
+	AdminAccess   Permission = "admin:access"
+	UserManage    Permission = "user:manage"
+	TokenRevoke   Permission = "token:revoke"
+	LockoutManage Permission = "lockout:manage"
+	AuditRead     Permission = "audit:read"
+)
+
+// Any is the permission to act on every record
+func (p Permission) Any() Permission {
+	return p + ":any"
+}
+
+// Own is the permission to act on the records of the user
+func (p Permission) Own() Permission {
+	return p + ":own"
+}
+
+var ownUserPermissions = []Permission{
+	ReurlCreate,
+	ReurlList.Own(),
+	ReurlRead.Own(),
+	ReurlUpdate.Own(),
+	ReurlDelete.Own(),
+}
+
+var rolePermissions = map[models.Role][]Permission{
+	models.RoleAdmin: {
+		ReurlCreate,
+		ReurlList.Any(),
+		ReurlRead.Any(),
+		ReurlUpdate.Any(),
+		ReurlDelete.Any(),
+		AdminAccess,
+		UserManage,
+		TokenRevoke,
+		LockoutManage,
+		AuditRead,
+	},
+	models.RoleUser:  ownUserPermissions,
+	models.RoleGuest: ownUserPermissions,
+}
+
+// permissionKey is where RequirePermission leaves the permission for AuthorizeOwner
+const permissionKey = "permission"
+
+// Has reports whether role is granted exactly p
+func Has(role string, p Permission) bool {
+	return slices.Contains(rolePermissions[models.Role(role)], p)
+}
+
+// Allows reports whether role may perform p at all: p itself, or p on any or on own records
+func Allows(role string, p Permission) bool {
+	return Has(role, p) || Has(role, p.Any()) || Has(role, p.Own())
+}
+
+// Can reports whether the current user is granted exactly p
+func Can(c *gin.Context, p Permission) bool {
+	user, err := utils.GetTokenUser(c)
+	return err == nil && Has(user.Role, p)
+}
+
+// Require remembers p as the permission of the request, RequirePermission calls it once
+// the user is allowed to perform p
+func Require(c *gin.Context, p Permission) {
+	c.Set(permissionKey, p)
+}
+
+// AuthorizeOwner checks the permission declared by RequirePermission against a record owned
+// by ownerID. It answers 403 and returns false unless the user may act on any record, or
+// on own records and owns this one.
+func AuthorizeOwner(c *gin.Context, ownerID uint) bool {
+	user, err := utils.GetTokenUser(c)
+	value, _ := c.Get(permissionKey)
+	p, ok := value.(Permission)
+	if err == nil && ok {
+		if Has(user.Role, p.Any()) || (Has(user.Role, p.Own()) && ownerID == user.ID) {
+			return true
+		}
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{"error": "not allowed"})
+	return false
+}
@@ -0,0 +1,49 @@
+package policy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"personal_site/schemas"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, Has("admin", ReurlDelete.Any()))
+	assert.True(t, Has("user", ReurlDelete.Own()))
+	assert.False(t, Has("user", ReurlDelete.Any()))
+	assert.False(t, Has("user", ReurlDelete), "Owned actions are only granted as any or own")
+
+	assert.True(t, Allows("user", ReurlDelete))
+	assert.True(t, Allows("guest", ReurlCreate))
+	assert.False(t, Allows("user", UserManage))
+	assert.True(t, Has("admin", AuditRead))
+	assert.False(t, Allows("user", AuditRead))
+	assert.False(t, Allows("anonymous", ReurlRead))
+	assert.False(t, Allows("root", AdminAccess), "Unknown roles have no permissions")
+}
+
+func TestAuthorizeOwner(t *testing.T) {
+	authorize := func(role string, userID, ownerID uint) (bool, int) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("user", schemas.TokenUser{ID: userID, Role: role})
+		Require(c, ReurlUpdate)
+		return AuthorizeOwner(c, ownerID), w.Code
+	}
+
+	ok, _ := authorize("user", 1, 1)
+	assert.True(t, ok)
+	ok, code := authorize("user", 1, 2)
+	assert.False(t, ok)
+	assert.Equal(t, 403, code)
+	ok, _ = authorize("admin", 1, 2)
+	assert.True(t, ok)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("user", schemas.TokenUser{ID: 1, Role: "admin"})
+	assert.False(t, AuthorizeOwner(c, 1), "Nothing is allowed without a declared permission")
+}
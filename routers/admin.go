@@ -0,0 +1,65 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	adminController "personal_site/controllers/admin"
+	"personal_site/middlewares"
+	"personal_site/policy"
+)
+
+// adminRouter registers management endpoints, all of them require admin:access and each
+// group declares the permission it needs on top.
+// It declares no APIKeyScope, so personal API keys are rejected here.
+// Routes are mounted under the API prefix + `/admin`.
+type adminRouter struct{}
+
+func (adminRouter) RegisterRoutes(r *gin.RouterGroup, db *gorm.DB) {
+	r.Use(middlewares.AuthRequired(db), middlewares.AdminRequired())
+
+	// token revocation
+	tokens := r.Group("", middlewares.RequirePermission(policy.TokenRevoke))
+	tokens.POST("/tokens/revoke", func(c *gin.Context) {
+		adminController.RevokeToken(c, db)
+	})
+	tokens.POST("/users/:id/revoke-tokens", func(c *gin.Context) {
+		adminController.RevokeUserTokens(c, db)
+	})
+
+	// user management
+	users := r.Group("", middlewares.RequirePermission(policy.UserManage))
+	users.GET("/users", func(c *gin.Context) {
+		adminController.ListUsers(c, db)
+	})
+	users.GET("/users/:id", func(c *gin.Context) {
+		adminController.GetUser(c, db)
+	})
+	users.PATCH("/users/:id/role", func(c *gin.Context) {
+		adminController.ChangeUserRole(c, db)
+	})
+	users.POST("/users/:id/disable", func(c *gin.Context) {
+		adminController.DisableUser(c, db)
+	})
+	users.POST("/users/:id/enable", func(c *gin.Context) {
+		adminController.EnableUser(c, db)
+	})
+	users.DELETE("/users/:id", func(c *gin.Context) {
+		adminController.DeleteUser(c, db)
+	})
+
+	// login lockouts
+	lockouts := r.Group("", middlewares.RequirePermission(policy.LockoutManage))
+	lockouts.GET("/lockouts", func(c *gin.Context) {
+		adminController.ListLockouts(c, db)
+	})
+	lockouts.POST("/lockouts/unlock", func(c *gin.Context) {
+		adminController.UnlockLogin(c, db)
+	})
+
+	// audit trail
+	auditEvents := r.Group("", middlewares.RequirePermission(policy.AuditRead))
+	auditEvents.GET("/audit-events", func(c *gin.Context) {
+		adminController.ListAuditEvents(c, db)
+	})
+}
@@ -7,8 +7,10 @@ import (
 	"personal_site/apipaths"
 	authController "personal_site/controllers/auth"
 	"personal_site/middlewares"
+	"personal_site/models"
 )
 
+// authRouter declares no APIKeyScope, personal API keys cannot manage the account
 type authRouter struct{}
 
 func (a authRouter) RegisterRoutes(r *gin.RouterGroup, db *gorm.DB) {
@@ -20,27 +22,170 @@ func (a authRouter) RegisterRoutes(r *gin.RouterGroup, db *gorm.DB) {
 		authController.Login(c, db)
 	})
 
+	// Same as /login, but returns the tokens in the body for Bearer clients
+	r.POST("/token", func(c *gin.Context) {
+		authController.LoginForToken(c, db)
+	})
+
 	r.POST("/logout", func(c *gin.Context) {
-		authController.Logout(c)
+		authController.Logout(c, db)
+	})
+
+	r.POST("/refresh", func(c *gin.Context) {
+		authController.Refresh(c, db)
+	})
+
+	r.GET(apipaths.VerifyEmailRel, func(c *gin.Context) {
+		authController.VerifyEmail(c, db)
+	})
+	r.POST(apipaths.VerifyEmailRel+"/resend", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ResendVerificationEmail(c, db)
 	})
 
-	r.POST("/change-password", middlewares.AuthRequired(), func(c *gin.Context) {
+	r.POST("/forgot-password", func(c *gin.Context) {
+		authController.ForgotPassword(c, db)
+	})
+	r.POST(apipaths.ResetPasswordRel, func(c *gin.Context) {
+		authController.ResetPassword(c, db)
+	})
+
+	// Passwordless login by email
+	r.POST(apipaths.MagicLinkRel, func(c *gin.Context) {
+		authController.RequestMagicLink(c, db)
+	})
+	r.POST(apipaths.MagicLinkRel+"/verify", func(c *gin.Context) {
+		authController.MagicLinkLogin(c, db)
+	})
+
+	// Guest accounts, the guest data moves to another account with a merge token of the guest
+	r.POST("/guest", func(c *gin.Context) {
+		authController.CreateGuest(c, db)
+	})
+	r.POST("/guest/upgrade", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.UpgradeGuest(c, db)
+	})
+	r.POST("/guest/merge-token", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.StartGuestMerge(c, db)
+	})
+	r.POST("/guest/merge", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.MergeGuest(c, db)
+	})
+
+	r.POST("/change-password", middlewares.AuthRequired(db), func(c *gin.Context) {
 		authController.ChangePassword(c, db)
 	})
 
-	// GitHub OAuth
+	// Profile of the logged in user
+	r.GET("/me", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.GetMe(c, db)
+	})
+	r.PATCH("/me", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.UpdateMe(c, db)
+	})
+	r.DELETE("/me", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.DeleteMe(c, db)
+	})
+
+	// Devices the user is logged in on
+	r.GET("/sessions", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ListSessions(c, db)
+	})
+	r.DELETE("/sessions", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.SignOutOtherSessions(c, db)
+	})
+	r.DELETE("/sessions/:id", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.SignOutSession(c, db)
+	})
+
+	// TOTP two-factor authentication
+	r.POST("/mfa/totp/setup", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.SetupTOTP(c, db)
+	})
+	r.POST("/mfa/totp/confirm", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ConfirmTOTP(c, db)
+	})
+	r.POST("/mfa/totp/disable", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.DisableTOTP(c, db)
+	})
+	r.POST("/mfa/recovery-codes", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.RegenerateRecoveryCodes(c, db)
+	})
+	r.POST("/mfa/verify", func(c *gin.Context) {
+		authController.VerifyMFA(c, db)
+	})
+
+	// Linked accounts
+	r.GET("/identities", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ListIdentities(c, db)
+	})
+	r.DELETE("/identities/:id", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.UnlinkIdentity(c, db)
+	})
+	r.GET("/link/:provider", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.StartLink(c, db)
+	})
+	r.POST("/link/confirm", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ConfirmLink(c, db)
+	})
+
+	// Personal API keys
+	r.POST("/api-keys", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.CreateAPIKey(c, db)
+	})
+	r.GET("/api-keys", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ListAPIKeys(c, db)
+	})
+	r.DELETE("/api-keys/:id", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.RevokeAPIKey(c, db)
+	})
+
+	// Passkeys, registering while logged in adds a passkey to the account
+	r.POST("/passkey/register/begin", middlewares.AuthOptional(db), func(c *gin.Context) {
+		authController.BeginPasskeyRegistration(c, db)
+	})
+	r.POST("/passkey/register/finish", middlewares.AuthOptional(db), func(c *gin.Context) {
+		authController.FinishPasskeyRegistration(c, db)
+	})
+	r.POST("/passkey/login/begin", authController.BeginPasskeyLogin)
+	r.POST("/passkey/login/finish", func(c *gin.Context) {
+		authController.FinishPasskeyLogin(c, db)
+	})
+	r.GET("/passkeys", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.ListPasskeys(c, db)
+	})
+	r.PATCH("/passkeys/:id", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.RenamePasskey(c, db)
+	})
+	r.DELETE("/passkeys/:id", middlewares.AuthRequired(db), func(c *gin.Context) {
+		authController.DeletePasskey(c, db)
+	})
+
+	// OAuth and OpenID Connect login, every provider of the registry shares the handlers
+	r.GET("/providers", authController.ListOAuthProviders)
+	r.GET(apipaths.OIDCRel+"/:provider", func(c *gin.Context) {
+		authController.OAuthLoginStart(c, models.AuthProvider(c.Param("provider")))
+	})
+	r.GET(apipaths.OIDCRel+"/:provider/callback", func(c *gin.Context) {
+		authController.OAuthLoginCallback(c, db, models.AuthProvider(c.Param("provider")))
+	})
+
+	// GitHub, Google and LINE keep the paths their apps are registered with
 	r.GET(apipaths.GitHubLoginRel, func(c *gin.Context) {
-		authController.GitHubLoginStart(c)
+		authController.OAuthLoginStart(c, models.AuthProviderGitHub)
 	})
 	r.GET(apipaths.GitHubCallbackRel, func(c *gin.Context) {
-		authController.GitHubLoginCallback(c, db)
+		authController.OAuthLoginCallback(c, db, models.AuthProviderGitHub)
 	})
-
-	// Google OAuth
 	r.GET(apipaths.GoogleLoginRel, func(c *gin.Context) {
-		authController.GoogleLoginStart(c)
+		authController.OAuthLoginStart(c, models.AuthProviderGoogle)
 	})
 	r.GET(apipaths.GoogleCallbackRel, func(c *gin.Context) {
-		authController.GoogleLoginCallback(c, db)
+		authController.OAuthLoginCallback(c, db, models.AuthProviderGoogle)
+	})
+	r.GET(apipaths.LineLoginRel, func(c *gin.Context) {
+		authController.OAuthLoginStart(c, models.AuthProviderLine)
+	})
+	r.GET(apipaths.LineCallbackRel, func(c *gin.Context) {
+		authController.OAuthLoginCallback(c, db, models.AuthProviderLine)
 	})
 }
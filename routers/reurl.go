@@ -6,6 +6,7 @@ import (
 
     reurlController "personal_site/controllers/reurl"
     "personal_site/middlewares"
+    "personal_site/policy"
 )
 
 // reurlRouter registers RESTful endpoints to manage redirect mappings.
@@ -13,34 +14,36 @@ import (
 type reurlRouter struct{}
 
 func (reurlRouter) RegisterRoutes(r *gin.RouterGroup, db *gorm.DB) {
+    r.Use(middlewares.APIKeyScope("reurl"))
+
     // List all mappings
-    r.GET("/", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.GET("/", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlList), func(c *gin.Context) {
         reurlController.ListReurls(c, db)
     })
-    r.GET("", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.GET("", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlList), func(c *gin.Context) {
         reurlController.ListReurls(c, db)
     })
 
     // Create a new mapping (protected)
-    r.POST("/", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.POST("/", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlCreate), middlewares.VerifiedEmailRequired(db), func(c *gin.Context) {
         reurlController.CreateReurl(c, db)
     })
-    r.POST("", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.POST("", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlCreate), middlewares.VerifiedEmailRequired(db), func(c *gin.Context) {
         reurlController.CreateReurl(c, db)
     })
 
     // Get a mapping by ID
-    r.GET("/:id", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.GET("/:id", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlRead), func(c *gin.Context) {
         reurlController.GetReurl(c, db)
     })
 
     // Patch a mapping by ID (protected)
-    r.PATCH("/:id", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.PATCH("/:id", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlUpdate), func(c *gin.Context) {
         reurlController.PatchReurl(c, db)
     })
 
     // Delete a mapping by ID (protected)
-    r.DELETE("/:id", middlewares.AuthRequired(), func(c *gin.Context) {
+    r.DELETE("/:id", middlewares.AuthRequired(db), middlewares.RequirePermission(policy.ReurlDelete), func(c *gin.Context) {
         reurlController.DeleteReurl(c, db)
     })
 
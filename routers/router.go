@@ -1,19 +1,47 @@
 package routers
 
 import (
+	"log"
+	"strings"
+
+	"personal_site/apipaths"
 	"personal_site/config"
 	"personal_site/controllers"
+	authController "personal_site/controllers/auth"
 	"personal_site/middlewares"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
+// SetTrustedProxies makes r take the client IP from X-Forwarded-For or X-Real-IP only when the
+// request comes from one of TRUSTED_PROXIES (comma separated IPs or CIDRs). No proxy is
+// trusted when it is not set, so clients cannot choose the IP that login throttling,
+// sessions and the audit log see.
+func SetTrustedProxies(r *gin.Engine) error {
+	var proxies []string
+	if value, err := config.GetVariableAsString("TRUSTED_PROXIES"); err == nil {
+		for _, proxy := range strings.Split(value, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+	return r.SetTrustedProxies(proxies)
+}
+
 type Router interface {
 	RegisterRoutes(r *gin.RouterGroup, db *gorm.DB)
 }
 
 func RegisterRouters(r *gin.Engine, db *gorm.DB) {
+	if err := authController.LoadOAuthProviders(); err != nil {
+		log.Println("[OAuth] load providers error:", err)
+	}
+
+	// public keys for other services to verify our tokens
+	r.GET(apipaths.JWKSPath, authController.JWKS)
+
 	apiPathPrefix, _ := config.GetVariableAsString("API_PATH_PREFIX")
 	mainRouter := r.Group(apiPathPrefix)
 
@@ -29,7 +57,10 @@ func RegisterRouters(r *gin.Engine, db *gorm.DB) {
 	var reurlRouterVal Router = reurlRouter{}
 	reurlRouterVal.RegisterRoutes(mainRouter.Group("/reurl"), db)
 
-	mainRouter.GET("/get-yt-data-api-token", middlewares.AuthOptional(), func(c *gin.Context) {
+	var adminRouterVal Router = adminRouter{}
+	adminRouterVal.RegisterRoutes(mainRouter.Group("/admin"), db)
+
+	mainRouter.GET("/get-yt-data-api-token", middlewares.AuthOptional(db), func(c *gin.Context) {
 		controllers.GetYTDataAPIToken(c, db)
 	})
 }
@@ -11,7 +11,7 @@ import (
 type storageRouter struct{}
 
 func (s storageRouter) RegisterRoutes(r *gin.RouterGroup, db *gorm.DB) {
-	r.Use(middlewares.AuthOptional())
+	r.Use(middlewares.APIKeyScope("storage"), middlewares.AuthOptional(db))
 
 	// folder
 	r.POST("/folder/*folder_path", func(c *gin.Context) {
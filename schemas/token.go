@@ -2,6 +2,7 @@ package schemas
 
 import (
 	"personal_site/config"
+	"slices"
 	"strconv"
 	"time"
 
@@ -9,15 +10,29 @@ import (
 	"github.com/google/uuid"
 )
 
+func init() {
+	// Issue iat/nbf/exp with millisecond precision, so revoking every token of a user
+	// does not also reject a token issued later within the same second
+	jwt.TimePrecision = time.Millisecond
+}
+
+const (
+	TokenIssuer           = "https://後端.夢.台灣"
+	TokenAudienceFrontend = "https://夢.台灣"
+)
+
 type TokenClaims struct {
 	jwt.RegisteredClaims
-	Payload TokenPayload `json:"payload"`
+	SessionID   string       `json:"sid,omitempty"` // models.Session.PublicID the token was issued for
+	AuthMethods []string     `json:"amr,omitempty"` // how the user authenticated, e.g. "pwd", "mfa"
+	Payload     TokenPayload `json:"payload"`
 }
 
 type TokenPayload struct {
-	UserID   uint   `json:"user_id"`
-	Role     string `json:"role"`
-	Nickname string `json:"nickname"`
+	UserID       uint   `json:"user_id"`
+	Role         string `json:"role"`
+	Nickname     string `json:"nickname"`
+	TokenVersion uint   `json:"token_version,omitempty"` // models.User.TokenVersion when the token was issued
 }
 
 type TokenUser struct {
@@ -42,9 +57,9 @@ func NewTokenClaims[T interface{ ~string | ~uint }](sub T) *TokenClaims {
 	}
 	return &TokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
-			Issuer:    "https://後端.夢.台灣",
+			Issuer:    TokenIssuer,
 			Subject:   subject,
-			Audience:  []string{"https://夢.台灣", "https://後端.夢.台灣"},
+			Audience:  []string{TokenAudienceFrontend, TokenIssuer},
 			ExpiresAt: jwt.NewNumericDate(now.Add(exp)),
 			NotBefore: jwt.NewNumericDate(now),
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -53,6 +68,11 @@ func NewTokenClaims[T interface{ ~string | ~uint }](sub T) *TokenClaims {
 	}
 }
 
+// HasAuthMethod reports whether method is one of the amr values of the token
+func (t *TokenClaims) HasAuthMethod(method string) bool {
+	return slices.Contains(t.AuthMethods, method)
+}
+
 func (t *TokenPayload) ExtractUser() TokenUser {
 	return TokenUser{
 		ID:       t.UserID,
@@ -0,0 +1,26 @@
+package tasks
+
+import (
+	"log"
+	"time"
+
+	authController "personal_site/controllers/auth"
+
+	"gorm.io/gorm"
+)
+
+// ExpireGuestAccounts 每小時刪除超過 GUEST_ACCOUNT_TTL 的訪客帳號，連同其 reurl 與檔案
+func ExpireGuestAccounts(db *gorm.DB) {
+	go func() {
+		for {
+			removed, err := authController.DeleteExpiredGuests(db, time.Now())
+			if err != nil {
+				log.Println("[ExpireGuestAccounts] delete error:", err)
+			}
+			if removed > 0 {
+				log.Println("[ExpireGuestAccounts] removed:", removed)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package tasks
+
+import (
+	"log"
+	"time"
+
+	"personal_site/config"
+	"personal_site/models"
+
+	"gorm.io/gorm"
+)
+
+// defaultAuditRetention is how long audit events are kept when AUDIT_RETENTION is not set
+const defaultAuditRetention = 90 * 24 * time.Hour
+
+// PruneAuditEvents 每小時刪除超過 AUDIT_RETENTION 的 audit events，設為 0 則永久保存
+func PruneAuditEvents(db *gorm.DB) {
+	go func() {
+		for {
+			if _, err := pruneAuditEvents(db, time.Now()); err != nil {
+				log.Println("[PruneAuditEvents] delete error:", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// pruneAuditEvents deletes the events older than the retention at now and returns how many
+func pruneAuditEvents(db *gorm.DB, now time.Time) (int64, error) {
+	retention := auditRetention()
+	if retention <= 0 {
+		return 0, nil
+	}
+	result := db.Where("created_at < ?", now.Add(-retention)).Delete(&models.AuditEvent{})
+	if result.RowsAffected > 0 {
+		log.Println("[PruneAuditEvents] removed:", result.RowsAffected)
+	}
+	return result.RowsAffected, result.Error
+}
+
+func auditRetention() time.Duration {
+	if _, err := config.GetVariableAsString("AUDIT_RETENTION"); err != nil {
+		return defaultAuditRetention
+	}
+	retention, err := config.GetVariableAsTimeDuration("AUDIT_RETENTION")
+	if err != nil {
+		log.Println("[PruneAuditEvents] invalid AUDIT_RETENTION, using the default:", err)
+		return defaultAuditRetention
+	}
+	return retention
+}
@@ -0,0 +1,32 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	"personal_site/database"
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneAuditEvents(t *testing.T) {
+	t.Setenv("DATABASE_DSN", ":memory:")
+	db, err := database.InitDB()
+	require.NoError(t, err)
+
+	now := time.Now()
+	old := models.AuditEvent{Action: "auth.login", Outcome: "success", CreatedAt: now.Add(-defaultAuditRetention - time.Hour)}
+	recent := models.AuditEvent{Action: "auth.login", Outcome: "success", CreatedAt: now.Add(-defaultAuditRetention + time.Hour)}
+	require.NoError(t, db.Create(&old).Error)
+	require.NoError(t, db.Create(&recent).Error)
+
+	removed, err := pruneAuditEvents(db, now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), removed)
+
+	var ids []uint
+	db.Model(&models.AuditEvent{}).Pluck("id", &ids)
+	assert.Equal(t, []uint{recent.ID}, ids)
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	authController "personal_site/controllers/auth"
+	"personal_site/models"
+	"personal_site/schemas"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type adminUserList struct {
+	Users []struct {
+		ID         uint    `json:"id"`
+		Email      string  `json:"email"`
+		Role       string  `json:"role"`
+		DisabledAt *string `json:"disabled_at"`
+		DeletedAt  *string `json:"deleted_at"`
+	} `json:"users"`
+	Page     int   `json:"page"`
+	PageSize int   `json:"page_size"`
+	Total    int64 `json:"total"`
+}
+
+// freshTokenCookie issues a new access token for user, bypassing login
+func freshTokenCookie(t *testing.T, user models.User) *http.Cookie {
+	token, err := authController.GenerateToken(schemas.TokenPayload{
+		UserID:   user.ID,
+		Role:     string(user.Role),
+		Nickname: user.Nickname,
+	}, user.ID)
+	require.NoError(t, err)
+	return &http.Cookie{Name: "auth_token", Value: token}
+}
+
+func userPath(user models.User, suffix string) string {
+	return "/admin/users/" + strconv.FormatUint(uint64(user.ID), 10) + suffix
+}
+
+func countAuditEvents(action string, target uint) int64 {
+	var count int64
+	db.Model(&models.AuditEvent{}).Where("action = ? AND target_user_id = ?", action, target).Count(&count)
+	return count
+}
+
+func TestAdminUsers(t *testing.T) {
+	t.Run("List and search users", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "list-admin@example.com", models.RoleAdmin)
+		for _, email := range []string{"alice@example.com", "bob@example.com", "alina@example.org"} {
+			createUserWithToken(t, email, models.RoleUser)
+		}
+
+		w := request(http.MethodGet, "/admin/users?q=ali&page_size=1", "", "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var list adminUserList
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, int64(2), list.Total)
+		require.Len(t, list.Users, 1)
+		assert.Equal(t, "alice@example.com", list.Users[0].Email)
+
+		w = request(http.MethodGet, "/admin/users?q=ali&page_size=1&page=2", "", "", adminCookie, "")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Users, 1)
+		assert.Equal(t, "alina@example.org", list.Users[0].Email)
+
+		w = request(http.MethodGet, "/admin/users?role=admin", "", "", adminCookie, "")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Equal(t, int64(1), list.Total)
+
+		assert.Equal(t, 400, request(http.MethodGet, "/admin/users?page_size=1000", "", "", adminCookie, "").Code)
+		assert.Equal(t, 400, request(http.MethodGet, "/admin/users?status=unknown", "", "", adminCookie, "").Code)
+	})
+
+	t.Run("Only admins can manage users", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "plain@example.com", models.RoleUser)
+		assert.Equal(t, 403, request(http.MethodGet, "/admin/users", "", "", cookie, "").Code)
+		assert.Equal(t, 403, request(http.MethodPatch, userPath(user, "/role"), `{"role":"admin"}`, "", cookie, "").Code)
+	})
+
+	t.Run("Change role", func(t *testing.T) {
+		setup(t)
+
+		admin, adminCookie := createUserWithToken(t, "role-admin@example.com", models.RoleAdmin)
+		user, userCookie := createUserWithToken(t, "promote@example.com", models.RoleUser)
+
+		w := request(http.MethodPatch, userPath(user, "/role"), `{"role":"admin"}`, "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var updated models.User
+		require.NoError(t, db.First(&updated, user.ID).Error)
+		assert.Equal(t, models.RoleAdmin, updated.Role)
+		assert.Equal(t, int64(1), countAuditEvents("admin.user.role_change", user.ID))
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "", userCookie, "").Code,
+			"Tokens with the old role are revoked")
+
+		assert.Equal(t, 400, request(http.MethodPatch, userPath(user, "/role"), `{"role":"root"}`, "", adminCookie, "").Code)
+		assert.Equal(t, 409, request(http.MethodPatch, userPath(admin, "/role"), `{"role":"user"}`, "", adminCookie, "").Code,
+			"Admins cannot demote themselves")
+		assert.Equal(t, 404, request(http.MethodPatch, "/admin/users/9999/role", `{"role":"user"}`, "", adminCookie, "").Code)
+
+		assert.Equal(t, 400, request(http.MethodPatch, userPath(user, "/role"), `{"role":"guest"}`, "", adminCookie, "").Code,
+			"The guest role belongs to guest accounts")
+		guest, _, _ := createGuest(t)
+		assert.Equal(t, 409, request(http.MethodPatch, userPath(guest, "/role"), `{"role":"admin"}`, "", adminCookie, "").Code,
+			"Guests upgrade instead of changing role")
+		var unchanged models.User
+		require.NoError(t, db.First(&unchanged, guest.ID).Error)
+		assert.Equal(t, models.RoleGuest, unchanged.Role)
+	})
+
+	t.Run("Disable and enable", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "disable-admin@example.com", models.RoleAdmin)
+		user, cookie := createUserWithToken(t, "disable@example.com", models.RoleUser)
+		apiKey := createAPIKey(t, cookie, "reurl:read").Key
+
+		w := request(http.MethodPost, userPath(user, "/disable"), `{"reason":"spam"}`, "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, int64(1), countAuditEvents("admin.user.disable", user.ID))
+		assert.Equal(t, 409, request(http.MethodPost, userPath(user, "/disable"), "", "", adminCookie, "").Code)
+
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "", cookie, "").Code, "Existing tokens are revoked")
+		time.Sleep(2 * time.Millisecond) // a token from the millisecond of the revocation counts as revoked
+		assert.Equal(t, 403, request(http.MethodGet, "/reurl", "", "", freshTokenCookie(t, user), "").Code,
+			"Tokens issued later are rejected too")
+		assert.Equal(t, 403, request(http.MethodGet, "/reurl", "", "Bearer "+apiKey, nil, "").Code)
+
+		w = request(http.MethodPost, "/auth/login", loginBody("disable@example.com", "password123"), "", nil, "")
+		assert.Equal(t, 403, w.Code)
+		assert.Contains(t, w.Body.String(), "Account is disabled")
+
+		w = request(http.MethodPost, userPath(user, "/enable"), "", "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, int64(1), countAuditEvents("admin.user.enable", user.ID))
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("disable@example.com", "password123"), "", nil, "").Code)
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "Bearer "+apiKey, nil, "").Code)
+	})
+
+	t.Run("Soft delete", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "delete-admin@example.com", models.RoleAdmin)
+		user, _ := createUserWithToken(t, "delete@example.com", models.RoleUser)
+
+		require.Equal(t, 200, request(http.MethodDelete, userPath(user, ""), "", "", adminCookie, "").Code)
+		assert.Equal(t, int64(1), countAuditEvents("admin.user.delete", user.ID))
+
+		var stored models.User
+		require.NoError(t, db.Unscoped().First(&stored, user.ID).Error, "The row is kept")
+		assert.True(t, stored.DeletedAt.Valid)
+
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("delete@example.com", "password123"), "", nil, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "", freshTokenCookie(t, user), "").Code)
+
+		var list adminUserList
+		w := request(http.MethodGet, "/admin/users?q=delete@", "", "", adminCookie, "")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		assert.Zero(t, list.Total, "Deleted users are hidden by default")
+
+		w = request(http.MethodGet, "/admin/users?status=deleted", "", "", adminCookie, "")
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		require.Len(t, list.Users, 1)
+		assert.NotNil(t, list.Users[0].DeletedAt)
+
+		assert.Equal(t, 200, request(http.MethodGet, userPath(user, ""), "", "", adminCookie, "").Code)
+		assert.Equal(t, 404, request(http.MethodDelete, userPath(user, ""), "", "", adminCookie, "").Code)
+	})
+}
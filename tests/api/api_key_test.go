@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type createdAPIKey struct {
+	Key    string `json:"key"`
+	APIKey struct {
+		ID         uint       `json:"id"`
+		Prefix     string     `json:"prefix"`
+		Scopes     []string   `json:"scopes"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	} `json:"api_key"`
+}
+
+func createAPIKey(t *testing.T, cookie *http.Cookie, scopes ...string) createdAPIKey {
+	body, _ := json.Marshal(map[string]any{"name": "automation", "scopes": scopes})
+	w := request(http.MethodPost, "/auth/api-keys", string(body), "", cookie, "")
+	require.Equal(t, 201, w.Code, w.Body.String())
+
+	var created createdAPIKey
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return created
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Run("Create and list", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "keys@example.com", models.RoleUser)
+		created := createAPIKey(t, cookie, "reurl:write", "reurl:read", "reurl:read")
+		assert.True(t, strings.HasPrefix(created.Key, "ps_"+created.APIKey.Prefix+"_"))
+		assert.Equal(t, []string{"reurl:read", "reurl:write"}, created.APIKey.Scopes)
+
+		var stored models.APIKey
+		require.NoError(t, db.First(&stored, created.APIKey.ID).Error)
+		assert.NotContains(t, stored.SecretHash, created.Key, "Only the hash is stored")
+
+		w := request(http.MethodGet, "/auth/api-keys", "", "", cookie, "")
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), created.APIKey.Prefix)
+		assert.NotContains(t, w.Body.String(), created.Key, "The key is only shown on creation")
+
+		w = request(http.MethodPost, "/auth/api-keys", `{"name":"bad","scopes":["admin"]}`, "", cookie, "")
+		assert.Equal(t, 400, w.Code)
+		w = request(http.MethodPost, "/auth/api-keys", `{"name":"old","scopes":["reurl:read"],"expires_at":"2000-01-01T00:00:00Z"}`, "", cookie, "")
+		assert.Equal(t, 400, w.Code)
+	})
+
+	t.Run("Scopes are enforced per route group", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "scopes@example.com", models.RoleUser)
+		readKey := createAPIKey(t, cookie, "reurl:read").Key
+		writeKey := createAPIKey(t, cookie, "reurl:write").Key
+		body := `{"target_url":"https://example.com"}`
+
+		w := request(http.MethodGet, "/reurl", "", "Bearer "+readKey, nil, "")
+		assert.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 403, request(http.MethodPost, "/reurl", body, "Bearer "+readKey, nil, "").Code)
+
+		w = request(http.MethodPost, "/reurl", body, "Bearer "+writeKey, nil, "")
+		assert.Less(t, w.Code, 300, w.Body.String())
+		var count int64
+		db.Model(&models.Reurl{}).Where("owner_id = ?", user.ID).Count(&count)
+		assert.Equal(t, int64(1), count, "The key acts as its owner")
+		assert.Equal(t, 403, request(http.MethodGet, "/reurl", "", "Bearer "+writeKey, nil, "").Code, "Write does not imply read")
+
+		assert.Equal(t, 403, request(http.MethodGet, "/storage/folder/", "", "Bearer "+readKey, nil, "").Code)
+		assert.Equal(t, 403, request(http.MethodGet, "/auth/api-keys", "", "Bearer "+readKey, nil, "").Code,
+			"Keys cannot manage the account")
+	})
+
+	t.Run("Revoked and unknown keys are rejected", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "revoke-key@example.com", models.RoleUser)
+		created := createAPIKey(t, cookie, "reurl:read")
+		auth := "Bearer " + created.Key
+
+		require.Equal(t, 200, request(http.MethodGet, "/reurl", "", auth, nil, "").Code)
+		var stored models.APIKey
+		require.NoError(t, db.First(&stored, created.APIKey.ID).Error)
+		assert.NotNil(t, stored.LastUsedAt)
+
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", auth+"x", nil, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Bearer ps_unknown_secret", nil, "").Code)
+
+		w := request(http.MethodDelete, "/auth/api-keys/"+strconv.FormatUint(uint64(created.APIKey.ID), 10), "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", auth, nil, "").Code)
+
+		w = request(http.MethodGet, "/auth/api-keys", "", "", cookie, "")
+		assert.NotContains(t, w.Body.String(), created.APIKey.Prefix)
+	})
+
+	t.Run("Guests cannot use API keys", func(t *testing.T) {
+		setup(t)
+
+		_, guestCookie, _ := createGuest(t)
+		w := request(http.MethodPost, "/auth/api-keys", `{"name":"guest","scopes":["reurl:read"]}`, "", guestCookie, "")
+		assert.Equal(t, 403, w.Code, w.Body.String())
+
+		// A key of an account that turned into an expired guest stops working
+		user, cookie := createUserWithToken(t, "expiring-key@example.com", models.RoleUser)
+		created := createAPIKey(t, cookie, "reurl:read")
+		require.Equal(t, 200, request(http.MethodGet, "/reurl", "", "Bearer "+created.Key, nil, "").Code)
+		past := time.Now().Add(-time.Minute)
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", user.ID).
+			UpdateColumns(map[string]any{"provider": models.AuthProviderGuest, "expires_at": past}).Error)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Bearer "+created.Key, nil, "").Code)
+	})
+
+	t.Run("Keys of other users cannot be revoked", func(t *testing.T) {
+		setup(t)
+
+		_, owner := createUserWithToken(t, "owner-key@example.com", models.RoleUser)
+		_, other := createUserWithToken(t, "other-key@example.com", models.RoleUser)
+		created := createAPIKey(t, owner, "reurl:read")
+
+		assert.Equal(t, 404, request(http.MethodDelete, "/auth/api-keys/"+strconv.FormatUint(uint64(created.APIKey.ID), 10), "", "", other, "").Code)
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "Bearer "+created.Key, nil, "").Code)
+	})
+}
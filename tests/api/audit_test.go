@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type auditEventList struct {
+	Events []struct {
+		ID           uint   `json:"id"`
+		ActorID      *uint  `json:"actor_id"`
+		TargetUserID *uint  `json:"target_user_id"`
+		Action       string `json:"action"`
+		Outcome      string `json:"outcome"`
+		Details      string `json:"details"`
+		IP           string `json:"ip"`
+		UserAgent    string `json:"user_agent"`
+	} `json:"events"`
+	Total int64 `json:"total"`
+}
+
+func listAuditEvents(t *testing.T, cookie *http.Cookie, query string) auditEventList {
+	w := request(http.MethodGet, "/admin/audit-events?"+query, "", "", cookie, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var list auditEventList
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	return list
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Run("Logins are recorded with their outcome", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "audit-admin@example.com", models.RoleAdmin)
+		user, _ := createUserWithToken(t, "audit-user@example.com", models.RoleUser)
+
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody(user.Email, "wrong-password"), "", nil, "").Code)
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody(user.Email, "password123"), "", nil, "").Code)
+
+		list := listAuditEvents(t, adminCookie, "action=auth.login&target_user_id="+strconv.FormatUint(uint64(user.ID), 10))
+		require.Len(t, list.Events, 2)
+		assert.Equal(t, "success", list.Events[0].Outcome, "Newest first")
+		require.NotNil(t, list.Events[0].ActorID)
+		assert.Equal(t, user.ID, *list.Events[0].ActorID)
+		assert.Equal(t, "failure", list.Events[1].Outcome)
+		assert.Nil(t, list.Events[1].ActorID, "A failed login has no actor")
+		assert.Equal(t, "192.0.2.1", list.Events[1].IP)
+
+		list = listAuditEvents(t, adminCookie, "outcome=failure")
+		assert.Equal(t, int64(1), list.Total)
+	})
+
+	t.Run("Disabled accounts are denied", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "denied-admin@example.com", models.RoleAdmin)
+		user, _ := createUserWithToken(t, "denied-user@example.com", models.RoleUser)
+		now := time.Now()
+		require.NoError(t, db.Model(&user).Update("disabled_at", &now).Error)
+
+		assert.Equal(t, 403, request(http.MethodPost, "/auth/login", loginBody(user.Email, "password123"), "", nil, "").Code)
+
+		list := listAuditEvents(t, adminCookie, "action=auth.login&outcome=denied")
+		require.Len(t, list.Events, 1)
+		assert.Equal(t, user.ID, *list.Events[0].TargetUserID)
+	})
+
+	t.Run("Filter by action prefix and user", func(t *testing.T) {
+		setup(t)
+
+		admin, adminCookie := createUserWithToken(t, "prefix-admin@example.com", models.RoleAdmin)
+		user, userCookie := createUserWithToken(t, "prefix-user@example.com", models.RoleUser)
+
+		require.Equal(t, 200, request(http.MethodPost, userPath(user, "/disable"), "", "", adminCookie, "").Code)
+		require.Equal(t, 200, request(http.MethodPost, userPath(user, "/enable"), "", "", adminCookie, "").Code)
+		request(http.MethodPost, "/auth/logout", "", "", userCookie, "")
+
+		list := listAuditEvents(t, adminCookie, "action=admin.user.*")
+		require.Len(t, list.Events, 2)
+		assert.Equal(t, "admin.user.enable", list.Events[0].Action)
+		assert.Equal(t, admin.ID, *list.Events[0].ActorID)
+
+		list = listAuditEvents(t, adminCookie, "user_id="+strconv.FormatUint(uint64(user.ID), 10))
+		assert.Equal(t, int64(3), list.Total, "Events about the user and by the user")
+
+		assert.Zero(t, listAuditEvents(t, adminCookie, "action=admin_*").Total, "Wildcards of the prefix are literal")
+		assert.Zero(t, listAuditEvents(t, adminCookie, "since="+time.Now().Add(time.Hour).Format(time.RFC3339)).Total)
+		assert.Equal(t, int64(3), listAuditEvents(t, adminCookie, "until="+time.Now().Add(time.Hour).Format(time.RFC3339)).Total)
+	})
+
+	t.Run("Invalid filters", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "invalid-admin@example.com", models.RoleAdmin)
+		for _, query := range []string{"actor_id=abc", "since=yesterday", "page_size=1000", "page=0"} {
+			assert.Equal(t, 400, request(http.MethodGet, "/admin/audit-events?"+query, "", "", adminCookie, "").Code, query)
+		}
+	})
+
+	t.Run("Only admins can read the audit log", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "reader@example.com", models.RoleUser)
+		assert.Equal(t, 403, request(http.MethodGet, "/admin/audit-events", "", "", cookie, "").Code)
+	})
+}
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	authController "personal_site/controllers/auth"
 	"personal_site/models"
+	"personal_site/password"
 	"personal_site/schemas"
 	"strings"
 	"testing"
@@ -36,8 +37,8 @@ func TestAuth(t *testing.T) {
 		assert.Equal(t, "testuser", user.Nickname, "User nickname should match")
 		assert.Equal(t, models.RoleUser, user.Role, "User role should be 'user'")
 		assert.Equal(t, models.AuthProviderPassword, user.Provider, "User provider should be 'password'")
-		err2 := bcrypt.CompareHashAndPassword([]byte(user.Identifier), []byte("password123"))
-		assert.NoError(t, err2, "User password should match")
+		match, _ := password.Verify("password123", user.Identifier)
+		assert.True(t, match, "User password should match")
 	})
 
 	t.Run("Login", func(t *testing.T) {
@@ -125,8 +126,8 @@ func TestAuth(t *testing.T) {
 		assert.Equal(t, "testuser", user.Nickname, "User nickname should match")
 		assert.Equal(t, models.RoleUser, user.Role, "User role should be 'user'")
 		assert.Equal(t, models.AuthProviderPassword, user.Provider, "User provider should be 'password'")
-		err2 := bcrypt.CompareHashAndPassword([]byte(user.Identifier), []byte("newpassword123"))
-		assert.NoError(t, err2, "User password should match")
+		match, _ := password.Verify("newpassword123", user.Identifier)
+		assert.True(t, match, "User password should match")
 	})
 
 	t.Run("logout", func(t *testing.T) {
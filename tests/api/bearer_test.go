@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tokenBody struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	UserID       uint   `json:"user_id"`
+}
+
+// request sends a request with optional Authorization header, cookie and Origin
+func request(method, path, body, authorization string, cookie *http.Cookie, origin string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) tokenBody {
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var tokens tokenBody
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	require.NotEmpty(t, tokens.AccessToken)
+	require.NotEmpty(t, tokens.RefreshToken)
+	return tokens
+}
+
+func TestBearerAuth(t *testing.T) {
+	t.Run("Token login returns tokens in the body", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "bearer@example.com", models.RoleUser)
+		w := request(http.MethodPost, "/auth/token", `{"email":"bearer@example.com","password":"password123"}`, "", nil, "")
+		tokens := decodeTokens(t, w)
+		assert.Equal(t, "Bearer", tokens.TokenType)
+		assert.Positive(t, tokens.ExpiresIn)
+		assert.Empty(t, w.Result().Cookies(), "No cookies for token login")
+
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "Bearer "+tokens.AccessToken, nil, "").Code)
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "bearer "+tokens.AccessToken, nil, "").Code, "Scheme is case-insensitive")
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Basic "+tokens.AccessToken, nil, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Bearer", nil, "").Code)
+	})
+
+	t.Run("Bearer header takes precedence over the cookie", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "precedence@example.com", models.RoleUser)
+		tokens := decodeTokens(t, request(http.MethodPost, "/auth/token",
+			`{"email":"precedence@example.com","password":"password123"}`, "", nil, ""))
+
+		badCookie := &http.Cookie{Name: "auth_token", Value: "invalid"}
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "Bearer "+tokens.AccessToken, badCookie, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Bearer invalid", cookie, "").Code,
+			"An invalid header must not fall back to the cookie")
+		assert.Equal(t, 401, request(http.MethodGet, "/storage/folder/", "", "Bearer invalid", nil, "").Code,
+			"AuthOptional rejects an invalid header too")
+	})
+
+	t.Run("Refresh with a body token", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "refresh-body@example.com", models.RoleUser)
+		first := decodeTokens(t, request(http.MethodPost, "/auth/token",
+			`{"email":"refresh-body@example.com","password":"password123"}`, "", nil, ""))
+
+		w := request(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`, "", nil, "")
+		second := decodeTokens(t, w)
+		assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+		assert.Empty(t, w.Result().Cookies())
+
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`, "", nil, "").Code,
+			"Reusing a rotated refresh token fails")
+	})
+
+	t.Run("Logout revokes the Bearer token", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "logout-bearer@example.com", models.RoleUser)
+		tokens := decodeTokens(t, request(http.MethodPost, "/auth/token",
+			`{"email":"logout-bearer@example.com","password":"password123"}`, "", nil, ""))
+
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/logout", "", "Bearer "+tokens.AccessToken, nil, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/reurl", "", "Bearer "+tokens.AccessToken, nil, "").Code)
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "", nil, "").Code)
+	})
+
+	t.Run("MFA token login finishes in the body", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "mfa-bearer@example.com", models.RoleUser)
+		secret, _ := enableTOTP(t, cookie)
+
+		w := request(http.MethodPost, "/auth/token", `{"email":"mfa-bearer@example.com","password":"password123"}`, "", nil, "")
+		require.Equal(t, 200, w.Code)
+		var pending struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pending))
+
+		w = request(http.MethodPost, "/auth/mfa/verify",
+			`{"mfa_token":"`+pending.MFAToken+`","code":"`+currentTOTP(t, secret, 0)+`"}`, "", nil, "")
+		decodeTokens(t, w)
+		assert.Empty(t, w.Result().Cookies())
+	})
+
+	t.Run("Cookie requests from foreign origins are rejected", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "csrf@example.com", models.RoleUser)
+		body := `{"target_url":"https://example.com"}`
+
+		assert.Equal(t, 403, request(http.MethodPost, "/reurl", body, "", cookie, "https://evil.example.com").Code)
+		assert.NotEqual(t, 403, request(http.MethodPost, "/reurl", body, "", cookie, "http://localhost:3000").Code)
+		assert.Equal(t, 200, request(http.MethodGet, "/reurl", "", "", cookie, "https://evil.example.com").Code,
+			"Safe methods are not checked")
+
+		tokens := decodeTokens(t, request(http.MethodPost, "/auth/token",
+			`{"email":"csrf@example.com","password":"password123"}`, "", nil, ""))
+		assert.NotEqual(t, 403, request(http.MethodPost, "/reurl", body, "Bearer "+tokens.AccessToken, nil, "https://evil.example.com").Code,
+			"Bearer requests cannot be forged by a browser")
+	})
+
+	t.Run("Cookies are SameSite=Lax", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "samesite@example.com")
+		for _, name := range []string{"auth_token", "refresh_token"} {
+			cookie := findCookie(w, name)
+			require.NotNil(t, cookie)
+			assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite, name)
+			assert.True(t, cookie.HttpOnly, name)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"personal_site/models"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var verifyLinkPattern = regexp.MustCompile(`\S*/auth/verify-email\?token=\S+`)
+
+// verificationPath returns the path and query of the verification link in the latest email to address
+func verificationPath(t *testing.T, address string) string {
+	link := verifyLinkPattern.FindString(mails.last(t, address).Body)
+	require.NotEmpty(t, link, "Email should contain a verification link")
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return "/auth/verify-email?" + u.RawQuery
+}
+
+// registerAndLogin registers a password account through the API and returns its auth_token cookie
+func registerAndLogin(t *testing.T, email string) *http.Cookie {
+	w := requestWithCookie(http.MethodPost, "/auth/register",
+		`{"email":"`+email+`","nickname":"testuser","password":"password123"}`, nil)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	w = requestWithCookie(http.MethodPost, "/auth/login",
+		`{"email":"`+email+`","password":"password123"}`, nil)
+	require.Equal(t, 200, w.Code)
+	cookie := findCookie(w, "auth_token")
+	require.NotNil(t, cookie)
+	return cookie
+}
+
+func TestEmailVerification(t *testing.T) {
+	t.Run("Register sends a link that verifies the email", func(t *testing.T) {
+		setup(t)
+
+		cookie := registerAndLogin(t, "verify@example.com")
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "verify@example.com").First(&user).Error)
+		assert.Nil(t, user.EmailVerifiedAt, "New users start unverified")
+
+		createReurl := func() int {
+			return requestWithCookie(http.MethodPost, "/reurl", `{"target_url":"https://example.com"}`, cookie).Code
+		}
+		assert.Equal(t, 403, createReurl(), "Unverified users cannot create reurls")
+
+		w := requestWithCookie(http.MethodGet, verificationPath(t, "verify@example.com"), "", nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		require.NoError(t, db.First(&user, user.ID).Error)
+		assert.NotNil(t, user.EmailVerifiedAt)
+		assert.NotEqual(t, 403, createReurl())
+	})
+
+	t.Run("Invalid or tampered tokens are rejected", func(t *testing.T) {
+		setup(t)
+
+		registerAndLogin(t, "tamper@example.com")
+		path := verificationPath(t, "tamper@example.com")
+
+		assert.Equal(t, 400, requestWithCookie(http.MethodGet, strings.Replace(path, "token=", "token=x", 1), "", nil).Code)
+		assert.Equal(t, 400, requestWithCookie(http.MethodGet, "/auth/verify-email", "", nil).Code)
+
+		// The link is bound to the address it was sent to
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "tamper@example.com").First(&user).Error)
+		require.NoError(t, db.Model(&user).Update("email", "other@example.com").Error)
+		assert.Equal(t, 400, requestWithCookie(http.MethodGet, path, "", nil).Code)
+	})
+
+	t.Run("Resend", func(t *testing.T) {
+		setup(t)
+
+		cookie := registerAndLogin(t, "resend@example.com")
+		assert.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/verify-email/resend", "", cookie).Code)
+		assert.True(t, strings.Contains(mails.last(t, "resend@example.com").Subject, "Verify"))
+
+		assert.Equal(t, 200, requestWithCookie(http.MethodGet, verificationPath(t, "resend@example.com"), "", nil).Code)
+		assert.Equal(t, 409, requestWithCookie(http.MethodPost, "/auth/verify-email/resend", "", cookie).Code)
+	})
+
+	t.Run("Resend shares the email limit", func(t *testing.T) {
+		setup(t)
+
+		cookie := registerAndLogin(t, "flood@example.com")
+		for i := 0; i < 5; i++ {
+			require.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/verify-email/resend", "", cookie).Code)
+		}
+		w := requestWithCookie(http.MethodPost, "/auth/verify-email/resend", "", cookie)
+		assert.Equal(t, 429, w.Code, w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), `"retry_after"`)
+	})
+}
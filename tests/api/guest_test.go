@@ -0,0 +1,270 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	authController "personal_site/controllers/auth"
+	"personal_site/controllers/storage"
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// createGuest creates a guest account and returns it with its auth_token and refresh_token cookies
+func createGuest(t *testing.T) (models.User, *http.Cookie, *http.Cookie) {
+	w := request(http.MethodPost, "/auth/guest", "", "", nil, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var data struct {
+		UserID uint `json:"user_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+
+	var guest models.User
+	require.NoError(t, db.First(&guest, data.UserID).Error)
+	access, refreshCookie := findCookie(w, "auth_token"), findCookie(w, "refresh_token")
+	require.NotNil(t, access)
+	require.NotNil(t, refreshCookie)
+	return guest, access, refreshCookie
+}
+
+func createReurl(t *testing.T, cookie *http.Cookie, key string) models.Reurl {
+	w := request(http.MethodPost, "/reurl", `{"key":"`+key+`","target_url":"https://example.com"}`, "", cookie, "")
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var reurl models.Reurl
+	require.NoError(t, db.Where("key = ?", key).First(&reurl).Error)
+	return reurl
+}
+
+// guestMergeToken returns a token that lets another account take the data of the guest of cookie
+func guestMergeToken(t *testing.T, cookie *http.Cookie) string {
+	w := request(http.MethodPost, "/auth/guest/merge-token", "", "", cookie, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var data struct {
+		MergeToken string `json:"merge_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	return data.MergeToken
+}
+
+func TestGuestAccounts(t *testing.T) {
+	t.Run("A guest has its own account and reurls", func(t *testing.T) {
+		setup(t)
+		guest, cookie, _ := createGuest(t)
+		assert.Equal(t, models.RoleGuest, guest.Role)
+		assert.Equal(t, models.AuthProviderGuest, guest.Provider)
+		require.NotNil(t, guest.ExpiresAt)
+		assert.WithinDuration(t, time.Now().Add(7*24*time.Hour), *guest.ExpiresAt, time.Minute)
+
+		other, _, _ := createGuest(t)
+		assert.NotEqual(t, guest.ID, other.ID, "Every guest gets its own account")
+
+		w := request(http.MethodGet, "/auth/me", "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"role":"guest"`)
+		assert.Contains(t, w.Body.String(), `"expires_at"`)
+
+		reurl := createReurl(t, cookie, "guest-key")
+		assert.Equal(t, guest.ID, reurl.OwnerID)
+
+		assert.Equal(t, 409, request(http.MethodPost, "/auth/guest", "", "", cookie, "").Code)
+		assert.Equal(t, 403, request(http.MethodGet, "/auth/link/github", "", "", cookie, "").Code, "Guests cannot link accounts")
+		assert.Equal(t, int64(1), countAuditEvents("auth.guest.create", guest.ID))
+	})
+
+	t.Run("Upgrade to a password account keeps the data", func(t *testing.T) {
+		setup(t)
+		guest, cookie, _ := createGuest(t)
+		reurl := createReurl(t, cookie, "kept")
+
+		body := `{"email":"upgraded@example.com","password":"password123","nickname":"upgraded"}`
+		w := request(http.MethodPost, "/auth/guest/upgrade", body, "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		newCookie := findCookie(w, "auth_token")
+		require.NotNil(t, newCookie, "The session continues with a token of the new role")
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", cookie, "").Code, "The guest token is outdated")
+
+		var user models.User
+		require.NoError(t, db.First(&user, guest.ID).Error)
+		assert.Equal(t, models.RoleUser, user.Role)
+		assert.Equal(t, models.AuthProviderPassword, user.Provider)
+		assert.Equal(t, "upgraded", user.Nickname)
+		assert.Nil(t, user.ExpiresAt)
+		_, sent := mails.find("upgraded@example.com")
+		assert.True(t, sent, "A verification email is sent")
+
+		w = request(http.MethodGet, "/auth/me", "", "", newCookie, "")
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `"role":"user"`)
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("upgraded@example.com", "password123"), "", nil, "").Code)
+
+		require.NoError(t, db.First(&reurl, reurl.ID).Error)
+		assert.Equal(t, guest.ID, reurl.OwnerID)
+		assert.Equal(t, 403, request(http.MethodPost, "/auth/guest/upgrade", body, "", newCookie, "").Code, "Only guests can upgrade")
+	})
+
+	t.Run("Upgrade checks the email and password", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "taken@example.com", models.RoleUser)
+		_, cookie, _ := createGuest(t)
+
+		w := request(http.MethodPost, "/auth/guest/upgrade", `{"email":"taken@example.com","password":"password123"}`, "", cookie, "")
+		assert.Equal(t, 409, w.Code, w.Body.String())
+		w = request(http.MethodPost, "/auth/guest/upgrade", `{"email":"free@example.com","password":"short"}`, "", cookie, "")
+		assert.Equal(t, 400, w.Code, w.Body.String())
+		assert.Equal(t, []string{"min_length"}, policyRules(t, w.Body.Bytes()))
+	})
+
+	t.Run("Logging in from a guest session keeps the guest apart", func(t *testing.T) {
+		setup(t)
+		user, _ := createUserWithToken(t, "owner@example.com", models.RoleUser)
+		guest, cookie, refreshCookie := createGuest(t)
+		reurl := createReurl(t, cookie, "kept-apart")
+
+		w := request(http.MethodPost, "/auth/login", loginBody("owner@example.com", "password123"), "", refreshCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, user.ID, loggedInUserID(t, w))
+
+		assert.NoError(t, db.First(&models.User{}, guest.ID).Error, "Logging in alone never takes the guest data")
+		require.NoError(t, db.First(&reurl, reurl.ID).Error)
+		assert.Equal(t, guest.ID, reurl.OwnerID)
+	})
+
+	t.Run("Merge moves the guest data to the account", func(t *testing.T) {
+		setup(t)
+		user, userCookie := createUserWithToken(t, "owner@example.com", models.RoleUser)
+		guest, cookie, _ := createGuest(t)
+		reurl := createReurl(t, cookie, "moved")
+		userStorageFile(t, user, "testuser", "mine.txt")
+		guestFile := userStorageFile(t, guest, guest.Nickname, "notes.txt")
+
+		token := guestMergeToken(t, cookie)
+		assert.Equal(t, 403, request(http.MethodPost, "/auth/guest/merge-token", "", "", userCookie, "").Code, "Only guests hand out merge tokens")
+		assert.Equal(t, 403, request(http.MethodPost, "/auth/guest/merge", `{"merge_token":"`+token+`"}`, "", cookie, "").Code,
+			"The guest cannot merge into itself")
+
+		w := request(http.MethodPost, "/auth/guest/merge", `{"merge_token":"`+token+`"}`, "", userCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var data struct {
+			GuestID     uint  `json:"guest_id"`
+			ReurlsMoved int64 `json:"reurls_moved"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		assert.Equal(t, guest.ID, data.GuestID)
+		assert.Equal(t, int64(1), data.ReurlsMoved)
+
+		require.NoError(t, db.First(&reurl, reurl.ID).Error)
+		assert.Equal(t, user.ID, reurl.OwnerID)
+		assert.ErrorIs(t, db.First(&models.User{}, guest.ID).Error, gorm.ErrRecordNotFound, "The guest is deleted")
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", cookie, "").Code)
+
+		_, err := os.Stat(guestFile)
+		assert.True(t, os.IsNotExist(err))
+		root, err := storage.GetStorageRoot()
+		require.NoError(t, err)
+		movedFile := filepath.Join(root, "data", strconv.FormatUint(uint64(user.ID), 10), "testuser", guest.Nickname, "notes.txt")
+		_, err = os.Stat(movedFile)
+		assert.NoError(t, err, "The guest files are kept in a folder of the guest nickname")
+		assert.Equal(t, int64(1), countAuditEvents("auth.guest.upgrade", guest.ID))
+
+		assert.Equal(t, 400, request(http.MethodPost, "/auth/guest/merge", `{"merge_token":"`+token+`"}`, "", userCookie, "").Code,
+			"The guest is gone")
+	})
+
+	t.Run("Guest files that cannot be moved stay with the guest", func(t *testing.T) {
+		setup(t)
+		user, userCookie := createUserWithToken(t, "crowded@example.com", models.RoleUser)
+		guest, cookie, _ := createGuest(t)
+		reurl := createReurl(t, cookie, "stays")
+		guestFile := userStorageFile(t, guest, guest.Nickname, "notes.txt")
+		// The folder the guest files would move to is taken
+		taken := userStorageFile(t, user, filepath.Join("testuser", guest.Nickname), "other.txt")
+
+		token := guestMergeToken(t, cookie)
+		w := request(http.MethodPost, "/auth/guest/merge", `{"merge_token":"`+token+`"}`, "", userCookie, "")
+		assert.Equal(t, 500, w.Code, w.Body.String())
+
+		assert.NoError(t, db.First(&models.User{}, guest.ID).Error, "The guest is kept")
+		assert.FileExists(t, guestFile)
+		require.NoError(t, db.First(&reurl, reurl.ID).Error)
+		assert.Equal(t, guest.ID, reurl.OwnerID)
+
+		require.NoError(t, os.RemoveAll(filepath.Dir(taken)))
+		w = request(http.MethodPost, "/auth/guest/merge", `{"merge_token":"`+token+`"}`, "", userCookie, "")
+		require.Equal(t, 200, w.Code, "The same token works again: %s", w.Body.String())
+		assert.NoFileExists(t, guestFile)
+	})
+
+	t.Run("Guest creation is limited per IP", func(t *testing.T) {
+		setup(t)
+		for i := 0; i < 10; i++ {
+			createGuest(t)
+		}
+		w := request(http.MethodPost, "/auth/guest", "", "", nil, "")
+		assert.Equal(t, 429, w.Code, w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+		var guests int64
+		db.Model(&models.User{}).Where("provider = ?", models.AuthProviderGuest).Count(&guests)
+		assert.Equal(t, int64(10), guests)
+	})
+
+	t.Run("A guest holds a limited number of reurls", func(t *testing.T) {
+		setup(t)
+		_, cookie, _ := createGuest(t)
+		for i := 0; i < 10; i++ {
+			createReurl(t, cookie, "guest-"+strconv.Itoa(i))
+		}
+		w := request(http.MethodPost, "/reurl", `{"key":"one-more","target_url":"https://example.com"}`, "", cookie, "")
+		assert.Equal(t, 403, w.Code, w.Body.String())
+
+		require.NoError(t, db.Model(&models.Reurl{}).Where("key = ?", "guest-0").UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error)
+		createReurl(t, cookie, "one-more")
+	})
+
+	t.Run("The guest role alone does not make a guest", func(t *testing.T) {
+		setup(t)
+		user, cookie := createUserWithToken(t, "guest-role@example.com", models.RoleGuest)
+		past := time.Now().Add(-time.Minute)
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", user.ID).UpdateColumn("expires_at", past).Error)
+
+		body := `{"email":"guest-role@example.com","password":"correct-horse-7"}`
+		assert.Equal(t, 403, request(http.MethodPost, "/auth/guest/upgrade", body, "", cookie, "").Code, "Only guest accounts upgrade")
+
+		removed, err := authController.DeleteExpiredGuests(db, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 0, removed)
+		assert.NoError(t, db.First(&models.User{}, user.ID).Error, "Password accounts are not deleted as guests")
+	})
+
+	t.Run("Expired guests are logged out and deleted", func(t *testing.T) {
+		setup(t)
+		guest, cookie, refreshCookie := createGuest(t)
+		createReurl(t, cookie, "expiring")
+		kept, _, _ := createGuest(t)
+
+		past := time.Now().Add(-time.Minute)
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", guest.ID).UpdateColumn("expires_at", past).Error)
+		authController.ForgetUserStatus(db, guest.ID)
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", cookie, "").Code)
+		assert.Equal(t, 401, refresh(refreshCookie).Code)
+
+		removed, err := authController.DeleteExpiredGuests(db, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		assert.ErrorIs(t, db.First(&models.User{}, guest.ID).Error, gorm.ErrRecordNotFound)
+		assert.NoError(t, db.First(&models.User{}, kept.ID).Error)
+
+		var reurls int64
+		db.Model(&models.Reurl{}).Where("owner_id = ?", guest.ID).Count(&reurls)
+		assert.Equal(t, int64(0), reurls)
+	})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"personal_site/models"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineCallback logs in with the fake LINE server
+func lineCallback(t *testing.T) *httptest.ResponseRecorder {
+	return lineLogin(t, "/auth/login-line", "good-code")
+}
+
+// oidcCallback logs in with the fake OIDC server, which confirms its emails unlike LINE
+func oidcCallback(t *testing.T) *httptest.ResponseRecorder {
+	return oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "good-code")
+}
+
+// lineLink links the fake LINE account to the user of cookie
+func lineLink(t *testing.T, cookie *http.Cookie) *httptest.ResponseRecorder {
+	return lineLogin(t, "/auth/link/line", "good-code", cookie)
+}
+
+func loggedInUserID(t *testing.T, w *httptest.ResponseRecorder) uint {
+	var data struct {
+		UserID uint `json:"user_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	return data.UserID
+}
+
+func listIdentities(t *testing.T, cookie *http.Cookie) []map[string]any {
+	w := requestWithCookie(http.MethodGet, "/auth/identities", "", cookie)
+	require.Equal(t, 200, w.Code)
+	var data struct {
+		Identities []map[string]any `json:"identities"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	return data.Identities
+}
+
+func TestAccountLinking(t *testing.T) {
+	useFakeLineServer(t)
+	useFakeOIDCServer(t)
+
+	t.Run("Link LINE to a password account", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "owner@example.com", models.RoleUser)
+
+		start := requestWithCookie(http.MethodGet, "/auth/link/line", "", cookie)
+		require.Equal(t, 302, start.Code)
+		require.NotNil(t, findCookie(start, "oauth_link"), "Link intent cookie should be set")
+
+		w := lineLink(t, cookie)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "Account linked")
+		assert.Nil(t, findCookie(w, "auth_token"), "Linking keeps the current session")
+
+		identities := listIdentities(t, cookie)
+		require.Len(t, identities, 1)
+		assert.Equal(t, "line", identities[0]["provider"])
+
+		w = lineCallback(t)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, user.ID, loggedInUserID(t, w), "LINE login should log in the linked user")
+
+		var count int64
+		db.Model(&models.User{}).Count(&count)
+		assert.Equal(t, int64(1), count, "No second user should be created")
+	})
+
+	t.Run("A linked login still needs the TOTP code", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "totp-owner@example.com", models.RoleUser)
+		secret, _ := enableTOTP(t, cookie)
+		require.Equal(t, 200, lineLink(t, cookie).Code)
+
+		w := lineCallback(t)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Nil(t, findCookie(w, "auth_token"), "The provider alone does not log in")
+		var data struct {
+			MFARequired bool   `json:"mfa_required"`
+			MFAToken    string `json:"mfa_token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		require.True(t, data.MFARequired)
+
+		w = request(http.MethodPost, "/auth/mfa/verify", `{"mfa_token":"`+data.MFAToken+`","code":"`+currentTOTP(t, secret, 0)+`"}`, "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, user.ID, loggedInUserID(t, w))
+		claims := jwt.MapClaims{}
+		_, _, err := jwt.NewParser().ParseUnverified(findCookie(w, "auth_token").Value, claims)
+		require.NoError(t, err)
+		assert.Equal(t, []any{"oauth", "otp", "mfa"}, claims["amr"])
+	})
+
+	t.Run("Cannot link an identity of another user", func(t *testing.T) {
+		setup(t)
+
+		require.Equal(t, 200, lineCallback(t).Code) // creates the LINE user
+		_, cookie := createUserWithToken(t, "other@example.com", models.RoleUser)
+
+		assert.Equal(t, 409, lineLink(t, cookie).Code)
+		assert.Empty(t, listIdentities(t, cookie))
+	})
+
+	t.Run("Offer to link when the verified email matches", func(t *testing.T) {
+		setup(t)
+
+		owner, ownerCookie := createUserWithToken(t, "kc-user@example.com", models.RoleUser)
+		_, strangerCookie := createUserWithToken(t, "stranger@example.com", models.RoleUser)
+
+		w := oidcCallback(t)
+		require.Equal(t, 409, w.Code, w.Body.String())
+		assert.Nil(t, findCookie(w, "auth_token"))
+
+		var offer struct {
+			LinkRequired bool   `json:"link_required"`
+			LinkToken    string `json:"link_token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &offer))
+		require.True(t, offer.LinkRequired)
+
+		var count int64
+		db.Model(&models.User{}).Where("provider = ?", "keycloak").Count(&count)
+		assert.Zero(t, count, "No duplicate account should be created")
+
+		body := `{"link_token":"` + offer.LinkToken + `"}`
+		assert.Equal(t, 400, requestWithCookie(http.MethodPost, "/auth/link/confirm", body, strangerCookie).Code,
+			"Only the owner of the email can accept")
+		require.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/link/confirm", body, ownerCookie).Code)
+
+		w = oidcCallback(t)
+		require.Equal(t, 200, w.Code)
+		assert.Equal(t, owner.ID, loggedInUserID(t, w))
+	})
+
+	t.Run("Unverified email match creates a separate account", func(t *testing.T) {
+		setup(t)
+
+		user, _ := createUserWithToken(t, "line-user@example.com", models.RoleUser)
+		db.Model(&user).Update("email_verified_at", nil)
+
+		w := lineCallback(t)
+		require.Equal(t, 200, w.Code)
+		assert.NotEqual(t, user.ID, loggedInUserID(t, w))
+	})
+
+	t.Run("A login verifies the email the provider confirms", func(t *testing.T) {
+		setup(t)
+
+		w := oidcCallback(t)
+		require.Equal(t, 200, w.Code)
+		userID := loggedInUserID(t, w)
+		// Like a user created before email verification existed
+		require.NoError(t, db.Model(&models.User{}).Where("id = ?", userID).UpdateColumn("email_verified_at", nil).Error)
+
+		w = oidcCallback(t)
+		require.Equal(t, 200, w.Code)
+		var user models.User
+		require.NoError(t, db.First(&user, userID).Error)
+		assert.True(t, user.IsEmailVerified())
+	})
+
+	t.Run("Unlink keeps the last login method", func(t *testing.T) {
+		setup(t)
+
+		w := lineCallback(t)
+		require.Equal(t, 200, w.Code)
+		lineOnly := findCookie(w, "auth_token")
+		identities := listIdentities(t, lineOnly)
+		require.Len(t, identities, 1)
+
+		id := strconv.Itoa(int(identities[0]["id"].(float64)))
+		w = requestWithCookie(http.MethodDelete, "/auth/identities/"+id, "", lineOnly)
+		assert.Equal(t, 409, w.Code)
+		assert.True(t, strings.Contains(w.Body.String(), "last login method"))
+
+		_, cookie := createUserWithToken(t, "pwd@example.com", models.RoleUser)
+		fakeLineUser.Sub = "U-second"
+		require.Equal(t, 200, lineLink(t, cookie).Code)
+
+		identities = listIdentities(t, cookie)
+		require.Len(t, identities, 1)
+		id = strconv.Itoa(int(identities[0]["id"].(float64)))
+		assert.Equal(t, 404, requestWithCookie(http.MethodDelete, "/auth/identities/"+id, "", lineOnly).Code,
+			"Cannot unlink an identity of another user")
+		assert.Equal(t, 200, requestWithCookie(http.MethodDelete, "/auth/identities/"+id, "", cookie).Code)
+		assert.Empty(t, listIdentities(t, cookie))
+	})
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"personal_site/models"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLineUser is the LINE account the fake server logs in, tests may change it
+var fakeLineUser = struct {
+	Sub   string
+	Email string
+}{Sub: "U1234567890", Email: "line-user@example.com"}
+
+var (
+	lineServer     *httptest.Server
+	lineServerOnce sync.Once
+)
+
+// useFakeLineServer points the LINE endpoints at a fake server. Config values are cached
+// for the whole process, so every test shares one server.
+func useFakeLineServer(t *testing.T) {
+	lineServerOnce.Do(func() { lineServer = newFakeLineServer() })
+	fakeLineUser.Sub = "U1234567890"
+	fakeLineUser.Email = "line-user@example.com"
+
+	t.Setenv("LINE_CLIENT_ID", "line-client")
+	t.Setenv("LINE_CLIENT_SECRET", "line-secret")
+	t.Setenv("LINE_AUTH_URL", lineServer.URL+"/oauth2/v2.1/authorize")
+	t.Setenv("LINE_TOKEN_URL", lineServer.URL+"/oauth2/v2.1/token")
+	t.Setenv("LINE_VERIFY_URL", lineServer.URL+"/oauth2/v2.1/verify")
+	t.Setenv("LINE_PROFILE_URL", lineServer.URL+"/v2/profile")
+}
+
+// newFakeLineServer mimics the LINE Login token, verify and profile endpoints
+func newFakeLineServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/v2.1/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" || r.Form.Get("client_id") != "line-client" || !checkPKCE(r) {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"line-access","token_type":"Bearer","expires_in":3600,"id_token":"line-id-token"}`))
+	})
+	mux.HandleFunc("/oauth2/v2.1/verify", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("id_token") != "line-id-token" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_request"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"iss":   "https://access.line.me",
+			"sub":   fakeLineUser.Sub,
+			"aud":   r.Form.Get("client_id"),
+			"name":  "Line User",
+			"email": fakeLineUser.Email,
+			"nonce": lastAuthorizeQuery.Get("nonce"),
+		})
+	})
+	mux.HandleFunc("/v2/profile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer line-access" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"userId": fakeLineUser.Sub, "displayName": "LINE 使用者"})
+	})
+	return httptest.NewServer(mux)
+}
+
+// lineLogin runs a LINE login against the fake server, see oauthLogin
+func lineLogin(t *testing.T, startPath, code string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return oauthLogin(t, startPath, "/auth/login-line-callback", code, cookies...)
+}
+
+func TestLineLogin(t *testing.T) {
+	useFakeLineServer(t)
+
+	t.Run("Start redirects to LINE", func(t *testing.T) {
+		setup(t)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/auth/login-line", nil)
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, 302, w.Code)
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/oauth2/v2.1/authorize", location.Path)
+		assert.Equal(t, "line-client", location.Query().Get("client_id"))
+		assert.NotEmpty(t, location.Query().Get("state"))
+	})
+
+	t.Run("Callback creates and reuses the user", func(t *testing.T) {
+		setup(t)
+
+		for i := 0; i < 2; i++ {
+			w := lineLogin(t, "/auth/login-line", "good-code")
+			assert.Equal(t, 200, w.Code)
+
+			var data map[string]any
+			json.Unmarshal(w.Body.Bytes(), &data)
+			assert.Equal(t, "LINE login successful", data["message"])
+			assert.Equal(t, "LINE 使用者", data["nickname"])
+
+			var authCookie *http.Cookie
+			for _, cookie := range w.Result().Cookies() {
+				if cookie.Name == "auth_token" {
+					authCookie = cookie
+				}
+			}
+			assert.NotNil(t, authCookie, "auth_token cookie should be set")
+		}
+
+		var users []models.User
+		db.Where("provider = ?", models.AuthProviderLine).Find(&users)
+		require.Len(t, users, 1, "Second login should reuse the LINE user")
+		assert.Equal(t, "U1234567890", users[0].Identifier)
+		assert.Equal(t, "line-user@example.com", users[0].Email)
+	})
+
+	t.Run("The LINE email is not trusted as verified", func(t *testing.T) {
+		setup(t)
+		owner, _ := createUserWithToken(t, "line-user@example.com", models.RoleUser)
+
+		w := lineLogin(t, "/auth/login-line", "good-code")
+		require.Equal(t, 200, w.Code, "No link to the account of the same email is offered: %s", w.Body.String())
+		assert.NotContains(t, w.Body.String(), "link_token")
+
+		var user models.User
+		require.NoError(t, db.Where("provider = ?", models.AuthProviderLine).First(&user).Error)
+		assert.NotEqual(t, owner.ID, user.ID)
+		assert.Nil(t, user.EmailVerifiedAt, "LINE does not say the email was confirmed")
+	})
+
+	t.Run("Callback rejects a bad code", func(t *testing.T) {
+		setup(t)
+
+		w := lineLogin(t, "/auth/login-line", "bad-code")
+		assert.Equal(t, 401, w.Code)
+	})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"personal_site/attempts"
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func loginBody(email, password string) string {
+	return `{"email":"` + email + `","password":"` + password + `"}`
+}
+
+// seedFailures adds n failures that happened long enough ago to not trigger the backoff
+func seedFailures(t *testing.T, key string, n int) {
+	for range n {
+		_, err := attempts.Default().AddFailure(key, time.Now().Add(-10*time.Minute), 15*time.Minute)
+		require.NoError(t, err)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	t.Run("Repeated failures need to back off", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "backoff@example.com", models.RoleUser)
+		createUserWithToken(t, "neighbour@example.com", models.RoleUser)
+		for range 3 {
+			assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("backoff@example.com", "wrongpass"), "", nil, "").Code)
+		}
+
+		w := request(http.MethodPost, "/auth/login", loginBody("backoff@example.com", "password123"), "", nil, "")
+		assert.Equal(t, 429, w.Code, "Even the right password has to wait")
+		retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		assert.Positive(t, retryAfter)
+
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("neighbour@example.com", "password123"), "", nil, "").Code,
+			"Other accounts from the same IP are not affected yet")
+	})
+
+	t.Run("Unknown emails are throttled like existing ones", func(t *testing.T) {
+		setup(t)
+
+		for range 3 {
+			assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("nobody@example.com", "wrongpass"), "", nil, "").Code)
+		}
+		assert.Equal(t, 429, request(http.MethodPost, "/auth/login", loginBody("nobody@example.com", "wrongpass"), "", nil, "").Code)
+	})
+
+	t.Run("Account lockout is recorded and can be unlocked", func(t *testing.T) {
+		setup(t)
+
+		user, _ := createUserWithToken(t, "lockout@example.com", models.RoleUser)
+		_, adminCookie := createUserWithToken(t, "lockout-admin@example.com", models.RoleAdmin)
+		seedFailures(t, "account:lockout@example.com", 9)
+
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("lockout@example.com", "wrongpass"), "", nil, "").Code)
+		assert.Equal(t, 429, request(http.MethodPost, "/auth/login", loginBody("lockout@example.com", "password123"), "", nil, "").Code)
+
+		var lockout models.LoginLockout
+		require.NoError(t, db.Where("kind = ? AND subject = ?", "account", "lockout@example.com").First(&lockout).Error)
+		require.NotNil(t, lockout.UserID)
+		assert.Equal(t, user.ID, *lockout.UserID)
+		assert.Equal(t, 10, lockout.Failures)
+		assert.True(t, lockout.LockedUntil.After(time.Now()))
+
+		w := request(http.MethodGet, "/admin/lockouts?active=true", "", "", adminCookie, "")
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), "lockout@example.com")
+
+		w = request(http.MethodPost, "/admin/lockouts/unlock", `{"email":"lockout@example.com"}`, "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("lockout@example.com", "password123"), "", nil, "").Code)
+
+		require.NoError(t, db.First(&lockout, lockout.ID).Error)
+		assert.NotNil(t, lockout.UnlockedAt)
+	})
+
+	t.Run("The backoff applies again after a lock expired", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "relapse@example.com", models.RoleUser)
+		// A lockout that ended after its failures were forgotten
+		require.NoError(t, attempts.Default().Lock("account:relapse@example.com", time.Now().Add(-time.Minute)))
+		for range 3 {
+			assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("relapse@example.com", "wrongpass"), "", nil, "").Code)
+		}
+		w := request(http.MethodPost, "/auth/login", loginBody("relapse@example.com", "password123"), "", nil, "")
+		assert.Equal(t, 429, w.Code, "Failing again after the lock backs off again")
+	})
+
+	t.Run("IP lockout applies to every account", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "ip-victim@example.com", models.RoleUser)
+		_, adminCookie := createUserWithToken(t, "ip-admin@example.com", models.RoleAdmin)
+		seedFailures(t, "ip:192.0.2.1", 99) // address of requests sent by request()
+
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody("someone@example.com", "wrongpass"), "", nil, "").Code)
+		assert.Equal(t, 429, request(http.MethodPost, "/auth/login", loginBody("ip-victim@example.com", "password123"), "", nil, "").Code)
+
+		var count int64
+		db.Model(&models.LoginLockout{}).Where("kind = ? AND subject = ?", "ip", "192.0.2.1").Count(&count)
+		assert.Equal(t, int64(1), count)
+
+		w := request(http.MethodPost, "/admin/lockouts/unlock", `{"ip":"192.0.2.1"}`, "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("ip-victim@example.com", "password123"), "", nil, "").Code)
+	})
+
+	t.Run("A forged X-Forwarded-For does not escape the IP lockout", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "forwarded@example.com", models.RoleUser)
+		seedFailures(t, "ip:192.0.2.1", 100)
+		require.NoError(t, attempts.Default().Lock("ip:192.0.2.1", time.Now().Add(time.Minute)))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(loginBody("forwarded@example.com", "password123")))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 429, w.Code, "Only trusted proxies may set the client IP")
+	})
+
+	t.Run("Change password is throttled", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "change-throttle@example.com", models.RoleUser)
+		body := `{"old_password":"wrongpass","new_password":"newpassword123"}`
+		for range 3 {
+			assert.Equal(t, 403, request(http.MethodPost, "/auth/change-password", body, "", cookie, "").Code)
+		}
+		assert.Equal(t, 429, request(http.MethodPost, "/auth/change-password",
+			`{"old_password":"password123","new_password":"newpassword123"}`, "", cookie, "").Code)
+	})
+
+	t.Run("Only admins can unlock", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "not-admin@example.com", models.RoleUser)
+		assert.Equal(t, 403, request(http.MethodPost, "/admin/lockouts/unlock", `{"email":"x@example.com"}`, "", cookie, "").Code)
+	})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var magicLinkPattern = regexp.MustCompile(`\S*/auth/magic-link/verify\?token=\S+`)
+
+// requestMagicLink asks for a login link and returns the token of the email
+func requestMagicLink(t *testing.T, email string) string {
+	w := request(http.MethodPost, "/auth/magic-link", `{"email":"`+email+`"}`, "", nil, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	link := magicLinkPattern.FindString(mails.last(t, email).Body)
+	require.NotEmpty(t, link, "The email should contain the login link")
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return u.Query().Get("token")
+}
+
+func useMagicLink(token string) (int, *http.Cookie, map[string]any) {
+	w := request(http.MethodPost, "/auth/magic-link/verify", `{"token":"`+token+`"}`, "", nil, "")
+	var data map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &data)
+	return w.Code, findCookie(w, "auth_token"), data
+}
+
+func TestMagicLink(t *testing.T) {
+	t.Run("The first link creates the user, later links reuse it", func(t *testing.T) {
+		setup(t)
+
+		code, cookie, data := useMagicLink(requestMagicLink(t, "link@example.com"))
+		require.Equal(t, 200, code, data)
+		require.NotNil(t, cookie)
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "link@example.com").First(&user).Error)
+		assert.Equal(t, models.AuthProviderEmail, user.Provider)
+		assert.Equal(t, "link", user.Nickname)
+		assert.True(t, user.IsEmailVerified(), "Opening the link verifies the email")
+		assert.Equal(t, int64(1), countAuditEvents("auth.register", user.ID))
+
+		claims := jwt.MapClaims{}
+		_, _, err := jwt.NewParser().ParseUnverified(cookie.Value, claims)
+		require.NoError(t, err)
+		assert.Equal(t, []any{"email"}, claims["amr"])
+
+		code, _, data = useMagicLink(requestMagicLink(t, "link@example.com"))
+		require.Equal(t, 200, code, data)
+		assert.Equal(t, float64(user.ID), data["user_id"])
+
+		var count int64
+		db.Model(&models.User{}).Where("email = ?", "link@example.com").Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("A link is used once", func(t *testing.T) {
+		setup(t)
+
+		token := requestMagicLink(t, "once@example.com")
+		code, _, _ := useMagicLink(token)
+		require.Equal(t, 200, code)
+		code, _, _ = useMagicLink(token)
+		assert.Equal(t, 400, code)
+
+		code, _, _ = useMagicLink("not-a-token")
+		assert.Equal(t, 400, code)
+	})
+
+	t.Run("A verified account of the email is reused", func(t *testing.T) {
+		setup(t)
+		user, _ := createUserWithToken(t, "known@example.com", models.RoleUser)
+
+		code, _, data := useMagicLink(requestMagicLink(t, "known@example.com"))
+		require.Equal(t, 200, code, data)
+		assert.Equal(t, float64(user.ID), data["user_id"])
+	})
+
+	t.Run("An unverified account of the email is not taken over", func(t *testing.T) {
+		setup(t)
+		squatter, _ := createUserWithToken(t, "victim@example.com", models.RoleUser)
+		require.NoError(t, db.Model(&squatter).Update("email_verified_at", nil).Error)
+
+		code, _, data := useMagicLink(requestMagicLink(t, "victim@example.com"))
+		require.Equal(t, 200, code, data)
+		assert.NotEqual(t, float64(squatter.ID), data["user_id"])
+	})
+
+	t.Run("Accounts with TOTP still need the code", func(t *testing.T) {
+		setup(t)
+		_, cookie := createUserWithToken(t, "totp-link@example.com", models.RoleUser)
+		secret, _ := enableTOTP(t, cookie)
+
+		code, sessionCookie, data := useMagicLink(requestMagicLink(t, "totp-link@example.com"))
+		require.Equal(t, 200, code, data)
+		assert.Nil(t, sessionCookie)
+		require.Equal(t, true, data["mfa_required"])
+
+		w := request(http.MethodPost, "/auth/mfa/verify", `{"mfa_token":"`+data["mfa_token"].(string)+`","code":"`+currentTOTP(t, secret, 0)+`"}`, "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		claims := jwt.MapClaims{}
+		_, _, err := jwt.NewParser().ParseUnverified(findCookie(w, "auth_token").Value, claims)
+		require.NoError(t, err)
+		assert.Equal(t, []any{"email", "otp", "mfa"}, claims["amr"])
+	})
+
+	t.Run("Login links share the email limit with password resets", func(t *testing.T) {
+		setup(t)
+
+		for range 3 {
+			require.Equal(t, 200, request(http.MethodPost, "/auth/forgot-password", `{"email":"limited@example.com"}`, "", nil, "").Code)
+		}
+		requestMagicLink(t, "limited@example.com")
+		requestMagicLink(t, "limited@example.com")
+
+		w := request(http.MethodPost, "/auth/magic-link", `{"email":"limited@example.com"}`, "", nil, "")
+		assert.Equal(t, 429, w.Code, w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	})
+
+	t.Run("Disabled accounts cannot log in", func(t *testing.T) {
+		setup(t)
+		user, _ := createUserWithToken(t, "disabled-link@example.com", models.RoleUser)
+		require.NoError(t, db.Model(&user).Update("disabled_at", user.CreatedAt).Error)
+
+		code, cookie, _ := useMagicLink(requestMagicLink(t, "disabled-link@example.com"))
+		assert.Equal(t, 403, code)
+		assert.Nil(t, cookie)
+	})
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"personal_site/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// currentTOTP computes the code of secret for the step offset from now, like an authenticator app
+func currentTOTP(t *testing.T, secret string, offset int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(time.Now().Unix()/30+offset))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	pos := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[pos:pos+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// enableTOTP enrolls the user behind cookie and returns the secret and recovery codes
+func enableTOTP(t *testing.T, cookie *http.Cookie) (string, []string) {
+	w := requestWithCookie(http.MethodPost, "/auth/mfa/totp/setup", "", cookie)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	var setupResp struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+		QRCode     string `json:"qr_code"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &setupResp))
+	assert.True(t, strings.HasPrefix(setupResp.OTPAuthURL, "otpauth://totp/"))
+	assert.True(t, strings.HasPrefix(setupResp.QRCode, "data:image/png;base64,"))
+
+	w = requestWithCookie(http.MethodPost, "/auth/mfa/totp/confirm",
+		`{"code":"`+currentTOTP(t, setupResp.Secret, -1)+`"}`, cookie)
+	require.Equal(t, 200, w.Code, w.Body.String())
+
+	var confirmResp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmResp))
+	require.Len(t, confirmResp.RecoveryCodes, 10)
+	return setupResp.Secret, confirmResp.RecoveryCodes
+}
+
+// passwordLogin posts the credentials and returns the mfa_token of the pending login
+func passwordLogin(t *testing.T, email string) string {
+	w := requestWithCookie(http.MethodPost, "/auth/login",
+		`{"email":"`+email+`","password":"password123"}`, nil)
+	require.Equal(t, 200, w.Code)
+	assert.Nil(t, findCookie(w, "auth_token"), "No session before the second step")
+
+	var resp struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.True(t, resp.MFARequired)
+	require.NotEmpty(t, resp.MFAToken)
+	return resp.MFAToken
+}
+
+func verifyMFA(mfaToken, code string) int {
+	w := requestWithCookie(http.MethodPost, "/auth/mfa/verify",
+		`{"mfa_token":"`+mfaToken+`","code":"`+code+`"}`, nil)
+	return w.Code
+}
+
+func TestMFA(t *testing.T) {
+	t.Run("Login with TOTP needs a second step", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "mfa@example.com", models.RoleUser)
+		secret, _ := enableTOTP(t, cookie)
+
+		mfaToken := passwordLogin(t, "mfa@example.com")
+		assert.Equal(t, 401, verifyMFA(mfaToken, "000000"), "Wrong code should be rejected")
+
+		w := requestWithCookie(http.MethodPost, "/auth/mfa/verify",
+			`{"mfa_token":"`+mfaToken+`","code":"`+currentTOTP(t, secret, 0)+`"}`, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		authCookie := findCookie(w, "auth_token")
+		require.NotNil(t, authCookie)
+		assert.NotNil(t, findCookie(w, "refresh_token"))
+		assert.Equal(t, 200, requestWithCookie(http.MethodGet, "/reurl", "", authCookie).Code)
+
+		assert.Equal(t, 401, verifyMFA(mfaToken, currentTOTP(t, secret, 1)), "MFA token is single use")
+	})
+
+	t.Run("TOTP code cannot be replayed", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "replay@example.com", models.RoleUser)
+		secret, _ := enableTOTP(t, cookie)
+
+		code := currentTOTP(t, secret, 0)
+		assert.Equal(t, 200, verifyMFA(passwordLogin(t, "replay@example.com"), code))
+		assert.Equal(t, 401, verifyMFA(passwordLogin(t, "replay@example.com"), code))
+	})
+
+	t.Run("Recovery code works once", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "recovery@example.com", models.RoleUser)
+		_, codes := enableTOTP(t, cookie)
+
+		assert.Equal(t, 200, verifyMFA(passwordLogin(t, "recovery@example.com"), strings.ToUpper(codes[0])))
+		assert.Equal(t, 401, verifyMFA(passwordLogin(t, "recovery@example.com"), codes[0]))
+	})
+
+	t.Run("Setup twice and disable", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "disable@example.com", models.RoleUser)
+		_, codes := enableTOTP(t, cookie)
+
+		assert.Equal(t, 409, requestWithCookie(http.MethodPost, "/auth/mfa/totp/setup", "", cookie).Code)
+		assert.Equal(t, 403, requestWithCookie(http.MethodPost, "/auth/mfa/totp/disable", `{"code":"000000"}`, cookie).Code)
+		assert.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/mfa/totp/disable", `{"code":"`+codes[1]+`"}`, cookie).Code)
+
+		w := requestWithCookie(http.MethodPost, "/auth/login",
+			`{"email":"disable@example.com","password":"password123"}`, nil)
+		assert.Equal(t, 200, w.Code)
+		assert.NotNil(t, findCookie(w, "auth_token"), "Login is single step again")
+	})
+
+	t.Run("OAuth accounts cannot enroll", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "oauth@example.com", models.RoleUser)
+		db.Model(&user).Update("provider", models.AuthProviderGitHub)
+
+		assert.Equal(t, 403, requestWithCookie(http.MethodPost, "/auth/mfa/totp/setup", "", cookie).Code)
+	})
+}
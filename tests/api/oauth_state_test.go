@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startLineLogin calls the LINE start endpoint and returns the state parameter and state cookie
+func startLineLogin(t *testing.T, redirect string) (string, *http.Cookie) {
+	w := requestWithCookie(http.MethodGet, "/auth/login-line?redirect="+url.QueryEscape(redirect), "", nil)
+	require.Equal(t, 302, w.Code, w.Body.String())
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	lastAuthorizeQuery = location.Query()
+	cookie := findCookie(w, "oauth_state")
+	require.NotNil(t, cookie, "State cookie should be set")
+	return location.Query().Get("state"), cookie
+}
+
+func lineCallbackWithState(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	return requestWithCookie(http.MethodGet,
+		"/auth/login-line-callback?code=good-code&state="+url.QueryEscape(state), "", cookie)
+}
+
+func TestOAuthState(t *testing.T) {
+	useFakeLineServer(t)
+
+	t.Run("Valid state redirects back to an allowed origin", func(t *testing.T) {
+		setup(t)
+
+		state, cookie := startLineLogin(t, "http://localhost:3000/after-login")
+		w := lineCallbackWithState(state, cookie)
+		require.Equal(t, 302, w.Code, w.Body.String())
+		assert.True(t, strings.HasPrefix(w.Header().Get("Location"), "http://localhost:3000/after-login?"))
+
+		removed := findCookie(w, "oauth_state")
+		require.NotNil(t, removed)
+		assert.True(t, removed.MaxAge < 0, "State cookie should be removed after use")
+	})
+
+	t.Run("Forged state is rejected", func(t *testing.T) {
+		setup(t)
+
+		state, cookie := startLineLogin(t, "")
+		authorizeQuery := lastAuthorizeQuery
+
+		assert.Equal(t, 400, lineCallbackWithState(state, nil).Code, "Missing cookie")
+		assert.Equal(t, 400, lineCallbackWithState("forged", cookie).Code, "State does not match the cookie")
+		assert.Equal(t, 400, lineCallbackWithState("", cookie).Code, "Missing state")
+
+		otherState, _ := startLineLogin(t, "")
+		assert.Equal(t, 400, lineCallbackWithState(otherState, cookie).Code, "State of another login")
+
+		// Change the encrypted cookie without knowing the key
+		value := []byte(cookie.Value)
+		value[len(value)/2] ^= 1
+		tampered := &http.Cookie{Name: cookie.Name, Value: string(value)}
+		assert.Equal(t, 400, lineCallbackWithState(state, tampered).Code, "Tampered cookie")
+
+		lastAuthorizeQuery = authorizeQuery
+		assert.Equal(t, 200, lineCallbackWithState(state, cookie).Code, "The genuine pair still works")
+	})
+
+	t.Run("Foreign redirect hosts are rejected", func(t *testing.T) {
+		setup(t)
+
+		for _, redirect := range []string{
+			"https://evil.example.com/",
+			"//evil.example.com/",
+			"http://localhost:3000.evil.example.com/",
+			"http://user@evil.example.com/",
+			"https://localhost:3000/", // scheme must match too
+			"javascript:alert(1)",
+			"/relative/path",
+		} {
+			w := requestWithCookie(http.MethodGet, "/auth/login-line?redirect="+url.QueryEscape(redirect), "", nil)
+			assert.Equal(t, 400, w.Code, redirect)
+			assert.Nil(t, findCookie(w, "oauth_state"), redirect)
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"personal_site/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOIDCUser is what the fake issuer puts in its ID tokens, tests may change it
+var fakeOIDCUser struct {
+	Sub            string
+	Email          string
+	EmailInIDToken bool // otherwise the email is only served by the userinfo endpoint
+	Audience       string
+	Nonce          string // overrides the nonce of the authorization request
+}
+
+// lastAuthorizeQuery is the query of the authorization URL of the last oauthLogin, the fake
+// providers check the PKCE verifier against it and put its nonce in their ID tokens
+var lastAuthorizeQuery url.Values
+
+// checkPKCE reports whether the code_verifier of a token request matches the challenge
+func checkPKCE(r *http.Request) bool {
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	return lastAuthorizeQuery.Get("code_challenge_method") == "S256" &&
+		base64.RawURLEncoding.EncodeToString(sum[:]) == lastAuthorizeQuery.Get("code_challenge")
+}
+
+// authorizeNonce is the nonce a fake provider puts in its ID token
+func authorizeNonce() string {
+	if fakeOIDCUser.Nonce != "" {
+		return fakeOIDCUser.Nonce
+	}
+	return lastAuthorizeQuery.Get("nonce")
+}
+
+var (
+	oidcServer     *httptest.Server
+	oidcServerKey  *rsa.PrivateKey
+	oidcServerOnce sync.Once
+)
+
+// useFakeOIDCServer configures a "keycloak" OIDC_PROVIDERS entry whose issuer is a fake
+// server. Config values are cached for the whole process, so every test shares one server.
+func useFakeOIDCServer(t *testing.T) {
+	oidcServerOnce.Do(func() {
+		oidcServerKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+		oidcServer = newFakeOIDCServer()
+	})
+	fakeOIDCUser.Sub = "kc-user-1"
+	fakeOIDCUser.Email = "kc-user@example.com"
+	fakeOIDCUser.EmailInIDToken = true
+	fakeOIDCUser.Audience = "kc-client"
+	fakeOIDCUser.Nonce = ""
+
+	t.Setenv("OIDC_PROVIDERS", "keycloak")
+	t.Setenv("OIDC_KEYCLOAK_ISSUER", oidcServer.URL)
+	t.Setenv("OIDC_KEYCLOAK_CLIENT_ID", "kc-client")
+	t.Setenv("OIDC_KEYCLOAK_CLIENT_SECRET", "kc-secret")
+	t.Setenv("OIDC_KEYCLOAK_DISPLAY_NAME", "Keycloak")
+}
+
+// newFakeOIDCServer mimics the discovery, JWKS, token and userinfo endpoints of an issuer
+func newFakeOIDCServer() *httptest.Server {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"userinfo_endpoint":      server.URL + "/userinfo",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub := oidcServerKey.PublicKey
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "kc-1",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "good-code" || !checkPKCE(r) {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		claims := jwt.MapClaims{
+			"iss":            server.URL,
+			"nonce":          authorizeNonce(),
+			"sub":            fakeOIDCUser.Sub,
+			"aud":            fakeOIDCUser.Audience,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(5 * time.Minute).Unix(),
+			"name":           "Keycloak User",
+			"email_verified": "true",
+		}
+		if fakeOIDCUser.EmailInIDToken {
+			claims["email"] = fakeOIDCUser.Email
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		idToken.Header["kid"] = "kc-1"
+		signed, _ := idToken.SignedString(oidcServerKey)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "kc-access",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     signed,
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kc-access" {
+			w.WriteHeader(401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"sub": fakeOIDCUser.Sub, "email": fakeOIDCUser.Email, "email_verified": true})
+	})
+	return server
+}
+
+// oauthLogin runs a login against a fake provider: it calls startPath with cookies, then
+// callbackPath with the returned state and every cookie the start set
+func oauthLogin(t *testing.T, startPath, callbackPath, code string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, startPath, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	router.ServeHTTP(w, req)
+	require.Equal(t, 302, w.Code, w.Body.String())
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	lastAuthorizeQuery = location.Query()
+	state := location.Query().Get("state")
+
+	callback := httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodGet, callbackPath+"?code="+code+"&state="+url.QueryEscape(state), nil)
+	for _, cookie := range w.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	router.ServeHTTP(callback, req)
+	return callback
+}
+
+func TestOIDCLogin(t *testing.T) {
+	useFakeOIDCServer(t)
+
+	t.Run("Providers lists the configured issuer", func(t *testing.T) {
+		setup(t)
+
+		w := request(http.MethodGet, "/auth/providers", "", "", nil, "")
+		require.Equal(t, 200, w.Code)
+
+		var data struct {
+			Providers []struct {
+				Name        string `json:"name"`
+				DisplayName string `json:"display_name"`
+				LoginPath   string `json:"login_path"`
+			} `json:"providers"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		names := make([]string, 0, len(data.Providers))
+		for _, p := range data.Providers {
+			names = append(names, p.Name)
+		}
+		assert.Equal(t, []string{"github", "google", "line", "keycloak"}, names)
+		assert.Equal(t, "Keycloak", data.Providers[3].DisplayName)
+		assert.Equal(t, "/auth/oidc/keycloak", data.Providers[3].LoginPath)
+	})
+
+	t.Run("Start redirects to the discovered authorization endpoint", func(t *testing.T) {
+		setup(t)
+
+		w := request(http.MethodGet, "/auth/oidc/keycloak", "", "", nil, "")
+		require.Equal(t, 302, w.Code, w.Body.String())
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/authorize", location.Path)
+		assert.Equal(t, "kc-client", location.Query().Get("client_id"))
+		assert.Contains(t, strings.Fields(location.Query().Get("scope")), "openid")
+		assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+		assert.NotEmpty(t, location.Query().Get("code_challenge"))
+		assert.NotEmpty(t, location.Query().Get("nonce"))
+		assert.True(t, strings.HasSuffix(location.Query().Get("redirect_uri"), "/auth/oidc/keycloak/callback"))
+	})
+
+	t.Run("Callback creates and reuses the user", func(t *testing.T) {
+		setup(t)
+
+		for i := 0; i < 2; i++ {
+			w := oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "good-code")
+			require.Equal(t, 200, w.Code, w.Body.String())
+
+			var data map[string]any
+			json.Unmarshal(w.Body.Bytes(), &data)
+			assert.Equal(t, "Keycloak login successful", data["message"])
+			assert.Equal(t, "Keycloak User", data["nickname"])
+		}
+
+		var users []models.User
+		db.Where("provider = ?", "keycloak").Find(&users)
+		require.Len(t, users, 1, "Second login should reuse the user")
+		assert.Equal(t, "kc-user@example.com", users[0].Email)
+		assert.True(t, users[0].IsEmailVerified(), "email_verified of the ID token should be trusted")
+	})
+
+	t.Run("Email falls back to userinfo", func(t *testing.T) {
+		setup(t)
+		fakeOIDCUser.Sub = "kc-user-2"
+		fakeOIDCUser.Email = "userinfo@example.com"
+		fakeOIDCUser.EmailInIDToken = false
+		t.Cleanup(func() { fakeOIDCUser.EmailInIDToken = true })
+
+		w := oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "good-code")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var user models.User
+		require.NoError(t, db.Where("provider = ? AND identifier = ?", "keycloak", "kc-user-2").First(&user).Error)
+		assert.Equal(t, "userinfo@example.com", user.Email)
+	})
+
+	t.Run("Callback rejects an ID token for another client", func(t *testing.T) {
+		setup(t)
+		fakeOIDCUser.Audience = "someone-else"
+		t.Cleanup(func() { fakeOIDCUser.Audience = "kc-client" })
+
+		w := oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "good-code")
+		assert.Equal(t, 401, w.Code)
+
+		var count int64
+		db.Model(&models.User{}).Where("provider = ?", "keycloak").Count(&count)
+		assert.Zero(t, count)
+	})
+
+	t.Run("Callback rejects an ID token of another login", func(t *testing.T) {
+		setup(t)
+		fakeOIDCUser.Nonce = "nonce-of-another-login"
+		t.Cleanup(func() { fakeOIDCUser.Nonce = "" })
+
+		w := oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "good-code")
+		assert.Equal(t, 401, w.Code)
+	})
+
+	t.Run("Callback rejects a bad code", func(t *testing.T) {
+		setup(t)
+
+		w := oauthLogin(t, "/auth/oidc/keycloak", "/auth/oidc/keycloak/callback", "bad-code")
+		assert.Equal(t, 401, w.Code)
+	})
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		setup(t)
+
+		w := request(http.MethodGet, "/auth/oidc/nope", "", "", nil, "")
+		assert.Equal(t, 404, w.Code)
+	})
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"personal_site/models"
+	"personal_site/webauthn"
+	"personal_site/webauthn/webauthntest"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const passkeyOrigin = "http://localhost:3000"
+
+func usePasskeys(t *testing.T) *webauthntest.Authenticator {
+	t.Setenv("WEBAUTHN_RP_ID", "localhost")
+	return webauthntest.NewAuthenticator(passkeyOrigin)
+}
+
+func jsonBody(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+// registerPasskey runs the registration ceremony, as a sign up without cookie
+func registerPasskey(t *testing.T, authenticator *webauthntest.Authenticator, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	w := request(http.MethodPost, "/auth/passkey/register/begin", body, "", cookie, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var begin struct {
+		Options        webauthn.CreationOptions `json:"options"`
+		ChallengeToken string                   `json:"challenge_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+
+	credential, err := authenticator.Create(begin.Options)
+	require.NoError(t, err)
+	return request(http.MethodPost, "/auth/passkey/register/finish", jsonBody(t, map[string]any{
+		"challenge_token": begin.ChallengeToken,
+		"credential":      credential,
+	}), "", cookie, "")
+}
+
+// passkeyAssertion runs the first half of a passkey login and returns the finish body
+func passkeyAssertion(t *testing.T, authenticator *webauthntest.Authenticator) string {
+	w := request(http.MethodPost, "/auth/passkey/login/begin", "", "", nil, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var begin struct {
+		Options        webauthn.RequestOptions `json:"options"`
+		ChallengeToken string                  `json:"challenge_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+
+	assertion, err := authenticator.Get(begin.Options)
+	require.NoError(t, err)
+	return jsonBody(t, map[string]any{"challenge_token": begin.ChallengeToken, "credential": assertion})
+}
+
+func passkeyLogin(t *testing.T, authenticator *webauthntest.Authenticator) *httptest.ResponseRecorder {
+	return request(http.MethodPost, "/auth/passkey/login/finish", passkeyAssertion(t, authenticator), "", nil, "")
+}
+
+func listPasskeys(t *testing.T, cookie *http.Cookie) []map[string]any {
+	w := request(http.MethodGet, "/auth/passkeys", "", "", cookie, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var data struct {
+		Passkeys []map[string]any `json:"passkeys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	return data.Passkeys
+}
+
+func TestPasskeys(t *testing.T) {
+	t.Run("Sign up and log in with a passkey", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+
+		w := registerPasskey(t, authenticator, `{"email":"passkey@example.com","nickname":"keyholder"}`, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NotNil(t, findCookie(w, "auth_token"))
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "passkey@example.com").First(&user).Error)
+		assert.Equal(t, models.AuthProviderPasskey, user.Provider)
+		assert.Equal(t, "keyholder", user.Nickname)
+		assert.Nil(t, user.EmailVerifiedAt)
+		_, sent := mails.find("passkey@example.com")
+		assert.True(t, sent, "Verification email is sent")
+		assert.Equal(t, int64(1), countAuditEvents("auth.register", user.ID))
+
+		w = passkeyLogin(t, authenticator)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		cookie := findCookie(w, "auth_token")
+		require.NotNil(t, cookie)
+
+		claims := jwt.MapClaims{}
+		_, _, err := jwt.NewParser().ParseUnverified(cookie.Value, claims)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []any{"hwk", "mfa"}, claims["amr"])
+
+		var cred models.WebAuthnCredential
+		require.NoError(t, db.Where("user_id = ?", user.ID).First(&cred).Error)
+		assert.Equal(t, uint32(1), cred.SignCount)
+		assert.NotNil(t, cred.LastUsedAt)
+
+		w = request(http.MethodGet, "/auth/me", "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"provider":"passkey"`)
+	})
+
+	t.Run("Sign up with a registered email is refused", func(t *testing.T) {
+		setup(t)
+		usePasskeys(t)
+		createUserWithToken(t, "taken@example.com", models.RoleUser)
+
+		w := request(http.MethodPost, "/auth/passkey/register/begin", `{"email":"taken@example.com","nickname":"someone"}`, "", nil, "")
+		assert.Equal(t, 409, w.Code, w.Body.String())
+
+		w = request(http.MethodPost, "/auth/passkey/register/begin", `{"email":"new@example.com","nickname":"../x"}`, "", nil, "")
+		assert.Equal(t, 400, w.Code, w.Body.String())
+		w = request(http.MethodPost, "/auth/passkey/register/begin", `{}`, "", nil, "")
+		assert.Equal(t, 400, w.Code, w.Body.String())
+	})
+
+	t.Run("An unverified passkey sign up does not hold the email", func(t *testing.T) {
+		setup(t)
+		squatter := usePasskeys(t)
+		w := registerPasskey(t, squatter, `{"email":"owner@example.com","nickname":"squatter"}`, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		squatterID := loggedInUserID(t, w)
+
+		w = request(http.MethodPost, "/auth/register", `{"email":"owner@example.com","nickname":"owner","password":"correct-horse-7"}`, "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		w = request(http.MethodPost, "/auth/login", loginBody("owner@example.com", "correct-horse-7"), "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.NotEqual(t, squatterID, loggedInUserID(t, w), "Password login only looks at password accounts")
+
+		owner := webauthntest.NewAuthenticator(passkeyOrigin)
+		w = registerPasskey(t, owner, `{"email":"owner@example.com","nickname":"owner"}`, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var squatterUser models.User
+		require.NoError(t, db.First(&squatterUser, squatterID).Error)
+		assert.NotEqual(t, "owner@example.com", squatterUser.Email, "The unverified email is released")
+		assert.Equal(t, 200, passkeyLogin(t, squatter).Code, "The released account keeps its passkey")
+	})
+
+	t.Run("A logged in user adds a passkey", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+		user, cookie := createUserWithToken(t, "adder@example.com", models.RoleUser)
+
+		w := registerPasskey(t, authenticator, "", cookie)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), "Passkey added")
+		assert.Equal(t, int64(1), countAuditEvents("auth.passkey.add", user.ID))
+
+		// The authenticator refuses to register the same account twice
+		w = request(http.MethodPost, "/auth/passkey/register/begin", "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		var begin struct {
+			Options webauthn.CreationOptions `json:"options"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+		assert.Len(t, begin.Options.ExcludeCredentials, 1)
+
+		w = passkeyLogin(t, authenticator)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, user.ID, loggedInUserID(t, w))
+
+		var stored models.User
+		require.NoError(t, db.First(&stored, user.ID).Error)
+		assert.Equal(t, models.AuthProviderPassword, stored.Provider, "The password is kept")
+	})
+
+	t.Run("A challenge is used once", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+		_, cookie := createUserWithToken(t, "replay@example.com", models.RoleUser)
+		require.Equal(t, 200, registerPasskey(t, authenticator, "", cookie).Code)
+
+		body := passkeyAssertion(t, authenticator)
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/passkey/login/finish", body, "", nil, "").Code)
+		w := request(http.MethodPost, "/auth/passkey/login/finish", body, "", nil, "")
+		assert.Equal(t, 400, w.Code, w.Body.String())
+	})
+
+	t.Run("Invalid assertions are refused", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+		user, cookie := createUserWithToken(t, "cloned@example.com", models.RoleUser)
+		require.Equal(t, 200, registerPasskey(t, authenticator, "", cookie).Code)
+		require.Equal(t, 200, passkeyLogin(t, authenticator).Code)
+
+		authenticator.FixedSignCount = true
+		w := passkeyLogin(t, authenticator)
+		assert.Equal(t, 401, w.Code, w.Body.String())
+		assert.Equal(t, int64(2), countAuditEvents("auth.login", user.ID), "The failure is recorded")
+
+		unknown := webauthntest.NewAuthenticator(passkeyOrigin)
+		_, err := unknown.Create(webauthn.Config{RPID: "localhost", Origins: []string{passkeyOrigin}}.NewCreationOptions(webauthn.User{ID: []byte{1}}, []byte{1}, nil))
+		require.NoError(t, err)
+		assert.Equal(t, 401, passkeyLogin(t, unknown).Code)
+
+		require.NoError(t, db.Model(&user).Update("disabled_at", user.CreatedAt).Error)
+		authenticator.FixedSignCount = false
+		assert.Equal(t, 403, passkeyLogin(t, authenticator).Code)
+	})
+
+	t.Run("Rename and delete passkeys", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+		user, cookie := createUserWithToken(t, "manage@example.com", models.RoleUser)
+		require.Equal(t, 200, registerPasskey(t, authenticator, "", cookie).Code)
+
+		passkeys := listPasskeys(t, cookie)
+		require.Len(t, passkeys, 1)
+		assert.Equal(t, "Passkey", passkeys[0]["name"])
+		path := "/auth/passkeys/" + jsonBody(t, passkeys[0]["id"])
+
+		w := request(http.MethodPatch, path, `{"name":" Laptop "}`, "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, "Laptop", listPasskeys(t, cookie)[0]["name"])
+
+		_, otherCookie := createUserWithToken(t, "other@example.com", models.RoleUser)
+		assert.Equal(t, 404, request(http.MethodPatch, path, `{"name":"Mine"}`, "", otherCookie, "").Code)
+		assert.Equal(t, 404, request(http.MethodDelete, path, "", "", otherCookie, "").Code)
+
+		w = request(http.MethodDelete, path, "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Empty(t, listPasskeys(t, cookie))
+		assert.Equal(t, int64(1), countAuditEvents("auth.passkey.remove", user.ID))
+		assert.Equal(t, 401, passkeyLogin(t, authenticator).Code)
+	})
+
+	t.Run("The last passkey of a passkey account cannot be deleted", func(t *testing.T) {
+		setup(t)
+		authenticator := usePasskeys(t)
+		w := registerPasskey(t, authenticator, `{"email":"only@example.com","nickname":"only"}`, nil)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		cookie := findCookie(w, "auth_token")
+
+		passkeys := listPasskeys(t, cookie)
+		require.Len(t, passkeys, 1)
+		w = request(http.MethodDelete, "/auth/passkeys/"+jsonBody(t, passkeys[0]["id"]), "", "", cookie, "")
+		assert.Equal(t, 409, w.Code, w.Body.String())
+	})
+}
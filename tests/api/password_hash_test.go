@@ -0,0 +1,47 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	t.Run("Login upgrades a bcrypt hash to argon2id", func(t *testing.T) {
+		setup(t)
+		user, _ := createUserWithToken(t, "legacy@example.com", models.RoleUser)
+		require.True(t, strings.HasPrefix(user.Identifier, "$2a$"), "createUserWithToken stores a bcrypt hash")
+
+		w := request(http.MethodPost, "/auth/login", loginBody("legacy@example.com", "wrong-password"), "", nil, "")
+		require.Equal(t, 401, w.Code)
+		require.NoError(t, db.First(&user, user.ID).Error)
+		assert.True(t, strings.HasPrefix(user.Identifier, "$2a$"), "A failed login keeps the hash")
+
+		w = request(http.MethodPost, "/auth/login", loginBody("legacy@example.com", "password123"), "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		require.NoError(t, db.First(&user, user.ID).Error)
+		assert.True(t, strings.HasPrefix(user.Identifier, "$argon2id$"), user.Identifier)
+
+		w = request(http.MethodPost, "/auth/login", loginBody("legacy@example.com", "password123"), "", nil, "")
+		assert.Equal(t, 200, w.Code, "The upgraded hash works")
+		var again models.User
+		require.NoError(t, db.First(&again, user.ID).Error)
+		assert.Equal(t, user.Identifier, again.Identifier, "A current hash is not rewritten")
+	})
+
+	t.Run("New passwords are hashed with argon2id", func(t *testing.T) {
+		setup(t)
+		w := request(http.MethodPost, "/auth/register", `{"email":"fresh@example.com","nickname":"fresh","password":"password123"}`, "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var user models.User
+		require.NoError(t, db.Where("email = ?", "fresh@example.com").First(&user).Error)
+		assert.True(t, strings.HasPrefix(user.Identifier, "$argon2id$"), user.Identifier)
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("fresh@example.com", "password123"), "", nil, "").Code)
+	})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// policyRules returns the rules of the violations in a rejected password response
+func policyRules(t *testing.T, body []byte) []string {
+	var data struct {
+		Violations []struct {
+			Rule    string `json:"rule"`
+			Message string `json:"message"`
+		} `json:"violations"`
+	}
+	require.NoError(t, json.Unmarshal(body, &data))
+	rules := make([]string, 0, len(data.Violations))
+	for _, v := range data.Violations {
+		assert.NotEmpty(t, v.Message)
+		rules = append(rules, v.Rule)
+	}
+	return rules
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	register := func(email, nickname, password string) (int, []byte) {
+		body := `{"email":"` + email + `","nickname":"` + nickname + `","password":"` + password + `"}`
+		w := request(http.MethodPost, "/auth/register", body, "", nil, "")
+		return w.Code, w.Body.Bytes()
+	}
+
+	t.Run("Registration reports every broken rule", func(t *testing.T) {
+		setup(t)
+
+		code, body := register("policy@example.com", "policy", "short")
+		require.Equal(t, 400, code, string(body))
+		assert.Equal(t, []string{"min_length"}, policyRules(t, body))
+
+		code, body = register("policy@example.com", "maverick", "maverick-2024")
+		require.Equal(t, 400, code, string(body))
+		assert.Equal(t, []string{"personal_info"}, policyRules(t, body))
+
+		code, body = register("policy@example.com", "policy", "letmein12345")
+		require.Equal(t, 400, code, string(body))
+		assert.Equal(t, []string{"breached"}, policyRules(t, body))
+
+		var count int64
+		db.Model(&models.User{}).Where("email = ?", "policy@example.com").Count(&count)
+		assert.Equal(t, int64(0), count)
+
+		code, body = register("policy@example.com", "policy", "password123")
+		assert.Equal(t, 200, code, string(body))
+	})
+
+	t.Run("Change password checks the new password", func(t *testing.T) {
+		setup(t)
+		_, cookie := createUserWithToken(t, "changer@example.com", models.RoleUser)
+
+		w := request(http.MethodPost, "/auth/change-password", `{"old_password":"password123","new_password":"letmein12345"}`, "", cookie, "")
+		require.Equal(t, 400, w.Code, w.Body.String())
+		assert.Equal(t, []string{"breached"}, policyRules(t, w.Body.Bytes()))
+
+		w = request(http.MethodPost, "/auth/change-password", `{"old_password":"password123","new_password":"changer-secret"}`, "", cookie, "")
+		require.Equal(t, 400, w.Code, w.Body.String())
+		assert.Equal(t, []string{"personal_info"}, policyRules(t, w.Body.Bytes()))
+	})
+
+	t.Run("A rejected reset keeps the token usable", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "resetter@example.com", models.RoleUser)
+		token := requestPasswordReset(t, "resetter@example.com")
+
+		w := request(http.MethodPost, "/auth/reset-password", `{"token":"`+token+`","new_password":"letmein12345"}`, "", nil, "")
+		require.Equal(t, 400, w.Code, w.Body.String())
+		assert.Equal(t, []string{"breached"}, policyRules(t, w.Body.Bytes()))
+
+		assert.Equal(t, 200, resetPassword(token, "a-much-better-one"))
+	})
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"personal_site/models"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var resetLinkPattern = regexp.MustCompile(`\S*/auth/reset-password\?token=\S+`)
+
+// requestPasswordReset calls forgot-password and waits for the emailed token
+func requestPasswordReset(t *testing.T, email string) string {
+	w := requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"`+email+`"}`, nil)
+	require.Equal(t, 200, w.Code)
+
+	var link string
+	require.Eventually(t, func() bool {
+		msg, ok := mails.find(email)
+		link = resetLinkPattern.FindString(msg.Body)
+		return ok && link != ""
+	}, 2*time.Second, 10*time.Millisecond, "Reset email should be sent")
+
+	u, err := url.Parse(link)
+	require.NoError(t, err)
+	return u.Query().Get("token")
+}
+
+func resetPassword(token, password string) int {
+	w := requestWithCookie(http.MethodPost, "/auth/reset-password",
+		`{"token":"`+token+`","new_password":"`+password+`"}`, nil)
+	return w.Code
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Run("Reset password and invalidate sessions", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "reset@example.com")
+		authCookie := findCookie(w, "auth_token")
+		refreshCookie := findCookie(w, "refresh_token")
+
+		token := requestPasswordReset(t, "reset@example.com")
+		require.Equal(t, 200, resetPassword(token, "newpassword123"))
+
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/reurl", "", authCookie).Code, "Old access token should be revoked")
+		assert.Equal(t, 401, refresh(refreshCookie).Code, "Old session should be revoked")
+
+		assert.Equal(t, 401, requestWithCookie(http.MethodPost, "/auth/login",
+			`{"email":"reset@example.com","password":"password123"}`, nil).Code)
+		assert.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/login",
+			`{"email":"reset@example.com","password":"newpassword123"}`, nil).Code)
+
+		assert.Equal(t, 400, resetPassword(token, "anotherpassword"), "Token is single use")
+	})
+
+	t.Run("Unknown email gets the same response", func(t *testing.T) {
+		setup(t)
+
+		loginAs(t, "known@example.com")
+		known := requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"known@example.com"}`, nil)
+		unknown := requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"unknown@example.com"}`, nil)
+
+		assert.Equal(t, known.Code, unknown.Code)
+		assert.Equal(t, known.Body.String(), unknown.Body.String())
+
+		time.Sleep(50 * time.Millisecond)
+		_, sent := mails.find("unknown@example.com")
+		assert.False(t, sent)
+	})
+
+	t.Run("Reset emails are limited per address", func(t *testing.T) {
+		setup(t)
+
+		for range 5 {
+			require.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"flood@example.com"}`, nil).Code)
+		}
+		w := requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"Flood@example.com"}`, nil)
+		assert.Equal(t, 429, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+		assert.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/forgot-password", `{"email":"other@example.com"}`, nil).Code)
+	})
+
+	t.Run("Expired, replaced and invalid tokens are rejected", func(t *testing.T) {
+		setup(t)
+
+		loginAs(t, "expired@example.com")
+		first := requestPasswordReset(t, "expired@example.com")
+		mails.sent = nil
+		second := requestPasswordReset(t, "expired@example.com")
+
+		assert.Equal(t, 400, resetPassword(first, "newpassword123"), "Older token is replaced")
+		assert.Equal(t, 400, resetPassword("not-a-token", "newpassword123"))
+
+		db.Model(&models.PasswordResetToken{}).Where("used_at IS NULL").Update("expires_at", time.Now().Add(-time.Minute))
+		assert.Equal(t, 400, resetPassword(second, "newpassword123"), "Expired token is rejected")
+	})
+}
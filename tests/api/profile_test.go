@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"personal_site/controllers/storage"
+	"personal_site/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// userStorageFile creates a file in the storage tree of user and removes the tree after the test
+func userStorageFile(t *testing.T, user models.User, nickname, name string) string {
+	root, err := storage.GetStorageRoot()
+	require.NoError(t, err)
+	dataPath := filepath.Join(root, "data", strconv.FormatUint(uint64(user.ID), 10))
+	t.Cleanup(func() {
+		os.RemoveAll(dataPath)
+		// Only removed when no other test left files
+		os.Remove(filepath.Dir(dataPath))
+		os.Remove(root)
+	})
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dataPath, nickname), 0o755))
+	path := filepath.Join(dataPath, nickname, name)
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0o644))
+	return path
+}
+
+func tokenNickname(t *testing.T, token string) string {
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, claims)
+	require.NoError(t, err)
+	return claims["payload"].(map[string]any)["nickname"].(string)
+}
+
+func TestProfile(t *testing.T) {
+	t.Run("Get the current user", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "me@example.com", models.RoleUser)
+		w := request(http.MethodGet, "/auth/me", "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var data map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		assert.Equal(t, float64(user.ID), data["id"])
+		assert.Equal(t, "me@example.com", data["email"])
+		assert.Equal(t, "testuser", data["nickname"])
+		assert.Equal(t, "password", data["provider"])
+		assert.Equal(t, true, data["email_verified"])
+		assert.Equal(t, false, data["mfa_enabled"])
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", nil, "").Code)
+	})
+
+	t.Run("Update the nickname reissues the cookie", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "rename@example.com", models.RoleUser)
+		oldFile := userStorageFile(t, user, "testuser", "notes.txt")
+
+		w := request(http.MethodPatch, "/auth/me", `{"nickname":"  renamed "}`, "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		newCookie := findCookie(w, "auth_token")
+		require.NotNil(t, newCookie)
+		assert.Equal(t, "renamed", tokenNickname(t, newCookie.Value))
+
+		var updated models.User
+		require.NoError(t, db.First(&updated, user.ID).Error)
+		assert.Equal(t, "renamed", updated.Nickname)
+		assert.Equal(t, int64(1), countAuditEvents("auth.profile.update", user.ID))
+
+		assert.NoFileExists(t, oldFile)
+		assert.FileExists(t, filepath.Join(filepath.Dir(filepath.Dir(oldFile)), "renamed", "notes.txt"),
+			"Files move to the folder of the new nickname")
+
+		w = request(http.MethodGet, "/auth/me", "", "", newCookie, "")
+		require.Equal(t, 200, w.Code)
+		assert.Contains(t, w.Body.String(), `"nickname":"renamed"`)
+	})
+
+	t.Run("Bearer clients get the new token in the body", func(t *testing.T) {
+		setup(t)
+
+		createUserWithToken(t, "bearer-rename@example.com", models.RoleUser)
+		tokens := decodeTokens(t, request(http.MethodPost, "/auth/token", loginBody("bearer-rename@example.com", "password123"), "", nil, ""))
+
+		w := request(http.MethodPatch, "/auth/me", `{"nickname":"bearer"}`, "Bearer "+tokens.AccessToken, nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Nil(t, findCookie(w, "auth_token"))
+
+		var data struct {
+			AccessToken string `json:"access_token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+		assert.Equal(t, "bearer", tokenNickname(t, data.AccessToken))
+
+		// The new token belongs to the same session, refreshing keeps working
+		w = request(http.MethodPost, "/auth/refresh", `{"refresh_token":"`+tokens.RefreshToken+`"}`, "", nil, "")
+		assert.Equal(t, "bearer", tokenNickname(t, decodeTokens(t, w).AccessToken))
+	})
+
+	t.Run("Invalid nicknames", func(t *testing.T) {
+		setup(t)
+
+		_, cookie := createUserWithToken(t, "invalid-nickname@example.com", models.RoleUser)
+		for _, nickname := range []string{`""`, `"   "`, `".."`, `"a/b"`, `"a\\b"`, `"` + string(make([]byte, 65)) + `"`} {
+			assert.Equal(t, 400, request(http.MethodPatch, "/auth/me", `{"nickname":`+nickname+`}`, "", cookie, "").Code, nickname)
+		}
+	})
+
+	t.Run("Delete the account", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "delete-me@example.com", models.RoleUser)
+		other, _ := createUserWithToken(t, "keep-me@example.com", models.RoleUser)
+		require.NoError(t, db.Create(&models.Reurl{Key: "mine", TargetURL: "https://example.com", OwnerID: user.ID}).Error)
+		require.NoError(t, db.Create(&models.Reurl{Key: "theirs", TargetURL: "https://example.com", OwnerID: other.ID}).Error)
+		file := userStorageFile(t, user, "testuser", "notes.txt")
+
+		assert.Equal(t, 400, request(http.MethodDelete, "/auth/me", "", "", cookie, "").Code, "Password is required")
+		assert.Equal(t, 401, request(http.MethodDelete, "/auth/me", `{"password":"wrong-password"}`, "", cookie, "").Code)
+
+		w := request(http.MethodDelete, "/auth/me", `{"password":"password123"}`, "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		var count int64
+		db.Model(&models.User{}).Where("id = ?", user.ID).Count(&count)
+		assert.Zero(t, count)
+		db.Unscoped().Model(&models.Reurl{}).Where("owner_id = ?", user.ID).Count(&count)
+		assert.Zero(t, count, "Reurls are deleted for good")
+		db.Model(&models.Reurl{}).Where("owner_id = ?", other.ID).Count(&count)
+		assert.Equal(t, int64(1), count)
+		assert.NoFileExists(t, file)
+		assert.Equal(t, int64(2), countAuditEvents("auth.account.delete", user.ID), "The wrong password and the deletion")
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", cookie, "").Code, "The token must not work anymore")
+		assert.Equal(t, 401, request(http.MethodPost, "/auth/login", loginBody(user.Email, "password123"), "", nil, "").Code)
+	})
+
+	t.Run("Accounts without a password delete after a recent login", func(t *testing.T) {
+		setup(t)
+
+		code, cookie, data := useMagicLink(requestMagicLink(t, "passwordless@example.com"))
+		require.Equal(t, 200, code, data)
+		userID := uint(data["user_id"].(float64))
+		require.NoError(t, db.Model(&models.Session{}).Where("user_id = ?", userID).
+			UpdateColumn("created_at", time.Now().Add(-time.Hour)).Error)
+
+		w := request(http.MethodDelete, "/auth/me", "", "", cookie, "")
+		assert.Equal(t, 403, w.Code, "An old login is not enough")
+		assert.Contains(t, w.Body.String(), `"reauth_required":true`)
+		assert.NoError(t, db.First(&models.User{}, userID).Error)
+
+		code, cookie, data = useMagicLink(requestMagicLink(t, "passwordless@example.com"))
+		require.Equal(t, 200, code, data)
+		w = request(http.MethodDelete, "/auth/me", "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.ErrorIs(t, db.First(&models.User{}, userID).Error, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("A deleted email can register again", func(t *testing.T) {
+		setup(t)
+
+		user, cookie := createUserWithToken(t, "again@example.com", models.RoleUser)
+		require.Equal(t, 200, request(http.MethodDelete, "/auth/me", `{"password":"password123"}`, "", cookie, "").Code)
+
+		w := request(http.MethodPost, "/auth/register", `{"email":"again@example.com","nickname":"again","password":"another-password"}`, "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.NotEqual(t, user.ID, loggedInUserID(t, w))
+		assert.Equal(t, 200, request(http.MethodPost, "/auth/login", loginBody("again@example.com", "another-password"), "", nil, "").Code)
+
+		code, _, _ := useMagicLink(requestMagicLink(t, "again@example.com"))
+		assert.Equal(t, 200, code, "The deleted account does not hold the email")
+	})
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReurlPermissions(t *testing.T) {
+	setup(t)
+
+	owner, ownerCookie := createUserWithToken(t, "reurl-owner@example.com", models.RoleUser)
+	_, otherCookie := createUserWithToken(t, "reurl-other@example.com", models.RoleUser)
+	_, adminCookie := createUserWithToken(t, "reurl-admin@example.com", models.RoleAdmin)
+
+	reurl := models.Reurl{Key: "perm", TargetURL: "https://example.com", OwnerID: owner.ID}
+	require.NoError(t, db.Create(&reurl).Error)
+	path := "/reurl/" + strconv.FormatUint(uint64(reurl.ID), 10)
+
+	countListed := func(cookie *http.Cookie) int {
+		w := request(http.MethodGet, "/reurl", "", "", cookie, "")
+		require.Equal(t, 200, w.Code)
+		var resp struct {
+			Data []models.Reurl `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return len(resp.Data)
+	}
+	assert.Equal(t, 1, countListed(ownerCookie))
+	assert.Equal(t, 0, countListed(otherCookie))
+	assert.Equal(t, 1, countListed(adminCookie))
+
+	assert.Equal(t, 200, request(http.MethodGet, path, "", "", ownerCookie, "").Code)
+	assert.Equal(t, 403, request(http.MethodGet, path, "", "", otherCookie, "").Code)
+	assert.Equal(t, 200, request(http.MethodGet, path, "", "", adminCookie, "").Code)
+
+	assert.Equal(t, 403, request(http.MethodPatch, path, `{"target_url":"https://evil.example.com"}`, "", otherCookie, "").Code)
+	assert.Equal(t, 200, request(http.MethodPatch, path, `{"target_url":"https://example.org"}`, "", ownerCookie, "").Code)
+	assert.Equal(t, 200, request(http.MethodPatch, path, `{"target_url":"https://example.net"}`, "", adminCookie, "").Code)
+
+	assert.Equal(t, 403, request(http.MethodDelete, path, "", "", otherCookie, "").Code)
+	assert.Equal(t, 200, request(http.MethodDelete, path, "", "", adminCookie, "").Code)
+	assert.Equal(t, 404, request(http.MethodDelete, path, "", "", ownerCookie, "").Code)
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"personal_site/models"
+	"personal_site/schemas"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requestWithCookie sends a request with the given auth_token cookie and returns the recorder
+func requestWithCookie(method, path, body string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// tokenID returns the jti of an auth_token cookie without verifying it
+func tokenID(t *testing.T, cookie *http.Cookie) string {
+	claims := &schemas.TokenClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(cookie.Value, claims)
+	require.NoError(t, err)
+	return claims.ID
+}
+
+func TestTokenRevocation(t *testing.T) {
+	t.Run("Admin revokes a single token", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "admin@example.com", models.RoleAdmin)
+		_, userCookie := createUserWithToken(t, "user@example.com", models.RoleUser)
+
+		assert.Equal(t, 200, requestWithCookie(http.MethodGet, "/reurl", "", userCookie).Code)
+
+		w := requestWithCookie(http.MethodPost, "/admin/tokens/revoke",
+			`{"token_id":"`+tokenID(t, userCookie)+`"}`, adminCookie)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/reurl", "", userCookie).Code, "Revoked token should be rejected")
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/storage/folder/", "", userCookie).Code, "AuthOptional should reject revoked token too")
+
+		var count int64
+		db.Model(&models.RevokedToken{}).Count(&count)
+		assert.Equal(t, int64(1), count)
+	})
+
+	t.Run("Revoking the token of a session rejects its other tokens at once", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "admin@example.com", models.RoleAdmin)
+		login := loginAs(t, "session-user@example.com")
+		first := findCookie(login, "auth_token")
+		assert.Equal(t, 200, requestWithCookie(http.MethodGet, "/reurl", "", first).Code)
+
+		refreshed := refresh(findCookie(login, "refresh_token"))
+		require.Equal(t, 200, refreshed.Code)
+		latest := findCookie(refreshed, "auth_token")
+
+		w := requestWithCookie(http.MethodPost, "/admin/tokens/revoke", `{"token_id":"`+tokenID(t, latest)+`"}`, adminCookie)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/reurl", "", first).Code, "The session is revoked")
+		var session models.Session
+		require.NoError(t, db.First(&session).Error)
+		assert.Equal(t, "admin", session.RevokeReason)
+	})
+
+	t.Run("Admin revokes every token of a user", func(t *testing.T) {
+		setup(t)
+
+		_, adminCookie := createUserWithToken(t, "admin@example.com", models.RoleAdmin)
+		user, userCookie := createUserWithToken(t, "user@example.com", models.RoleUser)
+
+		w := requestWithCookie(http.MethodPost, "/admin/users/"+strconv.Itoa(int(user.ID))+"/revoke-tokens", "", adminCookie)
+		assert.Equal(t, 200, w.Code)
+
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/reurl", "", userCookie).Code, "Old token should be rejected")
+		assert.Equal(t, 200, requestWithCookie(http.MethodGet, "/reurl", "", adminCookie).Code, "Other users are not affected")
+	})
+
+	t.Run("Non admin cannot revoke tokens", func(t *testing.T) {
+		setup(t)
+
+		_, userCookie := createUserWithToken(t, "user@example.com", models.RoleUser)
+
+		w := requestWithCookie(http.MethodPost, "/admin/tokens/revoke", `{"token_id":"whatever"}`, userCookie)
+		assert.Equal(t, 403, w.Code)
+	})
+
+	t.Run("Logout revokes the access token", func(t *testing.T) {
+		setup(t)
+
+		_, userCookie := createUserWithToken(t, "user@example.com", models.RoleUser)
+
+		assert.Equal(t, 200, requestWithCookie(http.MethodPost, "/auth/logout", "", userCookie).Code)
+		assert.Equal(t, 401, requestWithCookie(http.MethodGet, "/reurl", "", userCookie).Code)
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginFrom logs in the user of email from a device with userAgent and returns the auth_token cookie
+func loginFrom(t *testing.T, email, userAgent string) *http.Cookie {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(loginBody(email, "password123")))
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("User-Agent", userAgent)
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code, w.Body.String())
+	cookie := findCookie(w, "auth_token")
+	require.NotNil(t, cookie)
+	return cookie
+}
+
+func listSessions(t *testing.T, cookie *http.Cookie) []map[string]any {
+	w := request(http.MethodGet, "/auth/sessions", "", "", cookie, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	var data struct {
+		Sessions []map[string]any `json:"sessions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	return data.Sessions
+}
+
+func sessionPath(session map[string]any) string {
+	return "/auth/sessions/" + strconv.FormatFloat(session["id"].(float64), 'f', 0, 64)
+}
+
+func TestSessionList(t *testing.T) {
+	t.Run("List the sessions with their device", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "devices@example.com", models.RoleUser)
+
+		laptop := loginFrom(t, "devices@example.com", "Laptop Browser")
+		loginFrom(t, "devices@example.com", "Phone Browser")
+
+		sessions := listSessions(t, laptop)
+		require.Len(t, sessions, 2)
+		byAgent := map[string]map[string]any{}
+		for _, s := range sessions {
+			byAgent[s["user_agent"].(string)] = s
+		}
+		require.Contains(t, byAgent, "Laptop Browser")
+		require.Contains(t, byAgent, "Phone Browser")
+		assert.Equal(t, true, byAgent["Laptop Browser"]["current"])
+		assert.Equal(t, false, byAgent["Phone Browser"]["current"])
+		assert.Equal(t, "198.51.100.7", byAgent["Laptop Browser"]["ip"])
+		assert.Equal(t, []any{"pwd"}, byAgent["Laptop Browser"]["auth_methods"])
+		assert.NotNil(t, byAgent["Laptop Browser"]["last_seen_at"])
+		assert.NotNil(t, byAgent["Laptop Browser"]["created_at"])
+
+		_, other := createUserWithToken(t, "someone@example.com", models.RoleUser)
+		assert.Empty(t, listSessions(t, other), "Only the own sessions are listed")
+		assert.Equal(t, 404, request(http.MethodDelete, sessionPath(byAgent["Phone Browser"]), "", "", other, "").Code)
+	})
+
+	t.Run("Sign out another device", func(t *testing.T) {
+		setup(t)
+		user, _ := createUserWithToken(t, "remote@example.com", models.RoleUser)
+
+		laptop := loginFrom(t, "remote@example.com", "Laptop Browser")
+		phone := loginFrom(t, "remote@example.com", "Phone Browser")
+
+		var phoneSession map[string]any
+		for _, s := range listSessions(t, laptop) {
+			if s["user_agent"] == "Phone Browser" {
+				phoneSession = s
+			}
+		}
+		require.NotNil(t, phoneSession)
+
+		w := request(http.MethodDelete, sessionPath(phoneSession), "", "", laptop, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Nil(t, findCookie(w, "auth_token"), "The cookies of this device are kept")
+		assert.Equal(t, int64(1), countAuditEvents("auth.session.revoke", user.ID))
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", phone, "").Code, "The access token of the revoked session is rejected")
+		assert.Equal(t, 200, request(http.MethodGet, "/auth/me", "", "", laptop, "").Code)
+		assert.Len(t, listSessions(t, laptop), 1)
+
+		assert.Equal(t, 404, request(http.MethodDelete, sessionPath(phoneSession), "", "", laptop, "").Code, "Already signed out")
+	})
+
+	t.Run("Sign out all other devices", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "others@example.com", models.RoleUser)
+
+		current := loginFrom(t, "others@example.com", "Laptop Browser")
+		phone := loginFrom(t, "others@example.com", "Phone Browser")
+		tablet := loginFrom(t, "others@example.com", "Tablet Browser")
+
+		w := request(http.MethodDelete, "/auth/sessions", "", "", current, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"revoked":2`)
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", phone, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", tablet, "").Code)
+		sessions := listSessions(t, current)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, true, sessions[0]["current"])
+	})
+
+	t.Run("Sign out the current session", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "self@example.com", models.RoleUser)
+		cookie := loginFrom(t, "self@example.com", "Laptop Browser")
+
+		w := request(http.MethodDelete, sessionPath(listSessions(t, cookie)[0]), "", "", cookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		cleared := findCookie(w, "auth_token")
+		require.NotNil(t, cleared)
+		assert.Empty(t, cleared.Value)
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", cookie, "").Code)
+	})
+}
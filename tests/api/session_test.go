@@ -0,0 +1,140 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"personal_site/models"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// findCookie returns the cookie named name set by the response, or nil
+func findCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// loginAs creates a password user and logs in, returning the login response
+func loginAs(t *testing.T, email string) *httptest.ResponseRecorder {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	db.Create(&models.User{
+		Nickname:   "testuser",
+		Role:       models.RoleUser,
+		Provider:   models.AuthProviderPassword,
+		Email:      email,
+		Identifier: string(hashedPassword),
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/auth/login",
+		strings.NewReader(`{"email":"`+email+`","password":"password123"}`))
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+	return w
+}
+
+func refresh(refreshCookie *http.Cookie) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.AddCookie(refreshCookie)
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestSession(t *testing.T) {
+	t.Run("Login creates a session and sets a refresh token", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "test-session@example.com")
+
+		refreshCookie := findCookie(w, "refresh_token")
+		require.NotNil(t, refreshCookie, "refresh_token cookie should be set")
+		assert.True(t, refreshCookie.HttpOnly)
+
+		var session models.Session
+		err := db.First(&session).Error
+		assert.NoError(t, err, "Session should be created")
+		assert.Nil(t, session.RevokedAt)
+		assert.NotEmpty(t, session.TokenID, "Session should be tied to the access token jti")
+		assert.NotContains(t, refreshCookie.Value, session.RefreshTokenHash, "Only the hash should be stored")
+	})
+
+	t.Run("Refresh rotates the refresh token", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "test-refresh@example.com")
+		first := findCookie(w, "refresh_token")
+
+		w1 := refresh(first)
+		assert.Equal(t, 200, w1.Code)
+		second := findCookie(w1, "refresh_token")
+		require.NotNil(t, second)
+		assert.NotEqual(t, first.Value, second.Value, "Refresh token should be rotated")
+		assert.NotNil(t, findCookie(w1, "auth_token"), "A new access token should be issued")
+
+		w2 := refresh(second)
+		assert.Equal(t, 200, w2.Code, "Rotated refresh token should be usable")
+	})
+
+	t.Run("Reusing a refresh token revokes the session", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "test-reuse@example.com")
+		first := findCookie(w, "refresh_token")
+
+		w1 := refresh(first)
+		require.Equal(t, 200, w1.Code)
+		second := findCookie(w1, "refresh_token")
+
+		wReuse := refresh(first)
+		assert.Equal(t, 401, wReuse.Code, "Old refresh token should be rejected")
+
+		wAfter := refresh(second)
+		assert.Equal(t, 401, wAfter.Code, "Whole session should be revoked after reuse")
+
+		var session models.Session
+		db.First(&session)
+		assert.NotNil(t, session.RevokedAt)
+		assert.Equal(t, "refresh_token_reuse", session.RevokeReason)
+	})
+
+	t.Run("Logout revokes the session", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "test-session-logout@example.com")
+		refreshCookie := findCookie(w, "refresh_token")
+
+		wLogout := httptest.NewRecorder()
+		reqLogout, _ := http.NewRequest(http.MethodPost, "/auth/logout", nil)
+		reqLogout.AddCookie(findCookie(w, "auth_token"))
+		router.ServeHTTP(wLogout, reqLogout)
+		assert.Equal(t, 200, wLogout.Code)
+
+		wAfter := refresh(refreshCookie)
+		assert.Equal(t, 401, wAfter.Code, "Refresh token should not work after logout")
+	})
+
+	t.Run("Logout ignores a refresh cookie with a wrong secret", func(t *testing.T) {
+		setup(t)
+
+		w := loginAs(t, "test-session-forged@example.com")
+		refreshCookie := findCookie(w, "refresh_token")
+		publicID, _, _ := strings.Cut(refreshCookie.Value, ".")
+
+		wLogout := httptest.NewRecorder()
+		reqLogout, _ := http.NewRequest(http.MethodPost, "/auth/logout", nil)
+		reqLogout.AddCookie(&http.Cookie{Name: "refresh_token", Value: publicID + ".x"})
+		router.ServeHTTP(wLogout, reqLogout)
+		assert.Equal(t, 200, wLogout.Code)
+
+		assert.Equal(t, 200, refresh(refreshCookie).Code, "Only the holder of the secret can end the session")
+	})
+}
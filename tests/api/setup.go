@@ -1,22 +1,68 @@
 package api
 
 import (
+	"net/http"
+	"personal_site/attempts"
+	authController "personal_site/controllers/auth"
 	"personal_site/database"
+	"personal_site/mailer"
+	"personal_site/models"
 	"personal_site/routers"
+	"personal_site/schemas"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 var router *gin.Engine
 var db *gorm.DB
+var mails *captureMailer
+
+// captureMailer keeps sent emails in memory instead of delivering them
+type captureMailer struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *captureMailer) Send(msg mailer.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// find returns the latest email sent to address
+func (m *captureMailer) find(address string) (mailer.Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == address {
+			return m.sent[i], true
+		}
+	}
+	return mailer.Message{}, false
+}
+
+// last returns the latest email sent to address and fails the test when there is none
+func (m *captureMailer) last(t *testing.T, address string) mailer.Message {
+	msg, ok := m.find(address)
+	if !ok {
+		t.Fatalf("No email sent to %s", address)
+	}
+	return msg
+}
 
 func setup(t *testing.T) {
 	t.Setenv("DATABASE_DSN", ":memory:")
 	t.Setenv("JWT_SECRET_KEY", "testsecretkey")
 	t.Setenv("DEFAULT_TOKEN_EXPIRATION", "12h")
 	t.Setenv("YT_DATA_API_TOKEN", "YT_DATA_API_TOKEN")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "http://localhost:3000")
+	t.Setenv("PASSWORD_BREACH_DIR", "testdata/breached") // lists letmein12345
 
 	var err error
 	db, err = database.InitDB()
@@ -24,6 +70,40 @@ func setup(t *testing.T) {
 		panic(err)
 	}
 
+	mails = &captureMailer{}
+	mailer.SetDefault(mails)
+	attempts.SetDefault(attempts.NewMemoryStore())
+
 	router = gin.Default()
+	if err := routers.SetTrustedProxies(router); err != nil {
+		panic(err)
+	}
 	routers.RegisterRouters(router, db)
 }
+
+// createUserWithToken creates a verified password user with role and returns it with a valid auth_token cookie
+func createUserWithToken(t *testing.T, email string, role models.Role) (models.User, *http.Cookie) {
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte("password123"), bcrypt.DefaultCost)
+	now := time.Now()
+	user := models.User{
+		Nickname:        "testuser",
+		Role:            role,
+		Provider:        models.AuthProviderPassword,
+		Email:           email,
+		Identifier:      string(hashedPassword),
+		EmailVerifiedAt: &now,
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	token, err := authController.GenerateToken(schemas.TokenPayload{
+		UserID:   user.ID,
+		Role:     string(user.Role),
+		Nickname: user.Nickname,
+	}, user.ID)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	return user, &http.Cookie{Name: "auth_token", Value: token}
+}
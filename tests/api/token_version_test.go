@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"personal_site/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loginWithRefresh logs in the user of email and returns the auth_token and refresh_token cookies
+func loginWithRefresh(t *testing.T, email string) (*http.Cookie, *http.Cookie) {
+	w := request(http.MethodPost, "/auth/login", loginBody(email, "password123"), "", nil, "")
+	require.Equal(t, 200, w.Code, w.Body.String())
+	access, refreshCookie := findCookie(w, "auth_token"), findCookie(w, "refresh_token")
+	require.NotNil(t, access)
+	require.NotNil(t, refreshCookie)
+	return access, refreshCookie
+}
+
+func TestTokenVersion(t *testing.T) {
+	t.Run("A demoted admin loses admin access at once", func(t *testing.T) {
+		setup(t)
+		_, adminCookie := createUserWithToken(t, "boss@example.com", models.RoleAdmin)
+		demoted, _ := createUserWithToken(t, "demoted@example.com", models.RoleAdmin)
+		access, refreshCookie := loginWithRefresh(t, "demoted@example.com")
+		require.Equal(t, 200, request(http.MethodGet, "/admin/users", "", "", access, "").Code)
+
+		w := request(http.MethodPatch, userPath(demoted, "/role"), `{"role":"user"}`, "", adminCookie, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		w = request(http.MethodGet, "/admin/users", "", "", access, "")
+		assert.Equal(t, 401, w.Code)
+		assert.Contains(t, w.Body.String(), "Token is outdated")
+
+		// The session survives, its next token carries the new role
+		w = refresh(refreshCookie)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		access = findCookie(w, "auth_token")
+		assert.Equal(t, 403, request(http.MethodGet, "/admin/users", "", "", access, "").Code)
+		assert.Equal(t, 200, request(http.MethodGet, "/auth/me", "", "", access, "").Code)
+	})
+
+	t.Run("A password change logs out the other sessions", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "changer@example.com", models.RoleUser)
+		here, _ := loginWithRefresh(t, "changer@example.com")
+		there, thereRefresh := loginWithRefresh(t, "changer@example.com")
+
+		w := request(http.MethodPost, "/auth/change-password", `{"old_password":"password123","new_password":"newpassword123"}`, "", here, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		newHere := findCookie(w, "auth_token")
+		require.NotNil(t, newHere, "This session gets a token of the new version")
+
+		assert.Equal(t, 200, request(http.MethodGet, "/auth/me", "", "", newHere, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", here, "").Code)
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", there, "").Code)
+		assert.Equal(t, 401, refresh(thereRefresh).Code, "The other session is revoked")
+
+		w = request(http.MethodPost, "/auth/login", loginBody("changer@example.com", "newpassword123"), "", nil, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 200, request(http.MethodGet, "/auth/me", "", "", findCookie(w, "auth_token"), "").Code, "A new login gets a token of the current version")
+	})
+
+	t.Run("A nickname change outdates the tokens of other sessions", func(t *testing.T) {
+		setup(t)
+		createUserWithToken(t, "renamer@example.com", models.RoleUser)
+		here, _ := loginWithRefresh(t, "renamer@example.com")
+		there, thereRefresh := loginWithRefresh(t, "renamer@example.com")
+
+		w := request(http.MethodPatch, "/auth/me", `{"nickname":"renamed"}`, "", here, "")
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, 200, request(http.MethodGet, "/auth/me", "", "", findCookie(w, "auth_token"), "").Code)
+
+		assert.Equal(t, 401, request(http.MethodGet, "/auth/me", "", "", there, "").Code)
+		w = refresh(thereRefresh)
+		require.Equal(t, 200, w.Code, w.Body.String())
+		assert.Equal(t, "renamed", tokenNickname(t, findCookie(w, "auth_token").Value))
+	})
+}
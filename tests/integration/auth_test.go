@@ -25,6 +25,9 @@ func setup(t *testing.T) {
 	}
 
 	router = gin.Default()
+	if err := routers.SetTrustedProxies(router); err != nil {
+		panic(err)
+	}
 	routers.RegisterRouters(router, db)
 }
 
@@ -0,0 +1,52 @@
+package webauthn
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	// Examples of RFC 8949, appendix A
+	for encoded, want := range map[string]any{
+		"00":                 int64(0),
+		"1903e8":             int64(1000),
+		"3863":               int64(-100),
+		"4401020304":         []byte{1, 2, 3, 4},
+		"6449455446":         "IETF",
+		"83010203":           []any{int64(1), int64(2), int64(3)},
+		"a201020304":         map[any]any{int64(1): int64(2), int64(3): int64(4)},
+		"a26161016162820203": map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}},
+		"f5":                 true,
+		"f6":                 nil,
+		"c11a514b67b0":       int64(1363896240), // tag 1 is skipped
+	} {
+		data, err := hex.DecodeString(encoded)
+		require.NoError(t, err)
+		got, n, err := decodeCBOR(data)
+		require.NoError(t, err, encoded)
+		assert.Equal(t, want, got, encoded)
+		assert.Equal(t, len(data), n, encoded)
+	}
+
+	got, n, err := decodeCBOR([]byte{0x01, 0x02})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), got)
+	assert.Equal(t, 1, n, "Only the first item is decoded")
+
+	for _, invalid := range []string{
+		"",
+		"5f",                 // indefinite length
+		"44010203",           // truncated byte string
+		"a2010201",           // map misses a value
+		"a201020102",         // duplicate key
+		"9bffffffffffffffff", // huge array
+		"a1f501",             // boolean map key
+	} {
+		data, _ := hex.DecodeString(invalid)
+		_, _, err := decodeCBOR(data)
+		assert.Error(t, err, invalid)
+	}
+}
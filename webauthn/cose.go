@@ -0,0 +1,117 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) accepted for passkeys
+const (
+	AlgES256 int64 = -7
+	AlgEdDSA int64 = -8
+	AlgRS256 int64 = -257
+)
+
+// SupportedAlgorithms is the order of preference sent as pubKeyCredParams
+var SupportedAlgorithms = []int64{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters
+const (
+	coseKty = 1
+	coseAlg = 3
+	coseCrv = -1 // EC2 and OKP, for RSA it is n
+	coseX   = -2 // EC2 and OKP, for RSA it is e
+	coseY   = -3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+var errUnsupportedKey = errors.New("webauthn: unsupported public key")
+
+// coseKey is a parsed credential public key
+type coseKey struct {
+	Alg int64
+	Key crypto.PublicKey
+}
+
+// parseCOSEKey parses a COSE_Key of an ES256, EdDSA (Ed25519) or RS256 credential
+func parseCOSEKey(data []byte) (coseKey, error) {
+	v, n, err := decodeCBOR(data)
+	if err != nil {
+		return coseKey{}, err
+	}
+	if n != len(data) {
+		return coseKey{}, errors.New("webauthn: trailing data after the public key")
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return coseKey{}, errUnsupportedKey
+	}
+
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	switch {
+	case kty == coseKtyEC2 && alg == AlgES256:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		y, _ := m[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return coseKey{}, errUnsupportedKey
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return coseKey{}, errors.New("webauthn: public key is not on the curve")
+		}
+		return coseKey{Alg: alg, Key: key}, nil
+
+	case kty == coseKtyOKP && alg == AlgEdDSA:
+		crv, _ := m[int64(coseCrv)].(int64)
+		x, _ := m[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return coseKey{}, errUnsupportedKey
+		}
+		return coseKey{Alg: alg, Key: ed25519.PublicKey(x)}, nil
+
+	case kty == coseKtyRSA && alg == AlgRS256:
+		n, _ := m[int64(coseCrv)].([]byte)
+		e, _ := m[int64(coseX)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return coseKey{}, errUnsupportedKey
+		}
+		return coseKey{Alg: alg, Key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	}
+	return coseKey{}, fmt.Errorf("%w: kty %d, alg %d", errUnsupportedKey, kty, alg)
+}
+
+// verify checks sig over data with the algorithm of the key
+func (k coseKey) verify(data, sig []byte) error {
+	switch key := k.Key.(type) {
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(data)
+		if ecdsa.VerifyASN1(key, sum[:], sig) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		sum := sha256.Sum256(data)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("webauthn: invalid signature")
+}
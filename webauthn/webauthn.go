@@ -0,0 +1,380 @@
+// Package webauthn verifies the registration and authentication ceremonies of WebAuthn
+// passkeys (https://www.w3.org/TR/webauthn-3/). Attestation statements are not verified,
+// credentials are requested with attestation "none".
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Authenticator data flags
+const (
+	FlagUserPresent    byte = 0x01
+	FlagUserVerified   byte = 0x04
+	FlagBackupEligible byte = 0x08
+	FlagBackedUp       byte = 0x10
+	FlagAttestedData   byte = 0x40
+	FlagExtensionData  byte = 0x80
+)
+
+// Client data types
+const (
+	typeCreate = "webauthn.create"
+	typeGet    = "webauthn.get"
+)
+
+var (
+	ErrSignCountRegressed = errors.New("webauthn: signature counter did not increase, the authenticator may be cloned")
+	errUserNotVerified    = errors.New("webauthn: user verification is required")
+)
+
+// Config is the relying party: the passkeys are scoped to RPID and the ceremonies must run
+// on one of Origins
+type Config struct {
+	RPID    string
+	RPName  string
+	Origins []string
+	Timeout int // milliseconds the browser waits for the user
+}
+
+// URLEncodedBytes is binary data encoded as unpadded base64url in JSON, like the WebAuthn
+// JSON serialization of PublicKeyCredential does
+type URLEncodedBytes []byte
+
+func (b URLEncodedBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *URLEncodedBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// CredentialDescriptor identifies a credential in allowCredentials and excludeCredentials
+type CredentialDescriptor struct {
+	Type       string          `json:"type"`
+	ID         URLEncodedBytes `json:"id"`
+	Transports []string        `json:"transports,omitempty"`
+}
+
+// User is the account a passkey is created for. ID is the user handle, it must not contain
+// personal data.
+type User struct {
+	ID          URLEncodedBytes `json:"id"`
+	Name        string          `json:"name"`
+	DisplayName string          `json:"displayName"`
+}
+
+type relyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// CreationOptions are the publicKey options of navigator.credentials.create
+type CreationOptions struct {
+	RP                     relyingParty           `json:"rp"`
+	User                   User                   `json:"user"`
+	Challenge              URLEncodedBytes        `json:"challenge"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout,omitempty"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the publicKey options of navigator.credentials.get
+type RequestOptions struct {
+	Challenge        URLEncodedBytes        `json:"challenge"`
+	Timeout          int                    `json:"timeout,omitempty"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// RegistrationResponse is the JSON of the PublicKeyCredential returned by create()
+type RegistrationResponse struct {
+	ID       string          `json:"id"`
+	RawID    URLEncodedBytes `json:"rawId"`
+	Type     string          `json:"type"`
+	Response struct {
+		ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+		AttestationObject URLEncodedBytes `json:"attestationObject"`
+		Transports        []string        `json:"transports"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the JSON of the PublicKeyCredential returned by get()
+type AssertionResponse struct {
+	ID       string          `json:"id"`
+	RawID    URLEncodedBytes `json:"rawId"`
+	Type     string          `json:"type"`
+	Response struct {
+		ClientDataJSON    URLEncodedBytes `json:"clientDataJSON"`
+		AuthenticatorData URLEncodedBytes `json:"authenticatorData"`
+		Signature         URLEncodedBytes `json:"signature"`
+		UserHandle        URLEncodedBytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+// Credential is a verified new passkey, PublicKey is its COSE_Key
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+	AAGUID    []byte
+	Flags     byte
+}
+
+// Assertion is a verified login with a passkey
+type Assertion struct {
+	SignCount uint32
+	Flags     byte
+}
+
+// clientData is the part of CollectedClientData that is checked
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// authenticatorData is the parsed authData of a ceremony
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// NewCreationOptions builds the options to register a discoverable, user verified passkey
+// for user. exclude are the credentials the user already has.
+func (cfg Config) NewCreationOptions(user User, challenge []byte, exclude []CredentialDescriptor) CreationOptions {
+	params := make([]credentialParameter, 0, len(SupportedAlgorithms))
+	for _, alg := range SupportedAlgorithms {
+		params = append(params, credentialParameter{Type: "public-key", Alg: alg})
+	}
+	if exclude == nil {
+		exclude = []CredentialDescriptor{}
+	}
+	return CreationOptions{
+		RP:                 relyingParty{ID: cfg.RPID, Name: cfg.RPName},
+		User:               user,
+		Challenge:          challenge,
+		PubKeyCredParams:   params,
+		Timeout:            cfg.Timeout,
+		ExcludeCredentials: exclude,
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "required",
+		},
+		Attestation: "none",
+	}
+}
+
+// NewRequestOptions builds the options to log in with any passkey of the relying party
+func (cfg Config) NewRequestOptions(challenge []byte) RequestOptions {
+	return RequestOptions{
+		Challenge:        challenge,
+		Timeout:          cfg.Timeout,
+		RPID:             cfg.RPID,
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: "required",
+	}
+}
+
+// VerifyRegistration checks the response of create() for challenge and returns the new credential
+func (cfg Config) VerifyRegistration(challenge []byte, resp RegistrationResponse) (Credential, error) {
+	if resp.Type != "public-key" {
+		return Credential{}, errors.New("webauthn: credential type must be public-key")
+	}
+	if err := cfg.verifyClientData(resp.Response.ClientDataJSON, typeCreate, challenge); err != nil {
+		return Credential{}, err
+	}
+
+	v, n, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("webauthn: attestation object: %w", err)
+	}
+	attestation, ok := v.(map[any]any)
+	if !ok || n != len(resp.Response.AttestationObject) {
+		return Credential{}, errors.New("webauthn: invalid attestation object")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, errors.New("webauthn: attestation object without authData")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if err := cfg.verifyAuthenticatorData(authData); err != nil {
+		return Credential{}, err
+	}
+	if authData.Flags&FlagAttestedData == 0 {
+		return Credential{}, errors.New("webauthn: no attested credential data")
+	}
+	if len(resp.RawID) > 0 && !bytes.Equal(resp.RawID, authData.CredentialID) {
+		return Credential{}, errors.New("webauthn: rawId does not match the attested credential")
+	}
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return Credential{}, err
+	}
+
+	return Credential{
+		ID:        authData.CredentialID,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+		AAGUID:    authData.AAGUID,
+		Flags:     authData.Flags,
+	}, nil
+}
+
+// VerifyAssertion checks the response of get() for challenge against the stored public key
+// and signature counter of the credential
+func (cfg Config) VerifyAssertion(challenge []byte, resp AssertionResponse, publicKey []byte, signCount uint32) (Assertion, error) {
+	if resp.Type != "public-key" {
+		return Assertion{}, errors.New("webauthn: credential type must be public-key")
+	}
+	if err := cfg.verifyClientData(resp.Response.ClientDataJSON, typeGet, challenge); err != nil {
+		return Assertion{}, err
+	}
+
+	authData, err := parseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	if err := cfg.verifyAuthenticatorData(authData); err != nil {
+		return Assertion{}, err
+	}
+
+	key, err := parseCOSEKey(publicKey)
+	if err != nil {
+		return Assertion{}, err
+	}
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(slices.Clip(resp.Response.AuthenticatorData), clientDataHash[:]...)
+	if err := key.verify(signed, resp.Response.Signature); err != nil {
+		return Assertion{}, err
+	}
+
+	// Authenticators without a counter always send 0
+	if (authData.SignCount != 0 || signCount != 0) && authData.SignCount <= signCount {
+		return Assertion{}, ErrSignCountRegressed
+	}
+	return Assertion{SignCount: authData.SignCount, Flags: authData.Flags}, nil
+}
+
+func (cfg Config) verifyClientData(raw []byte, wantType string, challenge []byte) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("webauthn: client data: %w", err)
+	}
+	if data.Type != wantType {
+		return fmt.Errorf("webauthn: client data type must be %s", wantType)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(data.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("webauthn: challenge mismatch")
+	}
+	if !slices.Contains(cfg.Origins, data.Origin) {
+		return fmt.Errorf("webauthn: origin %q is not allowed", data.Origin)
+	}
+	if data.CrossOrigin {
+		return errors.New("webauthn: cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+func (cfg Config) verifyAuthenticatorData(authData authenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(cfg.RPID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return errors.New("webauthn: credential is for another relying party")
+	}
+	if authData.Flags&FlagUserPresent == 0 {
+		return errors.New("webauthn: user presence is required")
+	}
+	if authData.Flags&FlagUserVerified == 0 {
+		return errUserNotVerified
+	}
+	return nil
+}
+
+// parseAuthenticatorData splits authData into its fields, the attested credential data is
+// only present when FlagAttestedData is set
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("webauthn: authenticator data too short")
+	}
+	authData := authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	if authData.Flags&FlagAttestedData != 0 {
+		if len(rest) < 18 {
+			return authenticatorData{}, errors.New("webauthn: attested credential data too short")
+		}
+		authData.AAGUID = rest[:16]
+		idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLen == 0 || idLen > 1023 || len(rest) < idLen {
+			return authenticatorData{}, errors.New("webauthn: invalid credential id length")
+		}
+		authData.CredentialID = rest[:idLen]
+		rest = rest[idLen:]
+
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("webauthn: credential public key: %w", err)
+		}
+		authData.PublicKey = rest[:n]
+		rest = rest[n:]
+	}
+
+	if authData.Flags&FlagExtensionData != 0 {
+		_, n, err := decodeCBOR(rest)
+		if err != nil {
+			return authenticatorData{}, fmt.Errorf("webauthn: extensions: %w", err)
+		}
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return authenticatorData{}, errors.New("webauthn: trailing data after authenticator data")
+	}
+	return authData, nil
+}
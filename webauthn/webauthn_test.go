@@ -0,0 +1,108 @@
+package webauthn_test
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"personal_site/webauthn"
+	"personal_site/webauthn/webauthntest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = webauthn.Config{RPID: "example.com", RPName: "Example", Origins: []string{"https://example.com"}}
+
+func challenge(t *testing.T) []byte {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	require.NoError(t, err)
+	return b
+}
+
+func register(t *testing.T, authenticator *webauthntest.Authenticator) webauthn.Credential {
+	ch := challenge(t)
+	opts := testConfig.NewCreationOptions(webauthn.User{ID: []byte{1}, Name: "user@example.com"}, ch, nil)
+	resp, err := authenticator.Create(opts)
+	require.NoError(t, err)
+	cred, err := testConfig.VerifyRegistration(ch, resp)
+	require.NoError(t, err)
+	return cred
+}
+
+func TestRegistration(t *testing.T) {
+	authenticator := webauthntest.NewAuthenticator("https://example.com")
+	cred := register(t, authenticator)
+	assert.Len(t, cred.ID, 16)
+	assert.NotZero(t, cred.Flags&webauthn.FlagUserVerified)
+
+	ch := challenge(t)
+	opts := testConfig.NewCreationOptions(webauthn.User{ID: []byte{2}, Name: "other@example.com"}, ch, nil)
+	resp, err := authenticator.Create(opts)
+	require.NoError(t, err)
+
+	_, err = testConfig.VerifyRegistration(challenge(t), resp)
+	assert.Error(t, err, "Another challenge")
+
+	other := testConfig
+	other.RPID = "evil.example"
+	_, err = other.VerifyRegistration(ch, resp)
+	assert.Error(t, err, "Another relying party")
+
+	other = testConfig
+	other.Origins = []string{"https://evil.example"}
+	_, err = other.VerifyRegistration(ch, resp)
+	assert.Error(t, err, "Another origin")
+
+	authenticator.SkipUserVerification = true
+	resp, err = authenticator.Create(testConfig.NewCreationOptions(webauthn.User{ID: []byte{3}}, ch, nil))
+	require.NoError(t, err)
+	_, err = testConfig.VerifyRegistration(ch, resp)
+	assert.Error(t, err, "User verification is required")
+}
+
+func TestAssertion(t *testing.T) {
+	authenticator := webauthntest.NewAuthenticator("https://example.com")
+	cred := register(t, authenticator)
+
+	ch := challenge(t)
+	resp, err := authenticator.Get(testConfig.NewRequestOptions(ch))
+	require.NoError(t, err)
+	assertion, err := testConfig.VerifyAssertion(ch, resp, cred.PublicKey, cred.SignCount)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), assertion.SignCount)
+
+	_, err = testConfig.VerifyAssertion(challenge(t), resp, cred.PublicKey, cred.SignCount)
+	assert.Error(t, err, "Another challenge")
+	_, err = testConfig.VerifyAssertion(ch, resp, cred.PublicKey, assertion.SignCount)
+	assert.ErrorIs(t, err, webauthn.ErrSignCountRegressed, "Replayed assertion")
+
+	tampered := resp
+	tampered.Response.Signature = append([]byte{}, resp.Response.Signature...)
+	tampered.Response.Signature[len(tampered.Response.Signature)-1] ^= 1
+	_, err = testConfig.VerifyAssertion(ch, tampered, cred.PublicKey, cred.SignCount)
+	assert.Error(t, err, "Tampered signature")
+
+	otherCred := register(t, webauthntest.NewAuthenticator("https://example.com"))
+	_, err = testConfig.VerifyAssertion(ch, resp, otherCred.PublicKey, cred.SignCount)
+	assert.Error(t, err, "Key of another credential")
+
+	authenticator.FixedSignCount = true
+	ch = challenge(t)
+	resp, err = authenticator.Get(testConfig.NewRequestOptions(ch))
+	require.NoError(t, err)
+	_, err = testConfig.VerifyAssertion(ch, resp, cred.PublicKey, assertion.SignCount)
+	assert.ErrorIs(t, err, webauthn.ErrSignCountRegressed, "Cloned authenticator")
+}
+
+func TestURLEncodedBytes(t *testing.T) {
+	var b webauthn.URLEncodedBytes
+	require.NoError(t, b.UnmarshalJSON([]byte(`"AQI"`)))
+	assert.Equal(t, webauthn.URLEncodedBytes{1, 2}, b)
+	require.NoError(t, b.UnmarshalJSON([]byte(`"AQI="`)), "Padding is tolerated")
+	assert.Error(t, b.UnmarshalJSON([]byte(`"A+/"`)))
+
+	out, err := webauthn.URLEncodedBytes{0xfb, 0xff}.MarshalJSON()
+	require.NoError(t, err)
+	assert.Equal(t, `"-_8"`, string(out))
+}
@@ -0,0 +1,188 @@
+// Package webauthntest provides a software authenticator, so passkey ceremonies can be
+// tested without hardware
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"personal_site/webauthn"
+)
+
+// Authenticator is a software passkey provider that keeps ES256 discoverable credentials
+// in memory, like a platform authenticator of a browser would
+type Authenticator struct {
+	Origin string // origin reported in the client data
+
+	// Knobs to produce invalid responses, the defaults behave like a real authenticator
+	SkipUserVerification bool
+	FixedSignCount       bool // never increase the counter, like a cloned authenticator
+
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// NewAuthenticator returns an authenticator that runs ceremonies on origin
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// Create runs navigator.credentials.create with opts and stores the new credential
+func (a *Authenticator) Create(opts webauthn.CreationOptions) (webauthn.RegistrationResponse, error) {
+	if !slices.Contains(algorithms(opts), webauthn.AlgES256) {
+		return webauthn.RegistrationResponse{}, errors.New("webauthntest: ES256 was not offered")
+	}
+	for _, excluded := range opts.ExcludeCredentials {
+		if a.find(opts.RP.ID, excluded.ID) != nil {
+			return webauthn.RegistrationResponse{}, errors.New("webauthntest: credential already registered")
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return webauthn.RegistrationResponse{}, err
+	}
+	cred := &credential{id: make([]byte, 16), rpID: opts.RP.ID, userHandle: opts.User.ID, key: key}
+	if _, err := rand.Read(cred.id); err != nil {
+		return webauthn.RegistrationResponse{}, err
+	}
+
+	// A discoverable credential replaces the one of the same user
+	a.credentials = slices.DeleteFunc(a.credentials, func(c *credential) bool {
+		return c.rpID == cred.rpID && string(c.userHandle) == string(cred.userHandle)
+	})
+	a.credentials = append(a.credentials, cred)
+
+	attested := make([]byte, 0, 128)
+	attested = append(attested, make([]byte, 16)...) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(cred.id)))
+	attested = append(attested, cred.id...)
+	attested = append(attested, coseES256Key(&key.PublicKey)...)
+	authData := a.authenticatorData(cred, webauthn.FlagAttestedData, attested)
+
+	attestation := encodeCBOR(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+
+	var resp webauthn.RegistrationResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(cred.id)
+	resp.RawID = cred.id
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = a.clientData("webauthn.create", opts.Challenge)
+	resp.Response.AttestationObject = attestation
+	resp.Response.Transports = []string{"internal"}
+	return resp, nil
+}
+
+// Get runs navigator.credentials.get with opts. Without allowCredentials the credential of
+// the relying party created last is used.
+func (a *Authenticator) Get(opts webauthn.RequestOptions) (webauthn.AssertionResponse, error) {
+	var cred *credential
+	if len(opts.AllowCredentials) == 0 {
+		for _, c := range a.credentials {
+			if c.rpID == opts.RPID {
+				cred = c
+			}
+		}
+	}
+	for _, allowed := range opts.AllowCredentials {
+		if cred = a.find(opts.RPID, allowed.ID); cred != nil {
+			break
+		}
+	}
+	if cred == nil {
+		return webauthn.AssertionResponse{}, errors.New("webauthntest: no credential for the relying party")
+	}
+
+	if !a.FixedSignCount {
+		cred.signCount++
+	}
+	authData := a.authenticatorData(cred, 0, nil)
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(slices.Clip(authData), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return webauthn.AssertionResponse{}, err
+	}
+
+	var resp webauthn.AssertionResponse
+	resp.ID = base64.RawURLEncoding.EncodeToString(cred.id)
+	resp.RawID = cred.id
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = sig
+	resp.Response.UserHandle = cred.userHandle
+	return resp, nil
+}
+
+func (a *Authenticator) find(rpID string, id []byte) *credential {
+	for _, c := range a.credentials {
+		if c.rpID == rpID && string(c.id) == string(id) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) authenticatorData(cred *credential, flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	flags |= webauthn.FlagUserPresent
+	if !a.SkipUserVerification {
+		flags |= webauthn.FlagUserVerified
+	}
+
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, cred.signCount)
+	return append(data, attested...)
+}
+
+func (a *Authenticator) clientData(typ string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func algorithms(opts webauthn.CreationOptions) []int64 {
+	algs := make([]int64, 0, len(opts.PubKeyCredParams))
+	for _, p := range opts.PubKeyCredParams {
+		algs = append(algs, p.Alg)
+	}
+	return algs
+}
+
+// coseES256Key encodes key as a COSE_Key
+func coseES256Key(key *ecdsa.PublicKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return encodeCBOR(map[int64]any{
+		1:  int64(2),  // kty: EC2
+		3:  int64(-7), // alg: ES256
+		-1: int64(1),  // crv: P-256
+		-2: x,
+		-3: y,
+	})
+}
@@ -0,0 +1,67 @@
+package webauthntest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+// encodeCBOR encodes the values an authenticator sends: integers, byte and text strings and
+// maps of them. Map keys are sorted by their encoding, as CTAP2 canonical CBOR requires.
+func encodeCBOR(v any) []byte {
+	switch v := v.(type) {
+	case int64:
+		if v >= 0 {
+			return cborHead(0, uint64(v))
+		}
+		return cborHead(1, uint64(-1-v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case map[string]any:
+		entries := make([][2][]byte, 0, len(v))
+		for k, value := range v {
+			entries = append(entries, [2][]byte{encodeCBOR(k), encodeCBOR(value)})
+		}
+		return cborMap(entries)
+	case map[int64]any:
+		entries := make([][2][]byte, 0, len(v))
+		for k, value := range v {
+			entries = append(entries, [2][]byte{encodeCBOR(k), encodeCBOR(value)})
+		}
+		return cborMap(entries)
+	}
+	panic(fmt.Sprintf("webauthntest: cannot encode %T", v))
+}
+
+func cborMap(entries [][2][]byte) []byte {
+	slices.SortFunc(entries, func(a, b [2][]byte) int {
+		if len(a[0]) != len(b[0]) {
+			return len(a[0]) - len(b[0])
+		}
+		return bytes.Compare(a[0], b[0])
+	})
+	out := cborHead(5, uint64(len(entries)))
+	for _, e := range entries {
+		out = append(out, e[0]...)
+		out = append(out, e[1]...)
+	}
+	return out
+}
+
+func cborHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(n))
+	}
+	return binary.BigEndian.AppendUint64([]byte{major | 27}, n)
+}